@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// minKeyLen is the shortest API key accepted, in bytes.
+const minKeyLen = 16
+
+// APIKeys authenticates static API keys, each with a name.
+type APIKeys struct {
+	// Keys are looked up by their SHA-256, so that the lookup's timing
+	// says nothing about how much of a key was right.
+	names map[[sha256.Size]byte]string
+}
+
+// LoadAPIKeys reads a keys file: one "name key" pair per line, separated by
+// spaces or tabs. Blank lines and lines starting with # are skipped. Keys
+// must be unique and at least 16 bytes long; names need not be unique, so
+// a client's old and new keys can share its name while it rotates them.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("API keys: %w", err)
+	}
+	defer f.Close()
+	k := &APIKeys{names: make(map[[sha256.Size]byte]string)}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a name and a key", path, n)
+		}
+		name, key := fields[0], fields[1]
+		if len(key) < minKeyLen {
+			return nil, fmt.Errorf("%s:%d: key for %q is shorter than %d bytes", path, n, name, minKeyLen)
+		}
+		sum := sha256.Sum256([]byte(key))
+		if _, dup := k.names[sum]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate key", path, n)
+		}
+		k.names[sum] = name
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("API keys: %w", err)
+	}
+	if len(k.names) == 0 {
+		return nil, fmt.Errorf("API keys: %s has no keys", path)
+	}
+	return k, nil
+}
+
+// Authenticate implements Authenticator.
+func (k *APIKeys) Authenticate(token string) (Identity, error) {
+	name, ok := k.names[sha256.Sum256([]byte(token))]
+	if !ok {
+		return Identity{}, ErrUnrecognized
+	}
+	return Identity{Name: name, Method: "api_key"}, nil
+}
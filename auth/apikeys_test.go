@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeysAuthenticate(t *testing.T) {
+	path := writeFile(t, "keys", `# name key
+alice	alice-key-0123456789
+bob bob-key-0123456789
+
+  alice   alice-new-key-0123456789
+`)
+	k, err := LoadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token string
+		want  string // name, or "" for unrecognized
+	}{
+		{"alice-key-0123456789", "alice"},
+		{"alice-new-key-0123456789", "alice"},
+		{"bob-key-0123456789", "bob"},
+		{"bob-key-012345678", ""},
+		{"bob-key-01234567890", ""},
+		{"BOB-KEY-0123456789", ""},
+		{"bob", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		id, err := k.Authenticate(tt.token)
+		if tt.want == "" {
+			if !errors.Is(err, ErrUnrecognized) {
+				t.Errorf("Authenticate(%q) = %+v, %v; want ErrUnrecognized", tt.token, id, err)
+			}
+			continue
+		}
+		if err != nil || id != (Identity{Name: tt.want, Method: "api_key"}) {
+			t.Errorf("Authenticate(%q) = %+v, %v; want %s", tt.token, id, err, tt.want)
+		}
+	}
+}
+
+func TestLoadAPIKeysErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"empty", "# nobody\n\n", "has no keys"},
+		{"key only", "alice-key-0123456789\n", ":1: want a name and a key"},
+		{"extra field", "alice alice-key-0123456789 admin\n", ":1: want a name and a key"},
+		{"short key", "alice short\n", "shorter than 16 bytes"},
+		{"duplicate key", "alice alice-key-0123456789\nbob alice-key-0123456789\n", ":2: duplicate key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadAPIKeys(writeFile(t, "keys", tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadAPIKeys() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	keys, err := LoadAPIKeys(writeFile(t, "keys", "bob bob-key-0123456789\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Chain{keys, loadTestJWKS(t)}
+	if names := Names(c); len(names) != 1 || names[0] != "bob" {
+		t.Errorf("Names() = %q, want [bob]", names)
+	}
+	if id, err := c.Authenticate("bob-key-0123456789"); err != nil || id.Name != "bob" {
+		t.Errorf("API key: %+v, %v", id, err)
+	}
+	jwt := sign(map[string]any{"alg": "HS256", "kid": "k1"}, map[string]any{"sub": "alice", "iss": "https://issuer.example", "aud": "llmwt"}, secret1)
+	if id, err := c.Authenticate(jwt); err != nil || id.Name != "alice" {
+		t.Errorf("JWT: %+v, %v", id, err)
+	}
+	if _, err := c.Authenticate(jwt + "x"); err == nil || errors.Is(err, ErrUnrecognized) {
+		t.Errorf("JWT with a bad signature: %v", err)
+	}
+	if _, err := c.Authenticate("unknown"); !errors.Is(err, ErrUnrecognized) {
+		t.Errorf("unknown token: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+// Package auth authenticates the servers' clients by a bearer token: a
+// static API key (see LoadAPIKeys) or an HMAC-signed JWT verified against a
+// local JWKS file (see LoadJWKS). Clients send the token in an
+// Authorization: Bearer header or, since browsers' WebTransport and
+// EventSource APIs cannot set headers, in an access_token query parameter.
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TokenEnv is the environment variable the clients read their token from.
+// It is not a flag, so that it never shows up in process listings.
+const TokenEnv = "LLMWT_TOKEN"
+
+// Identity is an authenticated client.
+type Identity struct {
+	Name   string // the API key's name or the JWT's subject
+	Method string // "api_key" or "jwt", or "" for Anonymous
+}
+
+// Anonymous is every client's identity when authentication is off.
+var Anonymous = Identity{Name: "anonymous"}
+
+var (
+	// ErrNoToken means the request carried no token.
+	ErrNoToken = errors.New("no bearer token")
+	// ErrUnrecognized means the token is not one an Authenticator knows,
+	// so another may accept it.
+	ErrUnrecognized = errors.New("unrecognized token")
+)
+
+// Authenticator checks a bearer token.
+type Authenticator interface {
+	// Authenticate returns the token's identity, or an error wrapping
+	// ErrUnrecognized if the token is not of its kind or not known to it.
+	Authenticate(token string) (Identity, error)
+}
+
+// Chain accepts a token accepted by any of its authenticators, tried in
+// order.
+type Chain []Authenticator
+
+// Authenticate implements Authenticator. It stops at the first error other
+// than ErrUnrecognized, such as a JWT with a bad signature.
+func (c Chain) Authenticate(token string) (Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(token)
+		if err == nil || !errors.Is(err, ErrUnrecognized) {
+			return id, err
+		}
+	}
+	return Identity{}, ErrUnrecognized
+}
+
+// Names returns the identities a knows in advance, in no particular order:
+// the names of its API keys. A JWT's subject is known only once a token
+// arrives.
+func Names(a Authenticator) []string {
+	switch a := a.(type) {
+	case Chain:
+		var names []string
+		for _, b := range a {
+			names = append(names, Names(b)...)
+		}
+		return names
+	case *APIKeys:
+		var names []string
+		for _, name := range a.names {
+			names = append(names, name)
+		}
+		return names
+	}
+	return nil
+}
+
+// Token returns the bearer token of r, or "".
+func Token(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// Authenticate returns the identity of the client sending r. A nil
+// Authenticator means authentication is off: every client is Anonymous.
+func Authenticate(a Authenticator, r *http.Request) (Identity, error) {
+	if a == nil {
+		return Anonymous, nil
+	}
+	token := Token(r)
+	if token == "" {
+		return Identity{}, ErrNoToken
+	}
+	return a.Authenticate(token)
+}
+
+// Reason classifies an error from Authenticate, for metrics and the
+// WWW-Authenticate header: missing_token or invalid_token.
+func Reason(err error) string {
+	if errors.Is(err, ErrNoToken) {
+		return "missing_token"
+	}
+	return "invalid_token"
+}
+
+// Unauthorized writes the 401 response to a request that failed
+// Authenticate with err. The details of err are not sent.
+func Unauthorized(w http.ResponseWriter, err error) {
+	challenge := `Bearer realm="llm-webtransport"`
+	if !errors.Is(err, ErrNoToken) {
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// SetToken sets the Authorization header of an outgoing request to the
+// token in $LLMWT_TOKEN, if any.
+func SetToken(h http.Header) {
+	if token := os.Getenv(TokenEnv); token != "" {
+		h.Set("Authorization", "Bearer "+token)
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// leeway is the clock skew allowed when checking exp and nbf.
+const leeway = time.Minute
+
+// hashes are the JWT algorithms supported: HMAC with SHA-2.
+var hashes = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// JWKS authenticates JWTs signed with the HMAC keys of a JSON Web Key Set.
+type JWKS struct {
+	keys     []jwk
+	issuer   string // required iss, or ""
+	audience string // required in aud, or ""
+}
+
+type jwk struct {
+	kid, alg string // alg "" allows any HMAC algorithm
+	secret   []byte
+}
+
+// LoadJWKS reads a JWKS file of symmetric ("kty": "oct") keys, each with
+// its secret in "k" and optionally a "kid" and an "alg" of HS256, HS384 or
+// HS512. A token with a kid header is checked against the key with that
+// ID, and one without against every key. Unless empty, issuer must match a
+// token's iss claim and audience be among its aud.
+func LoadJWKS(path, issuer, audience string) (*JWKS, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("JWKS: %w", err)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("JWKS %s: %w", path, err)
+	}
+	j := &JWKS{issuer: issuer, audience: audience}
+	for i, k := range set.Keys {
+		if k.Kty != "oct" || k.Use != "" && k.Use != "sig" {
+			continue // not an HMAC signing key
+		}
+		if _, ok := hashes[k.Alg]; !ok && k.Alg != "" {
+			return nil, fmt.Errorf("JWKS %s: key %d: unsupported alg %q", path, i, k.Alg)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.K, "="))
+		if err != nil || len(secret) < minKeyLen {
+			return nil, fmt.Errorf("JWKS %s: key %d: k must be base64url, at least %d bytes", path, i, minKeyLen)
+		}
+		j.keys = append(j.keys, jwk{kid: k.Kid, alg: k.Alg, secret: secret})
+	}
+	if len(j.keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s: no HMAC signing keys", path)
+	}
+	return j, nil
+}
+
+// Authenticate implements Authenticator. A token that is not a JWT is
+// unrecognized; a JWT that fails verification is an error.
+func (j *JWKS) Authenticate(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrUnrecognized
+	}
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, fmt.Errorf("%w: header: %v", ErrUnrecognized, err)
+	}
+	newHash, ok := hashes[header.Alg]
+	if !ok {
+		return Identity{}, fmt.Errorf("JWT: unsupported alg %q", header.Alg)
+	}
+	if len(header.Crit) > 0 {
+		return Identity{}, errors.New("JWT: unsupported crit header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, errors.New("JWT: malformed signature")
+	}
+	if !j.verify(header.Kid, header.Alg, newHash, parts[0]+"."+parts[1], sig) {
+		return Identity{}, errors.New("JWT: bad signature")
+	}
+
+	var claims struct {
+		Sub string          `json:"sub"`
+		Iss string          `json:"iss"`
+		Aud json.RawMessage `json:"aud"`
+		Exp *float64        `json:"exp"`
+		Nbf *float64        `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, fmt.Errorf("JWT: claims: %w", err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Exp != nil && now.After(unixTime(*claims.Exp).Add(leeway)):
+		return Identity{}, errors.New("JWT: expired")
+	case claims.Nbf != nil && now.Before(unixTime(*claims.Nbf).Add(-leeway)):
+		return Identity{}, errors.New("JWT: not valid yet")
+	case claims.Sub == "":
+		return Identity{}, errors.New("JWT: no sub claim")
+	case j.issuer != "" && claims.Iss != j.issuer:
+		return Identity{}, fmt.Errorf("JWT: issuer %q not accepted", claims.Iss)
+	case j.audience != "" && !hasAudience(claims.Aud, j.audience):
+		return Identity{}, errors.New("JWT: audience not accepted")
+	}
+	return Identity{Name: claims.Sub, Method: "jwt"}, nil
+}
+
+// verify reports whether sig signs input with a key matching kid and alg.
+func (j *JWKS) verify(kid, alg string, newHash func() hash.Hash, input string, sig []byte) bool {
+	for _, k := range j.keys {
+		if kid != "" && k.kid != kid || k.alg != "" && k.alg != alg {
+			continue
+		}
+		mac := hmac.New(newHash, k.secret)
+		mac.Write([]byte(input))
+		if hmac.Equal(mac.Sum(nil), sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(s string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// unixTime converts a NumericDate claim, to the second.
+func unixTime(sec float64) time.Time { return time.Unix(int64(sec), 0) }
+
+// hasAudience reports whether an aud claim, a string or a list of them,
+// includes audience.
+func hasAudience(aud json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == audience
+	}
+	var list []string
+	return json.Unmarshal(aud, &list) == nil && slices.Contains(list, audience)
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	secret1 = []byte("first secret, 32 bytes long.....")
+	secret2 = []byte("second secret, at least 16")
+)
+
+// writeFile writes content to a file in a test directory and returns its
+// path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func segment(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b64(b)
+}
+
+// sign returns a JWT of header and claims signed with secret, using the
+// hash of header's alg, or HS256 for an algorithm it doesn't support.
+func sign(header, claims map[string]any, secret []byte) string {
+	input := segment(header) + "." + segment(claims)
+	newHash, ok := hashes[header["alg"].(string)]
+	if !ok {
+		newHash = hashes["HS256"]
+	}
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(input))
+	return input + "." + b64(mac.Sum(nil))
+}
+
+func loadTestJWKS(t *testing.T) *JWKS {
+	t.Helper()
+	path := writeFile(t, "jwks.json", `{"keys": [
+		{"kty": "oct", "kid": "k1", "alg": "HS256", "use": "sig", "k": "`+b64(secret1)+`"},
+		{"kty": "oct", "kid": "k2", "k": "`+b64(secret2)+`"},
+		{"kty": "RSA", "kid": "rsa", "n": "AQAB", "e": "AQAB"}
+	]}`)
+	j, err := LoadJWKS(path, "https://issuer.example", "llmwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestJWKSAuthenticate(t *testing.T) {
+	j := loadTestJWKS(t)
+	now := time.Now().Unix()
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "iss": "https://issuer.example", "aud": "llmwt", "exp": now + 3600}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	hs256 := map[string]any{"alg": "HS256", "kid": "k1", "typ": "JWT"}
+	valid := sign(hs256, claims(nil), secret1)
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		want  string // error text, or "" for alice
+	}{
+		{"valid", valid, ""},
+		{"no kid tries every key", sign(map[string]any{"alg": "HS512"}, claims(nil), secret2), ""},
+		{"aud list", sign(hs256, claims(map[string]any{"aud": []string{"other", "llmwt"}}), secret1), ""},
+		{"fractional dates", sign(hs256, claims(map[string]any{"exp": float64(now) + 0.5, "nbf": float64(now) - 0.5}), secret1), ""},
+		{"expired within leeway", sign(hs256, claims(map[string]any{"exp": now - 30}), secret1), ""},
+		{"no exp", sign(hs256, claims(map[string]any{"exp": nil}), secret1), ""},
+
+		{"alg none", segment(map[string]any{"alg": "none"}) + "." + parts[1] + ".", `unsupported alg "none"`},
+		{"alg none signed", sign(map[string]any{"alg": "none", "kid": "k1"}, claims(nil), secret1), `unsupported alg "none"`},
+		{"alg RS256", sign(map[string]any{"alg": "RS256", "kid": "rsa"}, claims(nil), secret1), `unsupported alg "RS256"`},
+		{"alg mismatch with key", sign(map[string]any{"alg": "HS384", "kid": "k1"}, claims(nil), secret1), "bad signature"},
+		{"wrong secret", sign(hs256, claims(nil), secret2), "bad signature"},
+		{"tampered claims", parts[0] + "." + segment(claims(map[string]any{"sub": "mallory"})) + "." + parts[2], "bad signature"},
+		{"unknown kid", sign(map[string]any{"alg": "HS256", "kid": "k9"}, claims(nil), secret1), "bad signature"},
+		{"malformed signature", parts[0] + "." + parts[1] + ".!!", "malformed signature"},
+		{"crit header", sign(map[string]any{"alg": "HS256", "kid": "k1", "crit": []string{"exp"}}, claims(nil), secret1), "crit"},
+		{"expired", sign(hs256, claims(map[string]any{"exp": now - 3600}), secret1), "expired"},
+		{"not yet valid", sign(hs256, claims(map[string]any{"nbf": now + 3600}), secret1), "not valid yet"},
+		{"wrong iss", sign(hs256, claims(map[string]any{"iss": "https://evil.example"}), secret1), "issuer"},
+		{"no iss", sign(hs256, claims(map[string]any{"iss": nil}), secret1), "issuer"},
+		{"wrong aud", sign(hs256, claims(map[string]any{"aud": "other"}), secret1), "audience"},
+		{"aud list without ours", sign(hs256, claims(map[string]any{"aud": []string{"a", "b"}}), secret1), "audience"},
+		{"no aud", sign(hs256, claims(map[string]any{"aud": nil}), secret1), "audience"},
+		{"no sub", sign(hs256, claims(map[string]any{"sub": nil}), secret1), "no sub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := j.Authenticate(tt.token)
+			if tt.want == "" {
+				if err != nil || id != (Identity{Name: "alice", Method: "jwt"}) {
+					t.Fatalf("Authenticate() = %+v, %v; want alice", id, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Authenticate() = %+v, %v; want error %q", id, err, tt.want)
+			}
+			// A JWT that fails verification must not fall through to
+			// another authenticator.
+			if errors.Is(err, ErrUnrecognized) {
+				t.Errorf("error %v is ErrUnrecognized", err)
+			}
+		})
+	}
+}
+
+func TestJWKSUnrecognized(t *testing.T) {
+	j := loadTestJWKS(t)
+	for _, token := range []string{"", "an-api-key-0123456789", "a.b", "a.b.c.d", "!!.e30.sig"} {
+		if _, err := j.Authenticate(token); !errors.Is(err, ErrUnrecognized) {
+			t.Errorf("Authenticate(%q) = %v, want ErrUnrecognized", token, err)
+		}
+	}
+}
+
+func TestLoadJWKSErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"not JSON", `{"keys": [`, "unexpected end"},
+		{"no HMAC keys", `{"keys": [{"kty": "RSA", "n": "AQAB"}]}`, "no HMAC signing keys"},
+		{"encryption key only", `{"keys": [{"kty": "oct", "use": "enc", "k": "` + b64(secret1) + `"}]}`, "no HMAC signing keys"},
+		{"unsupported alg", `{"keys": [{"kty": "oct", "alg": "none", "k": "` + b64(secret1) + `"}]}`, `unsupported alg "none"`},
+		{"short key", `{"keys": [{"kty": "oct", "k": "` + b64([]byte("short")) + `"}]}`, "at least 16 bytes"},
+		{"bad base64", `{"keys": [{"kty": "oct", "k": "not base64!"}]}`, "base64url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadJWKS(writeFile(t, "jwks.json", tt.content), "", "")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadJWKS() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+	if _, err := LoadJWKS(filepath.Join(t.TempDir(), "missing.json"), "", ""); err == nil {
+		t.Error("LoadJWKS() of a missing file succeeded")
+	}
+}
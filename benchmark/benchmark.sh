@@ -2,22 +2,53 @@
 set -euo pipefail
 
 # Network-conditioned benchmark runner (connection reuse mode)
-# Requires sudo for dnctl/pfctl (macOS dummynet) and tcpdump
+# On macOS: requires sudo for dnctl/pfctl (dummynet).
+# Elsewhere: uses the benchmark's in-process relays (-profile), no sudo.
 #
 # Pipes:
 #   pipe 1 — TCP port 8080  (HTTP SSE server)
 #   pipe 2 — UDP port 4433  (WebTransport server)
-#   pipe 3 — TCP port 11435 (Raw API → TLS proxy to Ollama)
+#   pipe 3 — TCP port 11435 (Raw API and Raw Native → TLS proxy to Ollama)
 
 SCRIPT_DIR="$(cd "$(dirname "$0")" && pwd)"
 PROJECT_DIR="$(cd "$SCRIPT_DIR/.." && pwd)"
 TIMESTAMP="$(date +%Y%m%d-%H%M%S)"
 RESULTS_FILE="$SCRIPT_DIR/results-${TIMESTAMP}.txt"
-PF_RULES_FILE="$(mktemp /tmp/benchmark-pf.XXXXXX)"
-PCAP_DIR="$(mktemp -d /tmp/benchmark-pcap.XXXXXX)"
 
 PROFILES="baseline latency-200ms loss-5pct bw-100kbps degraded"
 
+# Aggregate the per-profile JSON reports into markdown tables.
+write_report() {
+  local reports=()
+  for profile in $PROFILES; do
+    reports+=("$SCRIPT_DIR/results-${TIMESTAMP}-${profile}.json")
+  done
+  (cd "$PROJECT_DIR" && go run ./benchmark/ report -o "$SCRIPT_DIR/results-${TIMESTAMP}.md" "${reports[@]}")
+  echo "Markdown tables saved to: $SCRIPT_DIR/results-${TIMESTAMP}.md"
+}
+
+# Without dummynet, let the benchmark shape traffic itself. Wire bytes are
+# counted by the benchmark in both modes.
+if [ "$(uname)" != "Darwin" ]; then
+  echo "=== Network-Conditioned Benchmark (Connection Reuse, in-process relays) ==="
+  echo "Results will be saved to: $RESULTS_FILE"
+  for profile in $PROFILES; do
+    header="===== Profile: $profile ====="
+    echo ""
+    echo "$header"
+    echo "$header" >> "$RESULTS_FILE"
+    (cd "$PROJECT_DIR" && go run ./benchmark/ -reuse -profile "$profile" \
+      -json "$SCRIPT_DIR/results-${TIMESTAMP}-${profile}.json") 2>&1 | tee -a "$RESULTS_FILE"
+    echo "" >> "$RESULTS_FILE"
+  done
+  write_report
+  echo ""
+  echo "All profiles complete. Results saved to: $RESULTS_FILE"
+  exit 0
+fi
+
+PF_RULES_FILE="$(mktemp /tmp/benchmark-pf.XXXXXX)"
+
 # Map profile name to dnctl params
 profile_params() {
   case "$1" in
@@ -34,15 +65,11 @@ profile_params() {
 cleanup() {
   echo ""
   echo "Cleaning up..."
-  # Stop any lingering tcpdump
-  sudo kill "$TCPDUMP_PID" 2>/dev/null || true
   sudo pfctl -d 2>/dev/null || true
   sudo dnctl flush 2>/dev/null || true
   rm -f "$PF_RULES_FILE"
-  rm -rf "$PCAP_DIR"
   echo "Cleanup done."
 }
-TCPDUMP_PID=""
 trap cleanup EXIT
 
 # --- Helper: apply shaping for a profile ---
@@ -68,47 +95,6 @@ remove_shaping() {
   sudo dnctl flush 2>/dev/null || true
 }
 
-# --- Helper: analyze pcap wire bytes per port ---
-analyze_wire_bytes() {
-  local pcap_file="$1"
-  local label
-
-  echo ""
-  echo "Wire bytes (total on-the-wire including all protocol headers):"
-
-  for port_info in "11435:Raw API" "8080:HTTP SSE" "4433:WebTransport"; do
-    local port="${port_info%%:*}"
-    label="${port_info##*:}"
-    local filtered="$PCAP_DIR/filtered-${port}.pcap"
-
-    # Filter pcap by port into a separate file
-    sudo tcpdump -r "$pcap_file" "port $port" -w "$filtered" 2>/dev/null
-
-    if [ ! -f "$filtered" ]; then
-      echo "  $label (port $port): no packets captured"
-      continue
-    fi
-
-    # Count packets (tcpdump -nn to stdout, one line per packet)
-    local packets
-    packets=$(sudo tcpdump -r "$filtered" -nn -q 2>/dev/null | wc -l | tr -d ' ')
-
-    if [ "$packets" -eq 0 ] 2>/dev/null; then
-      echo "  $label (port $port): no packets captured"
-      rm -f "$filtered"
-      continue
-    fi
-
-    # Wire bytes = pcap file size - global header (24B) - per-packet headers (16B each)
-    local filesize
-    filesize=$(stat -f%z "$filtered")
-    local wire_bytes=$((filesize - 24 - packets * 16))
-
-    echo "  $label (port $port): $wire_bytes bytes over $packets packets ($(( wire_bytes / packets )) avg bytes/pkt)"
-    rm -f "$filtered"
-  done
-}
-
 # --- Main ---
 
 # Prompt for sudo once upfront and keep credentials cached.
@@ -136,25 +122,9 @@ for profile in $PROFILES; do
     apply_shaping "$params"
   fi
 
-  # Start packet capture
-  PCAP_FILE="$PCAP_DIR/${profile}.pcap"
-  sudo tcpdump -i lo0 -w "$PCAP_FILE" \
-    '(port 8080 or port 4433 or port 11435)' 2>/dev/null &
-  TCPDUMP_PID=$!
-  sleep 1  # let tcpdump initialize
-
   # Run the Go benchmark with connection reuse
-  (cd "$PROJECT_DIR" && go run ./benchmark/ -reuse) 2>&1 | tee -a "$RESULTS_FILE"
-
-  # Stop tcpdump
-  sudo kill "$TCPDUMP_PID" 2>/dev/null || true
-  wait "$TCPDUMP_PID" 2>/dev/null || true
-  TCPDUMP_PID=""
-  sleep 0.5  # let pcap flush
-
-  # Analyze wire bytes from pcap
-  analyze_wire_bytes "$PCAP_FILE" 2>&1 | tee -a "$RESULTS_FILE"
-  rm -f "$PCAP_FILE"
+  (cd "$PROJECT_DIR" && go run ./benchmark/ -reuse -profile-label "$profile" \
+    -json "$SCRIPT_DIR/results-${TIMESTAMP}-${profile}.json") 2>&1 | tee -a "$RESULTS_FILE"
 
   # Remove shaping between profiles
   if [ "$profile" != "baseline" ]; then
@@ -164,5 +134,6 @@ for profile in $PROFILES; do
   echo "" >> "$RESULTS_FILE"
 done
 
+write_report
 echo ""
 echo "All profiles complete. Results saved to: $RESULTS_FILE"
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+
+	"llm-webtransport/config"
+	"llm-webtransport/llm"
+)
+
+//go:embed prompts.jsonl
+var defaultPrompts string
+
+var (
+	promptFiles = config.List("prompts", "Load prompts from a JSONL file (repeatable, or comma-separated; default: the built-in set)")
+	sampleSize  = flag.Int("sample", 0, "Run a random sample of this many prompts from the corpus (with replacement if larger than the corpus)")
+	shuffle     = flag.Bool("shuffle", false, "Shuffle the prompt order")
+	repeat      = flag.Int("repeat", 1, "Run the prompt list this many times")
+	promptSeed  = flag.Int64("seed", 1, "Seed for -sample and -shuffle")
+)
+
+// Prompt is one benchmark request: a conversation whose last message is
+// the user turn to answer.
+type Prompt struct {
+	ID             string
+	Messages       []llm.Message
+	MaxTokens      int // cap on the response length, 0 for the model default
+	ExpectedTokens int // expected response length, for reporting only
+}
+
+// Text returns the final user message.
+func (p Prompt) Text() string { return p.Messages[len(p.Messages)-1].Content }
+
+// History returns the turns before the final user message.
+func (p Prompt) History() []llm.Message { return p.Messages[:len(p.Messages)-1] }
+
+// Options returns the generation options every approach sends with p: the
+// -model, its MaxTokens and the -llm-seed.
+func (p Prompt) Options() llm.Options {
+	opts := llm.Options{Model: *llmModel, MaxTokens: p.MaxTokens}
+	if *llmSeed >= 0 {
+		opts.Seed = llmSeed
+	}
+	return opts
+}
+
+// promptEntry is one line of a prompt file. Either prompt or messages is
+// required; with both, prompt is appended to messages as the final user
+// turn.
+type promptEntry struct {
+	ID             string        `json:"id"`
+	Prompt         string        `json:"prompt"`
+	Messages       []llm.Message `json:"messages"`
+	MaxTokens      int           `json:"max_tokens"`
+	ExpectedTokens int           `json:"expected_tokens"`
+}
+
+// readPrompts parses a JSONL prompt file. Blank lines are skipped.
+func readPrompts(r io.Reader, name string) ([]Prompt, error) {
+	var out []Prompt
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var e promptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		msgs := e.Messages
+		if e.Prompt != "" {
+			msgs = append(msgs, llm.Message{Role: llm.RoleUser, Content: e.Prompt})
+		}
+		if len(msgs) == 0 {
+			return nil, fmt.Errorf("%s:%d: prompt or messages is required", name, line)
+		}
+		if err := llm.ValidateMessages(msgs); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		if e.ID == "" {
+			e.ID = fmt.Sprintf("%s:%d", name, line)
+		}
+		out = append(out, Prompt{ID: e.ID, Messages: msgs, MaxTokens: e.MaxTokens, ExpectedTokens: e.ExpectedTokens})
+	}
+	return out, scanner.Err()
+}
+
+// loadPrompts reads the -prompts files (or the built-in set) and applies
+// -sample, -repeat and -shuffle.
+func loadPrompts() ([]Prompt, error) {
+	var corpus []Prompt
+	if len(*promptFiles) == 0 {
+		var err error
+		corpus, err = readPrompts(strings.NewReader(defaultPrompts), "prompts.jsonl")
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range *promptFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		ps, err := readPrompts(f, path)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		corpus = append(corpus, ps...)
+	}
+	if len(corpus) == 0 {
+		return nil, fmt.Errorf("no prompts in %s", strings.Join(*promptFiles, ", "))
+	}
+
+	rng := rand.New(rand.NewSource(*promptSeed))
+	if n := *sampleSize; n > 0 {
+		var sample []Prompt
+		if n <= len(corpus) {
+			for _, i := range rng.Perm(len(corpus))[:n] {
+				sample = append(sample, corpus[i])
+			}
+		} else {
+			for range n {
+				sample = append(sample, corpus[rng.Intn(len(corpus))])
+			}
+		}
+		corpus = sample
+	}
+	var out []Prompt
+	for range max(*repeat, 1) {
+		out = append(out, corpus...)
+	}
+	if *shuffle {
+		rng.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	}
+	return out, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	concurrency = flag.Int("concurrency", 0, "Run a load test with this many virtual clients per approach instead of the serial prompt list")
+	duration    = flag.Duration("duration", 30*time.Second, "How long a load test issues new requests")
+	rate        = flag.Float64("rate", 0, "Open-loop arrival rate in requests/s shared by the virtual clients (0 = closed loop)")
+	sessions    = flag.Int("sessions", 0, "With -reuse, WebTransport sessions shared by the virtual clients as streams (0 = one per client)")
+)
+
+// LoadConfig records the load-test settings in a report.
+type LoadConfig struct {
+	Concurrency int     `json:"concurrency"`
+	Duration    string  `json:"duration"`
+	Rate        float64 `json:"rate,omitempty"`
+	Sessions    int     `json:"sessions,omitempty"`
+}
+
+// approach creates the runners of one streaming approach for a load test.
+// All runners of an approach count their traffic with the same meter.
+type approach struct {
+	name      string
+	meter     *wireMeter
+	newRunner func(client int) (Runner, error)
+}
+
+func loadApproaches(proxyAddr string) []approach {
+	newHTTP := func(name string, mk func(m *wireMeter, client *http.Client) Runner) approach {
+		m := newTCPMeter()
+		return approach{name, m, func(int) (Runner, error) {
+			var c *http.Client
+			if *reuseConn {
+				// One connection pool per virtual client, as for real users.
+				c = &http.Client{Transport: newTransport(m, true)}
+			}
+			return mk(m, c), nil
+		}}
+	}
+	approaches := []approach{
+		newHTTP("Raw API", func(m *wireMeter, c *http.Client) Runner {
+			return &rawAPIRunner{proxyAddr: proxyAddr, client: c, meter: m}
+		}),
+		newHTTP("Raw Native", func(m *wireMeter, c *http.Client) Runner {
+			return &rawAPIRunner{proxyAddr: proxyAddr, native: true, client: c, meter: m}
+		}),
+		newHTTP("HTTP SSE", func(m *wireMeter, c *http.Client) Runner {
+			return &httpSSERunner{client: c, meter: m}
+		}),
+	}
+
+	// Check connectivity once rather than per client.
+	if _, err := newWebtransportRunner(false, newUDPMeter()); err != nil {
+		fmt.Printf("Warning: WebTransport unavailable: %v\n", err)
+		return approaches
+	}
+	m := newUDPMeter()
+	var shared []*webtransportRunner
+	approaches = append(approaches, approach{"WebTransport", m, func(client int) (Runner, error) {
+		if !*reuseConn {
+			return &webtransportRunner{meter: m}, nil
+		}
+		if *sessions <= 0 {
+			return newWebtransportRunner(true, m)
+		}
+		// Clients are created in order, so the first -sessions of them
+		// open the sessions and the rest share them round-robin.
+		if client < *sessions {
+			r, err := newWebtransportRunner(true, m)
+			if err != nil {
+				return nil, err
+			}
+			shared = append(shared, r)
+			return r, nil
+		}
+		return shared[client%len(shared)], nil
+	}})
+	if *datagrams {
+		// Each receiver needs its own session: datagrams of a shared
+		// session would be consumed by whichever client reads first.
+		m := newUDPMeter()
+		approaches = append(approaches, approach{"WT Datagram", m, func(int) (Runner, error) {
+			r, err := newWebtransportRunner(*reuseConn, m)
+			if err != nil {
+				return nil, err
+			}
+			return &webtransportDatagramRunner{*r}, nil
+		}})
+	}
+	return approaches
+}
+
+// loadSample is one request made during a load test.
+type loadSample struct {
+	prompt int
+	res    Result
+	err    error
+	wait   time.Duration // open loop: time queued before a client was free
+}
+
+// loadStats summarizes a load test of one approach.
+type loadStats struct {
+	requests, errors int
+	tokens           int
+	elapsed          time.Duration
+	ttfts, tbts      []time.Duration // sorted
+	waits            []time.Duration // sorted, open loop only
+	wire             WireStats
+	wireBytes        int64
+}
+
+// runLoad drives clients virtual clients against one approach for
+// -duration. In closed loop each client sends its next prompt as soon as
+// the previous response ends; with -rate, requests arrive as a Poisson
+// process regardless of completions and wait for a free client.
+func runLoad(a approach, clients int) ([]loadSample, loadStats, error) {
+	var runners []Runner
+	for i := range clients {
+		r, err := a.newRunner(i)
+		if err != nil {
+			for _, r := range runners {
+				r.Close()
+			}
+			return nil, loadStats{}, fmt.Errorf("client %d: %w", i, err)
+		}
+		runners = append(runners, r)
+	}
+	defer func() {
+		// Shared runners appear more than once; close each once.
+		seen := make(map[Runner]bool)
+		for _, r := range runners {
+			if !seen[r] {
+				seen[r] = true
+				r.Close()
+			}
+		}
+	}()
+
+	var (
+		mu      sync.Mutex
+		samples []loadSample
+		next    atomic.Int64
+		wg      sync.WaitGroup
+	)
+	record := func(s loadSample) {
+		mu.Lock()
+		samples = append(samples, s)
+		mu.Unlock()
+	}
+	run := func(r Runner, wait time.Duration) {
+		i := int(next.Add(1)-1) % len(prompts)
+		res, err := runTraced(r, prompts[i])
+		record(loadSample{prompt: i, res: res, err: err, wait: wait})
+	}
+
+	wireBefore := a.meter.snapshot()
+	start := time.Now()
+	deadline := start.Add(*duration)
+	if *rate > 0 {
+		arrivals := make(chan time.Time, int(*rate*duration.Seconds())+1)
+		go func() {
+			defer close(arrivals)
+			rng := rand.New(rand.NewSource(1))
+			at := start
+			for {
+				at = at.Add(time.Duration(rng.ExpFloat64() / *rate * float64(time.Second)))
+				if at.After(deadline) {
+					return
+				}
+				time.Sleep(time.Until(at))
+				arrivals <- at
+			}
+		}()
+		for _, r := range runners {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for at := range arrivals {
+					run(r, time.Since(at))
+				}
+			}()
+		}
+	} else {
+		for _, r := range runners {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					run(r, 0)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	s := loadStats{elapsed: time.Since(start), requests: len(samples)}
+	s.wire = a.meter.snapshot().Sub(wireBefore)
+	s.wireBytes = s.wire.Total(a.meter.headerBytes)
+	for _, smp := range samples {
+		if smp.err != nil {
+			s.errors++
+			continue
+		}
+		s.tokens += smp.res.TokenCount
+		if smp.res.TokenCount > 0 {
+			s.ttfts = append(s.ttfts, smp.wait+smp.res.TTFT)
+		}
+		for i := 1; i < len(smp.res.TokenTimes); i++ {
+			s.tbts = append(s.tbts, smp.res.TokenTimes[i]-smp.res.TokenTimes[i-1])
+		}
+		if *rate > 0 {
+			s.waits = append(s.waits, smp.wait)
+		}
+	}
+	slices.Sort(s.ttfts)
+	slices.Sort(s.tbts)
+	slices.Sort(s.waits)
+	return samples, s, nil
+}
+
+// runLoadTest runs the load test for every approach, prints a summary table
+// and adds each request to report.
+func runLoadTest(proxyAddr string, report *Report) {
+	report.Load = &LoadConfig{Concurrency: *concurrency, Duration: duration.String(), Rate: *rate, Sessions: *sessions}
+	loop := "closed loop"
+	if *rate > 0 {
+		loop = fmt.Sprintf("open loop, %.1f req/s", *rate)
+	}
+	if *sessions > 0 && !*reuseConn {
+		fmt.Println("Warning: -sessions has no effect without -reuse")
+	}
+
+	approaches := loadApproaches(proxyAddr)
+	results := make(map[string]loadStats)
+	for _, a := range approaches {
+		fmt.Printf("\n=== %s: %d clients, %v, %s ===\n", a.name, *concurrency, *duration, loop)
+		samples, s, err := runLoad(a, *concurrency)
+		if err != nil {
+			fmt.Printf("  ERROR: %v\n", err)
+			continue
+		}
+		for _, smp := range samples {
+			pr := newPromptResult(a.name, smp.prompt, prompts[smp.prompt], smp.res, smp.err)
+			pr.QueueMs = ms(smp.wait)
+			report.Prompts = append(report.Prompts, pr)
+		}
+		fmt.Printf("  %d requests, %d errors in %v\n", s.requests, s.errors, s.elapsed.Round(time.Millisecond))
+		results[a.name] = s
+	}
+
+	// TTFT is measured from the request's arrival, so in open loop it
+	// includes time spent waiting for a free client.
+	fmt.Printf("\n%-15s | %8s | %6s | %7s | %8s | %9s | %9s | %9s | %8s | %8s | %8s | %9s\n",
+		"Approach", "Requests", "Err %", "Req/s", "Tok/s", "TTFT p50", "TTFT p90", "TTFT p99", "TBT p50", "TBT p90", "TBT p99", "Wire KB/s")
+	fmt.Println(strings.Repeat("-", 134))
+	for _, a := range approaches {
+		s, ok := results[a.name]
+		if !ok || s.requests == 0 {
+			fmt.Printf("%-15s | %8s |\n", a.name, "N/A")
+			continue
+		}
+		secs := s.elapsed.Seconds()
+		p := func(d []time.Duration, q float64) time.Duration {
+			return percentile(d, q).Round(time.Millisecond)
+		}
+		fmt.Printf("%-15s | %8d | %6.1f | %7.2f | %8.1f | %9v | %9v | %9v | %8v | %8v | %8v | %9.1f\n",
+			a.name, s.requests, 100*float64(s.errors)/float64(s.requests),
+			float64(s.requests-s.errors)/secs, float64(s.tokens)/secs,
+			p(s.ttfts, 50), p(s.ttfts, 90), p(s.ttfts, 99),
+			p(s.tbts, 50), p(s.tbts, 90), p(s.tbts, 99),
+			float64(s.wireBytes)/secs/1000)
+		if len(s.waits) > 0 {
+			fmt.Printf("%-15s   queue wait p50 %v, p99 %v\n", "", p(s.waits, 50), p(s.waits, 99))
+		}
+	}
+}
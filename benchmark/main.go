@@ -3,28 +3,69 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"math"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"slices"
 	"strings"
 	"time"
 
+	"llm-webtransport/auth"
+	"llm-webtransport/config"
+	"llm-webtransport/llm"
 	"llm-webtransport/message"
+	"llm-webtransport/mockllm"
+	"llm-webtransport/netem"
+	"llm-webtransport/sse"
+	"llm-webtransport/tracing"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/webtransport-go"
 )
 
-var reuseConn = flag.Bool("reuse", false, "Reuse connections across prompts (simulates persistent browser connection)")
+var (
+	reuseConn = flag.Bool("reuse", false, "Reuse connections across prompts (simulates persistent browser connection)")
+	mockLLM   = flag.Bool("mock", false, "Serve a deterministic mock LLM on the Ollama address instead of using Ollama")
+
+	legacyFraming = flag.Bool("legacy-framing", false, "Use the legacy length-prefixed text framing for WebTransport")
+	datagrams     = flag.Bool("datagrams", false, "Also benchmark WebTransport with tokens delivered as datagrams")
+	profile       = flag.String("profile", "", "Network profile applied by in-process relays (built-in name or delay=,jitter=,loss=,reorder=,bw= spec)")
+
+	profileLabel = flag.String("profile-label", "", "Profile name recorded in reports when traffic is shaped externally (e.g. by dummynet)")
+
+	jsonOut = flag.String("json", "", "Write a JSON report with per-prompt results and token timings to this file")
+	csvOut  = flag.String("csv", "", "Write per-prompt results as CSV to this file")
+
+	dropAfter = flag.Int("drop-after", 0, "Drop the HTTP SSE connection or WebTransport session after this many tokens of each response and resume it")
+
+	llmSeed = flag.Int64("llm-seed", -1, "Sampling seed sent with every request so that all approaches get the same replies (-1 = none)")
+)
+
+// maxReconnects bounds how often a runner resumes one response.
+const maxReconnects = 5
+
+// Endpoints and settings shared by the runners; -profile points the
+// endpoints at relays.
+var (
+	wtURL       = config.URL("wt-url", "https://localhost:4433/wt", "WebTransport server endpoint")
+	sseURL      = config.URL("sse-url", "https://localhost:8080/chat", "HTTP SSE server endpoint")
+	ollamaAddr  = config.Addr("ollama", "127.0.0.1:11434", "Ollama (or -mock) address, called directly by the raw runners")
+	proxyListen = config.Addr("proxy-addr", "127.0.0.1:11435", "Listen address of the TLS proxy in front of Ollama")
+	llmModel    = flag.String("model", "gemma3:12b", "Model every approach requests")
+	tlsConf     = config.TLSFlags()
+	traceConf   = config.TracingFlags()
+)
 
 // CountingReader wraps an io.Reader and counts bytes read through it.
 type CountingReader struct {
@@ -45,21 +86,47 @@ type Result struct {
 	TokenCount          int
 	TotalInterTokenTime time.Duration
 	TotalTime           time.Duration
+	Repaired            int             // tokens recovered over the stream after datagram loss
+	TokenTimes          []time.Duration // when each token arrived (or was shown), relative to the request
+
+	// Socket-level traffic during the prompt, filled in by main from the
+	// runner's wireMeter. WireBytes adds estimated IP/UDP/TCP headers.
+	Wire           WireStats
+	WireBytes      int64
+	HandshakeBytes int64 // connection setup, when this prompt opened a connection
+
+	Reconnects   int           // times the response was resumed after losing the connection
+	RecoveryTime time.Duration // total time from losing the connection to the next token
 }
 
 // Runner is the interface each streaming approach implements.
 type Runner interface {
 	Name() string
-	Run(prompt string) (Result, error)
+	Run(ctx context.Context, p Prompt) (Result, error)
 	Close() error
+	wire() *wireMeter
+}
+
+// runTraced runs p on r as a trace of its own, with the runner's dials and
+// requests as child spans.
+func runTraced(r Runner, p Prompt) (Result, error) {
+	ctx, span := tracing.Start(context.Background(), "benchmark "+r.Name(), tracing.Client)
+	res, err := r.Run(ctx, p)
+	span.Set("tokens", res.TokenCount)
+	span.Set("ttft", res.TTFT)
+	span.Set("reconnects", res.Reconnects)
+	span.End(err)
+	return res, err
 }
 
 // --- LLM request/response types (local copies) ---
 
 type chatRequest struct {
-	Model    string        `json:"model"`
-	Messages []chatMessage `json:"messages"`
-	Stream   bool          `json:"stream"`
+	Model     string        `json:"model"`
+	Messages  []chatMessage `json:"messages"`
+	Stream    bool          `json:"stream"`
+	MaxTokens int           `json:"max_tokens,omitempty"`
+	Seed      *int64        `json:"seed,omitempty"`
 }
 
 type chatMessage struct {
@@ -75,29 +142,36 @@ type chatChunk struct {
 	} `json:"choices"`
 }
 
-// --- HTTP SSE request type ---
+type nativeChatRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+	Options  struct {
+		NumPredict int    `json:"num_predict,omitempty"`
+		Seed       *int64 `json:"seed,omitempty"`
+	} `json:"options"`
+}
 
-type httpChatRequest struct {
-	Message string `json:"message"`
+type nativeChatChunk struct {
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done  bool   `json:"done"`
+	Error string `json:"error"`
 }
 
-// --- Prompts ---
+// --- HTTP SSE request type ---
 
-var prompts = []string{
-	"What is the capital of France?",
-	"Explain the difference between a stack and a queue.",
-	"Write a haiku about programming.",
-	"What are the first 10 prime numbers?",
-	"Explain how a hash table works in simple terms.",
-	"Write a short Go function that reverses a string.",
-	"What causes a rainbow to appear?",
-	"Compare TCP and UDP in three sentences.",
-	"What is the time complexity of binary search and why?",
-	"Describe the observer design pattern briefly.",
+type httpChatRequest struct {
+	Messages []llm.Message `json:"messages"`
+	llm.Options
 }
 
-// startTLSProxy starts a TLS reverse proxy to Ollama so the Raw API runner
-// pays the same TCP+TLS handshake cost as other approaches.
+// prompts is the prompt list, loaded by main (see loadPrompts).
+var prompts []Prompt
+
+// startTLSProxy starts a TLS reverse proxy to Ollama so the raw runners
+// pay the same TCP+TLS handshake cost as other approaches.
 func startTLSProxy(ollamaAddr string) (string, error) {
 	target, err := url.Parse("http://" + ollamaAddr)
 	if err != nil {
@@ -105,12 +179,12 @@ func startTLSProxy(ollamaAddr string) (string, error) {
 	}
 	proxy := httputil.NewSingleHostReverseProxy(target)
 
-	tlsCert, err := tls.LoadX509KeyPair("certs/cert.pem", "certs/key.pem")
+	tlsCert, err := tlsConf.Load()
 	if err != nil {
-		return "", fmt.Errorf("load TLS cert: %w", err)
+		return "", err
 	}
 
-	ln, err := tls.Listen("tcp", "127.0.0.1:11435", &tls.Config{
+	ln, err := tls.Listen("tcp", *proxyListen, &tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
 	})
 	if err != nil {
@@ -121,24 +195,75 @@ func startTLSProxy(ollamaAddr string) (string, error) {
 	return ln.Addr().(*net.TCPAddr).String(), nil
 }
 
+// startRelays puts impairment relays in front of the three servers and
+// points the runners at them. Like the dummynet setup, the leg from the
+// servers to Ollama is left unshaped.
+func startRelays(p netem.Profile, proxyAddr *string) ([]*netem.Relay, error) {
+	wtTarget, err := url.Parse(*wtURL)
+	if err != nil {
+		return nil, err
+	}
+	sseTarget, err := url.Parse(*sseURL)
+	if err != nil {
+		return nil, err
+	}
+	wt, err := netem.ListenUDP("127.0.0.1:0", wtTarget.Host, p)
+	if err != nil {
+		return nil, fmt.Errorf("WebTransport relay: %w", err)
+	}
+	sse, err := netem.ListenTCP("127.0.0.1:0", sseTarget.Host, p)
+	if err != nil {
+		wt.Close()
+		return nil, fmt.Errorf("HTTP SSE relay: %w", err)
+	}
+	raw, err := netem.ListenTCP("127.0.0.1:0", *proxyAddr, p)
+	if err != nil {
+		wt.Close()
+		sse.Close()
+		return nil, fmt.Errorf("Raw API relay: %w", err)
+	}
+	wtTarget.Host, sseTarget.Host = wt.Addr().String(), sse.Addr().String()
+	*wtURL, *sseURL = wtTarget.String(), sseTarget.String()
+	*proxyAddr = raw.Addr().String()
+	return []*netem.Relay{wt, sse, raw}, nil
+}
+
 // =============================================
 // rawAPIRunner — direct Ollama API (via TLS proxy)
 // =============================================
 
+// rawAPIRunner calls Ollama directly, through its OpenAI-compatible
+// endpoint or, if native is set, its own /api/chat.
 type rawAPIRunner struct {
 	proxyAddr string
+	native    bool
 	client    *http.Client // non-nil when reusing connections
+	meter     *wireMeter
 }
 
-func (r *rawAPIRunner) Name() string { return "Raw API" }
-func (r *rawAPIRunner) Close() error { return nil }
+func (r *rawAPIRunner) Name() string {
+	if r.native {
+		return "Raw Native"
+	}
+	return "Raw API"
+}
+func (r *rawAPIRunner) Close() error     { return nil }
+func (r *rawAPIRunner) wire() *wireMeter { return r.meter }
 
-func (r *rawAPIRunner) Run(prompt string) (Result, error) {
-	body, err := json.Marshal(chatRequest{
-		Model:    "gemma3:12b",
-		Messages: []chatMessage{{Role: "user", Content: prompt}},
-		Stream:   true,
-	})
+func (r *rawAPIRunner) Run(ctx context.Context, p Prompt) (Result, error) {
+	var messages []chatMessage
+	for _, m := range p.Messages {
+		messages = append(messages, chatMessage{Role: m.Role, Content: m.Content})
+	}
+	path := "/v1/chat/completions"
+	opts := p.Options()
+	var req any = chatRequest{Model: *llmModel, Messages: messages, Stream: true, MaxTokens: opts.MaxTokens, Seed: opts.Seed}
+	if r.native {
+		nreq := nativeChatRequest{Model: *llmModel, Messages: messages, Stream: true}
+		nreq.Options.NumPredict, nreq.Options.Seed = opts.MaxTokens, opts.Seed
+		path, req = "/api/chat", nreq
+	}
+	body, err := json.Marshal(req)
 	if err != nil {
 		return Result{}, err
 	}
@@ -146,41 +271,22 @@ func (r *rawAPIRunner) Run(prompt string) (Result, error) {
 	client := r.client
 	if client == nil {
 		// Fresh TCP+TLS connection per prompt.
-		client = &http.Client{
-			Transport: &http.Transport{
-				DisableKeepAlives: true,
-				TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
-			},
-		}
+		client = &http.Client{Transport: newTransport(r.meter, false)}
 	}
 	start := time.Now()
-	resp, err := client.Post("https://"+r.proxyAddr+"/v1/chat/completions", "application/json", bytes.NewReader(body))
+	resp, err := post(ctx, client, "https://"+r.proxyAddr+path, nil, body)
 	if err != nil {
 		return Result{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Result{}, fmt.Errorf("API returned %s", resp.Status)
+	}
 
 	cr := &CountingReader{r: resp.Body}
-	scanner := bufio.NewScanner(cr)
 	var res Result
 	var lastToken time.Time
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			break
-		}
-		var chunk chatChunk
-		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
-			continue
-		}
-		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
-			continue
-		}
+	onToken := func() {
 		now := time.Now()
 		if res.TokenCount == 0 {
 			res.TTFT = now.Sub(start)
@@ -189,13 +295,94 @@ func (r *rawAPIRunner) Run(prompt string) (Result, error) {
 		}
 		lastToken = now
 		res.TokenCount++
+		res.TokenTimes = append(res.TokenTimes, now.Sub(start))
+	}
+	if r.native {
+		err = readNativeStream(cr, onToken)
+	} else {
+		err = readOpenAIStream(cr, onToken)
+	}
+	if err != nil {
+		return Result{}, err
 	}
 	// Drain remaining response body so the HTTP transport sees EOF
 	// and returns the connection to the keep-alive pool.
 	io.Copy(io.Discard, resp.Body)
 	res.BytesReceived = cr.Count
 	res.TotalTime = time.Since(start)
-	return res, scanner.Err()
+	return res, nil
+}
+
+// post sends a JSON request body, with the given headers and the trace
+// context of ctx.
+func post(ctx context.Context, client *http.Client, url string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(req.Header, header)
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+	return client.Do(req)
+}
+
+// tokenHeader returns the headers authenticating the benchmark to the
+// servers: the token in $LLMWT_TOKEN, if any.
+func tokenHeader() http.Header {
+	h := make(http.Header)
+	auth.SetToken(h)
+	return h
+}
+
+// readOpenAIStream reads OpenAI chat completion chunks up to [DONE],
+// calling onToken for each one carrying content.
+func readOpenAIStream(r io.Reader, onToken func()) error {
+	events := sse.NewReader(r)
+	for {
+		ev, err := events.Next()
+		if err == io.EOF || err == nil && ev.Data == "[DONE]" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var chunk chatChunk
+		if err := json.Unmarshal([]byte(ev.Data), &chunk); err != nil {
+			continue
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			onToken()
+		}
+	}
+}
+
+// readNativeStream reads Ollama's newline-delimited JSON chunks up to the
+// final "done" one, calling onToken for each one carrying content.
+func readNativeStream(r io.Reader, onToken func()) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var chunk nativeChatChunk
+			if json.Unmarshal(line, &chunk) == nil {
+				if chunk.Error != "" {
+					return fmt.Errorf("API error: %s", chunk.Error)
+				}
+				if chunk.Message.Content != "" {
+					onToken()
+				}
+				if chunk.Done {
+					return nil
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
 // =============================================
@@ -204,13 +391,15 @@ func (r *rawAPIRunner) Run(prompt string) (Result, error) {
 
 type httpSSERunner struct {
 	client *http.Client // non-nil when reusing connections
+	meter  *wireMeter
 }
 
-func (r *httpSSERunner) Name() string { return "HTTP SSE" }
-func (r *httpSSERunner) Close() error { return nil }
+func (r *httpSSERunner) Name() string     { return "HTTP SSE" }
+func (r *httpSSERunner) Close() error     { return nil }
+func (r *httpSSERunner) wire() *wireMeter { return r.meter }
 
-func (r *httpSSERunner) Run(prompt string) (Result, error) {
-	body, err := json.Marshal(httpChatRequest{Message: prompt})
+func (r *httpSSERunner) Run(ctx context.Context, p Prompt) (Result, error) {
+	body, err := json.Marshal(httpChatRequest{Messages: p.Messages, Options: p.Options()})
 	if err != nil {
 		return Result{}, err
 	}
@@ -218,35 +407,63 @@ func (r *httpSSERunner) Run(prompt string) (Result, error) {
 	client := r.client
 	if client == nil {
 		// Fresh TCP+TLS connection per prompt.
-		client = &http.Client{
-			Transport: &http.Transport{
-				DisableKeepAlives: true,
-				TLSClientConfig:  &tls.Config{InsecureSkipVerify: true},
-			},
-		}
+		client = &http.Client{Transport: newTransport(r.meter, false)}
 	}
 	start := time.Now()
-	resp, err := client.Post("https://localhost:8080/chat", "application/json", bytes.NewReader(body))
+	resp, err := post(ctx, client, *sseURL, tokenHeader(), body)
 	if err != nil {
 		return Result{}, err
 	}
-	defer resp.Body.Close()
+	defer func() { resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return Result{}, fmt.Errorf("server returned %s", resp.Status)
+	}
 
 	cr := &CountingReader{r: resp.Body}
-	scanner := bufio.NewScanner(cr)
+	events := sse.NewReader(cr)
 	var res Result
-	var lastToken time.Time
+	var lastToken, lost time.Time
+	var lastEventID string
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
+read:
+	for {
+		ev, err := events.Next()
+		if err != nil {
+			// The stream ended before "done": resume after the last event.
+			if lastEventID == "" || res.Reconnects == maxReconnects {
+				return Result{}, err
+			}
+			if lost.IsZero() {
+				lost = time.Now()
+			}
+			resp.Body.Close()
+			res.BytesReceived += cr.Count
+			res.Reconnects++
+			if resp, err = resumeSSE(ctx, client, lastEventID); err != nil {
+				return Result{}, fmt.Errorf("resume after %s: %w", lastEventID, err)
+			}
+			cr = &CountingReader{r: resp.Body}
+			events = sse.NewReader(cr)
 			continue
 		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			break
+		if ev.ID != "" {
+			// Like a browser, keep the last ID across events without one.
+			lastEventID = ev.ID
+		}
+		switch ev.Event {
+		case sse.EventToken:
+		case sse.EventDone:
+			break read
+		case sse.EventError:
+			return Result{}, fmt.Errorf("server error: %s", ev.Data)
+		default:
+			continue
 		}
 		now := time.Now()
+		if !lost.IsZero() {
+			res.RecoveryTime += now.Sub(lost)
+			lost = time.Time{}
+		}
 		if res.TokenCount == 0 {
 			res.TTFT = now.Sub(start)
 		} else {
@@ -254,13 +471,39 @@ func (r *httpSSERunner) Run(prompt string) (Result, error) {
 		}
 		lastToken = now
 		res.TokenCount++
+		res.TokenTimes = append(res.TokenTimes, now.Sub(start))
+		if res.TokenCount == *dropAfter && res.Reconnects == 0 {
+			// Simulate a dropped connection; the next read fails.
+			resp.Body.Close()
+		}
 	}
 	// Drain remaining response body so the HTTP transport sees EOF
 	// and returns the connection to the keep-alive pool.
 	io.Copy(io.Discard, resp.Body)
-	res.BytesReceived = cr.Count
+	res.BytesReceived += cr.Count
 	res.TotalTime = time.Since(start)
-	return res, scanner.Err()
+	return res, nil
+}
+
+// resumeSSE reconnects to an interrupted response. The server replays the
+// events after lastEventID and then continues live.
+func resumeSSE(ctx context.Context, client *http.Client, lastEventID string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, *sseURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.SetToken(req.Header)
+	req.Header.Set("Last-Event-ID", lastEventID)
+	tracing.Inject(ctx, req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return resp, nil
 }
 
 // =============================================
@@ -268,29 +511,78 @@ func (r *httpSSERunner) Run(prompt string) (Result, error) {
 // =============================================
 
 type webtransportRunner struct {
-	sess *webtransport.Session // non-nil when reusing connections
+	sess  *webtransport.Session // non-nil when reusing connections
+	meter *wireMeter
 }
 
-func newWebtransportRunner(reuse bool) (*webtransportRunner, error) {
-	d := webtransport.Dialer{
+// newTransport returns an HTTP transport whose connections are counted by m.
+func newTransport(m *wireMeter, keepAlive bool) *http.Transport {
+	return &http.Transport{
+		DisableKeepAlives: !keepAlive,
+		DialTLSContext:    m.dialTLS,
+	}
+}
+
+// newWebtransportDialer returns the dialer used for every WebTransport
+// session, negotiating binary frames unless -legacy-framing is set. Its
+// traffic is counted by m.
+func newWebtransportDialer(m *wireMeter) *webtransport.Dialer {
+	d := &webtransport.Dialer{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialAddr:        m.dialQUIC,
 		QUICConfig: &quic.Config{
 			EnableDatagrams:                  true,
 			EnableStreamResetPartialDelivery: true,
 		},
 	}
-	_, sess, err := d.Dial(context.Background(), "https://localhost:4433/wt", nil)
+	if !*legacyFraming {
+		d.ApplicationProtocols = []string{message.ProtocolV1}
+	}
+	return d
+}
+
+// newWebtransportRunner checks that the server is reachable and returns a
+// runner counting its traffic with m. With reuse, the runner keeps the
+// session for all of its prompts.
+func newWebtransportRunner(reuse bool, m *wireMeter) (*webtransportRunner, error) {
+	r := &webtransportRunner{meter: m}
+	if !reuse {
+		// Count the connectivity check separately so it isn't
+		// attributed to the first prompt.
+		_, sess, err := newWebtransportDialer(newUDPMeter()).Dial(context.Background(), *wtURL, tokenHeader())
+		if err != nil {
+			return nil, fmt.Errorf("webtransport dial: %w", err)
+		}
+		sess.CloseWithError(0, "connectivity check")
+		return r, nil
+	}
+	sess, err := r.dial(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("webtransport dial: %w", err)
+		return nil, err
 	}
-	if reuse {
-		return &webtransportRunner{sess: sess}, nil
+	r.sess = sess
+	return r, nil
+}
+
+// dial opens a session, recording the QUIC handshake and WebTransport
+// CONNECT exchange as handshake bytes. The CONNECT request carries the
+// dial's trace context and the benchmark's token.
+func (r *webtransportRunner) dial(ctx context.Context) (*webtransport.Session, error) {
+	ctx, span := tracing.Start(ctx, "webtransport.dial", tracing.Client)
+	header := tokenHeader()
+	tracing.Inject(ctx, header)
+	before := r.meter.snapshot()
+	_, sess, err := newWebtransportDialer(r.meter).Dial(ctx, *wtURL, header)
+	span.End(err)
+	if err != nil {
+		return nil, fmt.Errorf("webtransport dial: %w", err)
 	}
-	sess.CloseWithError(0, "connectivity check")
-	return &webtransportRunner{}, nil
+	r.meter.handshake.Add(r.meter.snapshot().Sub(before).Total(r.meter.headerBytes))
+	return sess, nil
 }
 
-func (r *webtransportRunner) Name() string { return "WebTransport" }
+func (r *webtransportRunner) Name() string     { return "WebTransport" }
+func (r *webtransportRunner) wire() *wireMeter { return r.meter }
 
 func (r *webtransportRunner) Close() error {
 	if r.sess != nil {
@@ -299,52 +591,132 @@ func (r *webtransportRunner) Close() error {
 	return nil
 }
 
-func (r *webtransportRunner) Run(prompt string) (Result, error) {
+// openStream opens a stream on sess, counting the bytes read from it.
+func openStream(ctx context.Context, sess *webtransport.Session) (*webtransport.Stream, *CountingReader, *message.Framer, error) {
+	_, span := tracing.Start(ctx, "webtransport.open_stream", tracing.Internal)
+	stream, err := sess.OpenStream()
+	span.End(err)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("open stream: %w", err)
+	}
+	cr := &CountingReader{r: stream}
+	framer, err := message.NewFramer(struct {
+		io.Reader
+		io.Writer
+	}{cr, stream}, sess.SessionState().ApplicationProtocol)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return stream, cr, framer, nil
+}
+
+// writeRequest sends p as a REQUEST frame with its options, delivery mode
+// and the trace context of ctx. Legacy framing has no REQUEST, so only the
+// last turn is sent, as a bare prompt with the server's default options.
+func writeRequest(ctx context.Context, framer *message.Framer, p Prompt, delivery string) error {
+	if framer.Legacy() {
+		if err := framer.WriteToken(p.Text()); err != nil {
+			return fmt.Errorf("write prompt: %w", err)
+		}
+		return nil
+	}
+	req := message.Request{Messages: p.Messages, Options: p.Options(), Delivery: delivery, Traceparent: tracing.Traceparent(ctx)}
+	if err := framer.WriteJSON(message.FrameRequest, req); err != nil {
+		return fmt.Errorf("write request: %w", err)
+	}
+	return nil
+}
+
+func (r *webtransportRunner) Run(ctx context.Context, p Prompt) (Result, error) {
 	start := time.Now()
 	sess := r.sess
 	if sess == nil {
 		// Fresh QUIC session per prompt to capture connection setup cost.
-		d := webtransport.Dialer{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			QUICConfig: &quic.Config{
-				EnableDatagrams:                  true,
-				EnableStreamResetPartialDelivery: true,
-			},
-		}
 		var err error
-		_, sess, err = d.Dial(context.Background(), "https://localhost:4433/wt", nil)
+		sess, err = r.dial(ctx)
 		if err != nil {
-			return Result{}, fmt.Errorf("webtransport dial: %w", err)
+			return Result{}, err
 		}
-		defer sess.CloseWithError(0, "prompt done")
+		defer func() { sess.CloseWithError(0, "prompt done") }()
 	}
 
-	stream, err := sess.OpenStream()
+	stream, cr, framer, err := openStream(ctx, sess)
 	if err != nil {
-		return Result{}, fmt.Errorf("open stream: %w", err)
+		return Result{}, err
 	}
-	if err := message.Write(stream, prompt); err != nil {
-		return Result{}, fmt.Errorf("write prompt: %w", err)
+	if err := writeRequest(ctx, framer, p, ""); err != nil {
+		return Result{}, err
 	}
 	// Close write side so server knows the prompt is complete.
 	if err := stream.Close(); err != nil {
 		return Result{}, fmt.Errorf("close write: %w", err)
 	}
 
-	cr := &CountingReader{r: stream}
-	reader := bufio.NewReader(cr)
 	var res Result
-	var lastToken time.Time
+	var lastToken, lost time.Time
+	var responseID string
 
+read:
 	for {
-		_, err := message.Read(reader)
-		if err == io.EOF {
-			break
-		}
+		frame, err := framer.ReadFrame()
 		if err != nil {
-			return Result{}, fmt.Errorf("read token: %w", err)
+			if responseID == "" {
+				// Legacy framing: nothing to resume.
+				if err == io.EOF {
+					break
+				}
+				return Result{}, fmt.Errorf("read token: %w", err)
+			}
+			if res.Reconnects == maxReconnects {
+				return Result{}, fmt.Errorf("read token: %w", err)
+			}
+			// The session was lost: resume the response on a new one.
+			if lost.IsZero() {
+				lost = time.Now()
+			}
+			sess.CloseWithError(0, "session lost")
+			res.BytesReceived += cr.Count
+			res.Reconnects++
+			if sess, err = r.dial(ctx); err != nil {
+				return Result{}, fmt.Errorf("resume: %w", err)
+			}
+			if r.sess != nil {
+				// Later prompts reuse the new session.
+				r.sess = sess
+			}
+			if stream, cr, framer, err = openStream(ctx, sess); err != nil {
+				return Result{}, fmt.Errorf("resume: %w", err)
+			}
+			if err := framer.WriteJSON(message.FrameMetadata, message.Metadata{ResponseID: responseID, Offset: res.TokenCount, Traceparent: tracing.Traceparent(ctx)}); err != nil {
+				return Result{}, fmt.Errorf("resume: %w", err)
+			}
+			if err := stream.Close(); err != nil {
+				return Result{}, fmt.Errorf("resume: %w", err)
+			}
+			continue
+		}
+		switch frame.Type {
+		case message.FrameToken:
+		case message.FrameEnd:
+			break read
+		case message.FrameError:
+			return Result{}, fmt.Errorf("server error: %w", message.ParseError(frame.Payload))
+		case message.FrameGoAway:
+			return Result{}, fmt.Errorf("server going away: %s", frame.Payload)
+		case message.FrameMetadata:
+			var md message.Metadata
+			if err := frame.DecodeJSON(&md); err == nil && md.ResponseID != "" {
+				responseID = md.ResponseID
+			}
+			continue
+		default:
+			continue
 		}
 		now := time.Now()
+		if !lost.IsZero() {
+			res.RecoveryTime += now.Sub(lost)
+			lost = time.Time{}
+		}
 		if res.TokenCount == 0 {
 			res.TTFT = now.Sub(start)
 		} else {
@@ -352,16 +724,224 @@ func (r *webtransportRunner) Run(prompt string) (Result, error) {
 		}
 		lastToken = now
 		res.TokenCount++
+		res.TokenTimes = append(res.TokenTimes, now.Sub(start))
+		if res.TokenCount == *dropAfter && res.Reconnects == 0 && responseID != "" {
+			// Simulate losing the session; the next read fails.
+			sess.CloseWithError(0, "simulated session loss")
+		}
 	}
-	res.BytesReceived = cr.Count
+	// Drain to EOF so trailing bytes are counted.
+	io.Copy(io.Discard, cr)
+	res.BytesReceived += cr.Count
+	res.TotalTime = time.Since(start)
+	return res, nil
+}
+
+// =============================================
+// webtransportDatagramRunner — WebTransport datagrams with stream repair
+// =============================================
+
+// webtransportDatagramRunner receives tokens as unreliable datagrams and
+// repairs gaps over the request stream. Tokens are timed as a chat UI would
+// render them: a token counts as delivered once it and every token before it
+// have arrived.
+type webtransportDatagramRunner struct {
+	webtransportRunner
+}
+
+func (r *webtransportDatagramRunner) Name() string { return "WT Datagram" }
+
+// tokenDatagram is a token datagram as seen by the receiver.
+type tokenDatagram struct {
+	id, seq uint64
+	size    int
+	at      time.Time
+}
+
+// streamFrame is a frame read from the request stream.
+type streamFrame struct {
+	message.Frame
+	err error
+	at  time.Time
+}
+
+func (r *webtransportDatagramRunner) Run(ctx context.Context, p Prompt) (Result, error) {
+	start := time.Now()
+	sess := r.sess
+	if sess == nil {
+		// Fresh QUIC session per prompt to capture connection setup cost.
+		var err error
+		sess, err = r.dial(ctx)
+		if err != nil {
+			return Result{}, err
+		}
+		defer sess.CloseWithError(0, "prompt done")
+	}
+	if sess.SessionState().ApplicationProtocol == "" {
+		return Result{}, fmt.Errorf("datagram delivery requires binary framing")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Datagrams are session-wide, so collect all of them and match the
+	// response ID once the server has announced it.
+	dgCh := make(chan tokenDatagram, 1024)
+	go func() {
+		for {
+			b, err := sess.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			id, seq, _, err := message.ParseDatagram(b)
+			if err != nil {
+				continue
+			}
+			select {
+			case dgCh <- tokenDatagram{id: id, seq: seq, size: len(b), at: time.Now()}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	stream, cr, framer, err := openStream(ctx, sess)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := writeRequest(ctx, framer, p, message.DeliveryDatagram); err != nil {
+		return Result{}, err
+	}
+
+	// Stop the reader below if we bail out early; a no-op after EOF.
+	defer stream.CancelRead(0)
+
+	frameCh := make(chan streamFrame, 16)
+	go func() {
+		defer close(frameCh)
+		for {
+			f, err := framer.ReadFrame()
+			select {
+			case frameCh <- streamFrame{Frame: f, err: err, at: time.Now()}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		id         uint64
+		received   []tokenDatagram
+		arrivals   = make(map[uint64]time.Time)
+		tokenCount = -1
+		dgramBytes int64
+		res        Result
+		gotEnd     bool
+	)
+	record := func(seq uint64, at time.Time) {
+		if t, ok := arrivals[seq]; !ok || at.Before(t) {
+			arrivals[seq] = at
+		}
+	}
+	for !gotEnd {
+		select {
+		case d := <-dgCh:
+			received = append(received, d)
+			if id != 0 && d.id == id {
+				record(d.seq, d.at)
+			}
+		case f, ok := <-frameCh:
+			if !ok {
+				return Result{}, fmt.Errorf("stream closed before end of response")
+			}
+			if f.err != nil {
+				return Result{}, fmt.Errorf("read frame: %w", f.err)
+			}
+			switch f.Type {
+			case message.FrameError:
+				return Result{}, fmt.Errorf("server error: %w", message.ParseError(f.Payload))
+			case message.FrameGoAway:
+				return Result{}, fmt.Errorf("server going away: %s", f.Payload)
+			case message.FrameEnd:
+				gotEnd = true
+			case message.FrameRepair:
+				seq, _, err := f.ParseRepair()
+				if err != nil {
+					return Result{}, err
+				}
+				record(seq, f.at)
+			case message.FrameMetadata:
+				var md message.Metadata
+				if err := f.DecodeJSON(&md); err != nil {
+					return Result{}, err
+				}
+				if md.DatagramID != 0 {
+					id = md.DatagramID
+					for _, d := range received {
+						if d.id == id {
+							record(d.seq, d.at)
+						}
+					}
+				}
+				// Any METADATA but the response's first asks for
+				// repairs, and must be answered even if nothing is
+				// missing.
+				if md.Delivery == "" {
+					tokenCount = md.TokenCount
+					var missing []uint64
+					for seq := range uint64(tokenCount) {
+						if _, ok := arrivals[seq]; !ok {
+							missing = append(missing, seq)
+						}
+					}
+					res.Repaired = len(missing)
+					if err := framer.WriteJSON(message.FrameMetadata, message.Metadata{Missing: missing}); err != nil {
+						return Result{}, fmt.Errorf("write repair request: %w", err)
+					}
+				}
+			}
+		}
+	}
+	// Close write side so the server ends the stream, then drain to EOF so
+	// trailing bytes are counted.
+	if err := stream.Close(); err != nil {
+		return Result{}, fmt.Errorf("close write: %w", err)
+	}
+	for range frameCh {
+	}
+	cancel()
+	for _, d := range received {
+		if d.id == id {
+			dgramBytes += int64(d.size)
+		}
+	}
+
+	var shown time.Time
+	for seq := range uint64(max(tokenCount, 0)) {
+		at := arrivals[seq]
+		if at.After(shown) {
+			shown = at
+		}
+		res.TokenTimes = append(res.TokenTimes, shown.Sub(start))
+		if seq == 0 {
+			res.TTFT = shown.Sub(start)
+		} else {
+			res.TotalInterTokenTime = shown.Sub(start) - res.TTFT
+		}
+	}
+	res.TokenCount = max(tokenCount, 0)
+	res.BytesReceived = cr.Count + dgramBytes
 	res.TotalTime = time.Since(start)
 	return res, nil
 }
 
 // percentile returns the p-th percentile from a sorted slice using nearest-rank.
-func percentile(sorted []int64, p float64) int64 {
+func percentile[T cmp.Ordered](sorted []T, p float64) T {
 	if len(sorted) == 0 {
-		return 0
+		var zero T
+		return zero
 	}
 	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
 	if rank < 0 {
@@ -375,15 +955,72 @@ func percentile(sorted []int64, p float64) int64 {
 // =============================================
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		if err := runReport(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "report: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	config.Parse()
+	if *dropAfter > 0 && *sessions > 0 {
+		// Resuming replaces the runner's session, which -sessions shares
+		// between clients.
+		fmt.Println("Fatal: -drop-after cannot be combined with -sessions")
+		return
+	}
+	var err error
+	prompts, err = loadPrompts()
+	if err != nil {
+		fmt.Printf("Fatal: %v\n", err)
+		return
+	}
+	flushTraces, err := traceConf.Start("benchmark")
+	if err != nil {
+		fmt.Printf("Fatal: %v\n", err)
+		return
+	}
+	defer flushTraces()
+	report := &Report{StartedAt: time.Now().UTC(), Profile: *profileLabel, Mode: "fresh", Env: newEnvironment(*llmModel)}
+	if *reuseConn {
+		report.Mode = "reuse"
+	}
+
+	if *mockLLM {
+		ln, err := net.Listen("tcp", *ollamaAddr)
+		if err != nil {
+			fmt.Printf("Fatal: could not start mock LLM on %s: %v\n", *ollamaAddr, err)
+			return
+		}
+		go http.Serve(ln, mockllm.New(mockllm.DefaultConfig()).Handler())
+		fmt.Printf("Mock LLM listening on %s\n", ln.Addr())
+	}
 
-	proxyAddr, err := startTLSProxy("127.0.0.1:11434")
+	proxyAddr, err := startTLSProxy(*ollamaAddr)
 	if err != nil {
 		fmt.Printf("Fatal: could not start TLS proxy: %v\n", err)
 		return
 	}
 	fmt.Printf("TLS proxy to Ollama listening on %s\n", proxyAddr)
 
+	if *profile != "" {
+		p, err := netem.ParseProfile(*profile)
+		if err != nil {
+			fmt.Printf("Fatal: %v\n", err)
+			return
+		}
+		relays, err := startRelays(p, &proxyAddr)
+		if err != nil {
+			fmt.Printf("Fatal: could not start relays: %v\n", err)
+			return
+		}
+		for _, r := range relays {
+			defer r.Close()
+		}
+		fmt.Printf("Profile: %s (%s)\n", p.Name, p)
+		report.Profile, report.ProfileSpec = p.Name, p.String()
+	}
+
 	if *reuseConn {
 		fmt.Println("Mode: connection reuse (persistent connections)")
 	} else {
@@ -393,11 +1030,11 @@ func main() {
 	// Warmup: send a short request to Ollama so the model is loaded before benchmarking.
 	fmt.Print("Warming up Ollama model... ")
 	warmupBody, _ := json.Marshal(chatRequest{
-		Model:    "gemma3:12b",
+		Model:    *llmModel,
 		Messages: []chatMessage{{Role: "user", Content: "hi"}},
 		Stream:   false,
 	})
-	warmupResp, err := http.Post("http://127.0.0.1:11434/v1/chat/completions", "application/json", bytes.NewReader(warmupBody))
+	warmupResp, err := http.Post("http://"+*ollamaAddr+"/v1/chat/completions", "application/json", bytes.NewReader(warmupBody))
 	if err != nil {
 		fmt.Printf("warning: warmup failed: %v\n", err)
 	} else {
@@ -406,26 +1043,38 @@ func main() {
 		fmt.Println("done")
 	}
 
-	wtRunner, err := newWebtransportRunner(*reuseConn)
+	if *concurrency > 0 {
+		runLoadTest(proxyAddr, report)
+		writeReports(report)
+		return
+	}
+
+	wtRunner, err := newWebtransportRunner(*reuseConn, newUDPMeter())
 	if err != nil {
 		fmt.Printf("Warning: WebTransport unavailable: %v\n", err)
 	}
 
-	rawRunner := &rawAPIRunner{proxyAddr: proxyAddr}
-	sseRunner := &httpSSERunner{}
+	rawRunner := &rawAPIRunner{proxyAddr: proxyAddr, meter: newTCPMeter()}
+	nativeRunner := &rawAPIRunner{proxyAddr: proxyAddr, native: true, meter: newTCPMeter()}
+	sseRunner := &httpSSERunner{meter: newTCPMeter()}
 	if *reuseConn {
-		tlsTransport := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		rawRunner.client = &http.Client{Transport: tlsTransport}
-		sseRunner.client = &http.Client{Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}}
+		rawRunner.client = &http.Client{Transport: newTransport(rawRunner.meter, true)}
+		nativeRunner.client = &http.Client{Transport: newTransport(nativeRunner.meter, true)}
+		sseRunner.client = &http.Client{Transport: newTransport(sseRunner.meter, true)}
 	}
 
-	runners := []Runner{rawRunner, sseRunner}
+	runners := []Runner{rawRunner, nativeRunner, sseRunner}
 	if wtRunner != nil {
 		runners = append(runners, wtRunner)
+		if *datagrams {
+			// Separate session so the stream runner's Close doesn't end it.
+			dgRunner, err := newWebtransportRunner(*reuseConn, newUDPMeter())
+			if err != nil {
+				fmt.Printf("Warning: WebTransport datagrams unavailable: %v\n", err)
+			} else {
+				runners = append(runners, &webtransportDatagramRunner{*dgRunner})
+			}
+		}
 	}
 
 	type stats struct {
@@ -436,6 +1085,9 @@ func main() {
 		totalTokens      int
 		promptsCompleted int
 		bytesSamples     []int64
+		wire             WireStats
+		wireBytes        int64
+		handshakeBytes   int64
 	}
 
 	results := make(map[string]*stats)
@@ -445,9 +1097,21 @@ func main() {
 
 	for _, runner := range runners {
 		fmt.Printf("\n=== %s ===\n", runner.Name())
+		// Start from zero so a session opened before the first prompt
+		// (reuse mode) is attributed to it, as it is for HTTP.
+		m := runner.wire()
+		var wireBefore WireStats
+		var handshakeBefore int64
 		for i, prompt := range prompts {
-			fmt.Printf("  [%d/%d] %s... ", i+1, len(prompts), prompt[:min(40, len(prompt))])
-			res, err := runner.Run(prompt)
+			text := prompt.Text()
+			fmt.Printf("  [%d/%d] %s... ", i+1, len(prompts), text[:min(40, len(text))])
+			res, err := runTraced(runner, prompt)
+			wireNow, handshakeNow := m.snapshot(), m.handshake.Load()
+			res.Wire = wireNow.Sub(wireBefore)
+			res.WireBytes = res.Wire.Total(m.headerBytes)
+			res.HandshakeBytes = handshakeNow - handshakeBefore
+			wireBefore, handshakeBefore = wireNow, handshakeNow
+			report.Prompts = append(report.Prompts, newPromptResult(runner.Name(), i, prompt, res, err))
 			if err != nil {
 				fmt.Printf("ERROR: %v\n", err)
 				continue
@@ -460,6 +1124,9 @@ func main() {
 			s.totalTime += res.TotalTime
 			s.totalTokens += res.TokenCount
 			s.promptsCompleted++
+			s.wire = s.wire.Add(res.Wire)
+			s.wireBytes += res.WireBytes
+			s.handshakeBytes += res.HandshakeBytes
 
 			avgTBT := time.Duration(0)
 			if res.TokenCount > 1 {
@@ -469,8 +1136,18 @@ func main() {
 			if res.TokenCount > 0 {
 				bytesPerToken = float64(res.BytesReceived) / float64(res.TokenCount)
 			}
-			fmt.Printf("%d tokens, TTFT %v, avg TBT %v, %v total, %d bytes, %.1f B/tok\n",
+			fmt.Printf("%d tokens, TTFT %v, avg TBT %v, %v total, %d bytes, %.1f B/tok",
 				res.TokenCount, res.TTFT.Round(time.Millisecond), avgTBT.Round(time.Millisecond), res.TotalTime.Round(time.Millisecond), res.BytesReceived, bytesPerToken)
+			if prompt.ExpectedTokens > 0 {
+				fmt.Printf(", %d expected", prompt.ExpectedTokens)
+			}
+			if res.Repaired > 0 {
+				fmt.Printf(", %d repaired", res.Repaired)
+			}
+			if res.Reconnects > 0 {
+				fmt.Printf(", %d reconnects, recovery %v", res.Reconnects, res.RecoveryTime.Round(time.Millisecond))
+			}
+			fmt.Printf("\n         wire %d bytes (%s), handshake %d bytes\n", res.WireBytes, res.Wire, res.HandshakeBytes)
 		}
 		runner.Close()
 	}
@@ -509,4 +1186,47 @@ func main() {
 		fmt.Printf("%-15s | %10d | %10d | %10d | %10d | %10v | %10v | %10v | %10d | %10.1f\n",
 			runner.Name(), avgBytes, p50, p90, maxBytes, avgTTFT, avgTBT, avgTotal, avgTokens, avgBytesPerToken)
 	}
+
+	// Wire bytes are counted at the socket and include TLS/QUIC overhead,
+	// retransmissions, ACKs and estimated IP/UDP/TCP headers, in both
+	// directions. Compare with the application bytes above.
+	fmt.Printf("\n%-15s | %10s | %10s | %10s | %10s | %10s | %10s | %10s | %10s\n",
+		"Approach", "Avg Wire", "Avg In", "Avg Out", "Pkts In", "Pkts Out", "Handshake", "Wire B/tok", "Wire/App")
+	fmt.Println(strings.Repeat("-", 115))
+	for _, runner := range runners {
+		s := results[runner.Name()]
+		if s.promptsCompleted == 0 {
+			fmt.Printf("%-15s | %10s | %10s | %10s | %10s | %10s | %10s | %10s | %10s\n",
+				runner.Name(), "N/A", "N/A", "N/A", "N/A", "N/A", "N/A", "N/A", "N/A")
+			continue
+		}
+		n := int64(s.promptsCompleted)
+		wireBytesPerToken := float64(0)
+		if s.totalTokens > 0 {
+			wireBytesPerToken = float64(s.wireBytes) / float64(s.totalTokens)
+		}
+		wireToApp := float64(0)
+		if s.totalBytes > 0 {
+			wireToApp = float64(s.wireBytes) / float64(s.totalBytes)
+		}
+		fmt.Printf("%-15s | %10d | %10d | %10d | %10d | %10d | %10d | %10.1f | %10.2f\n",
+			runner.Name(), s.wireBytes/n, s.wire.BytesIn/n, s.wire.BytesOut/n, s.wire.PacketsIn/n, s.wire.PacketsOut/n,
+			s.handshakeBytes/n, wireBytesPerToken, wireToApp)
+	}
+
+	writeReports(report)
+}
+
+// writeReports writes report to the -json and -csv files, if set.
+func writeReports(report *Report) {
+	if *jsonOut != "" {
+		if err := report.writeJSON(*jsonOut); err != nil {
+			fmt.Printf("Error writing JSON report: %v\n", err)
+		}
+	}
+	if *csvOut != "" {
+		if err := report.writeCSV(*csvOut); err != nil {
+			fmt.Printf("Error writing CSV report: %v\n", err)
+		}
+	}
 }
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report is the machine-readable result of one benchmark run, written with
+// -json and -csv and aggregated by the report subcommand.
+type Report struct {
+	StartedAt   time.Time      `json:"started_at"`
+	Profile     string         `json:"profile,omitempty"`      // netem profile name, empty when unshaped
+	ProfileSpec string         `json:"profile_spec,omitempty"` // the profile's settings
+	Mode        string         `json:"mode"`                   // "reuse" or "fresh"
+	Env         Environment    `json:"environment"`
+	Load        *LoadConfig    `json:"load,omitempty"` // set for -concurrency runs
+	Prompts     []PromptResult `json:"prompts"`
+}
+
+// Environment describes where a report was produced.
+type Environment struct {
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	NumCPU    int    `json:"num_cpu"`
+	Hostname  string `json:"hostname,omitempty"`
+	Revision  string `json:"revision,omitempty"` // VCS revision, when built from a checkout
+	LLM       string `json:"llm"`                // "ollama" or "mock"
+	Model     string `json:"model"`
+	Framing   string `json:"framing"` // WebTransport framing: "binary" or "legacy"
+}
+
+// PromptResult is one Result in a report. Durations are in milliseconds.
+// Under load, traffic can't be attributed to a single request, so the wire
+// fields are zero.
+type PromptResult struct {
+	Approach       string    `json:"approach"`
+	Index          int       `json:"index"`
+	PromptID       string    `json:"prompt_id"`
+	Prompt         string    `json:"prompt"` // the final user message
+	Turns          int       `json:"turns"`  // messages sent, including Prompt
+	MaxTokens      int       `json:"max_tokens,omitempty"`
+	ExpectedTokens int       `json:"expected_tokens,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Tokens         int       `json:"tokens"`
+	TTFTMs         float64   `json:"ttft_ms"`
+	AvgTBTMs       float64   `json:"avg_tbt_ms"`
+	TotalMs        float64   `json:"total_ms"`
+	AppBytes       int64     `json:"app_bytes"`
+	WireBytes      int64     `json:"wire_bytes"`
+	WireBytesIn    int64     `json:"wire_bytes_in"`
+	WireBytesOut   int64     `json:"wire_bytes_out"`
+	PacketsIn      int64     `json:"packets_in"`
+	PacketsOut     int64     `json:"packets_out"`
+	HandshakeBytes int64     `json:"handshake_bytes"`
+	Repaired       int       `json:"repaired,omitempty"`
+	Reconnects     int       `json:"reconnects,omitempty"`
+	RecoveryMs     float64   `json:"recovery_ms,omitempty"`
+	QueueMs        float64   `json:"queue_ms,omitempty"` // open-loop load: wait for a free client
+	TokenTimesMs   []float64 `json:"token_times_ms,omitempty"`
+}
+
+func newEnvironment(model string) Environment {
+	env := Environment{
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		NumCPU:    runtime.NumCPU(),
+		LLM:       "ollama",
+		Model:     model,
+		Framing:   "binary",
+	}
+	env.Hostname, _ = os.Hostname()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				env.Revision = s.Value
+			}
+		}
+	}
+	if *mockLLM {
+		env.LLM = "mock"
+	}
+	if *legacyFraming {
+		env.Framing = "legacy"
+	}
+	return env
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func newPromptResult(approach string, index int, p Prompt, res Result, err error) PromptResult {
+	pr := PromptResult{
+		Approach:       approach,
+		Index:          index,
+		PromptID:       p.ID,
+		Prompt:         p.Text(),
+		Turns:          len(p.Messages),
+		MaxTokens:      p.MaxTokens,
+		ExpectedTokens: p.ExpectedTokens,
+		Tokens:         res.TokenCount,
+		TTFTMs:         ms(res.TTFT),
+		TotalMs:        ms(res.TotalTime),
+		AppBytes:       res.BytesReceived,
+		WireBytes:      res.WireBytes,
+		WireBytesIn:    res.Wire.BytesIn,
+		WireBytesOut:   res.Wire.BytesOut,
+		PacketsIn:      res.Wire.PacketsIn,
+		PacketsOut:     res.Wire.PacketsOut,
+		HandshakeBytes: res.HandshakeBytes,
+		Repaired:       res.Repaired,
+		Reconnects:     res.Reconnects,
+		RecoveryMs:     ms(res.RecoveryTime),
+	}
+	if err != nil {
+		pr.Error = err.Error()
+	}
+	if res.TokenCount > 1 {
+		pr.AvgTBTMs = ms(res.TotalInterTokenTime) / float64(res.TokenCount-1)
+	}
+	for _, t := range res.TokenTimes {
+		pr.TokenTimesMs = append(pr.TokenTimesMs, ms(t))
+	}
+	return pr
+}
+
+func (r *Report) writeJSON(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// writeCSV writes one row per prompt. Run-level fields are repeated on every
+// row and token times are space-separated in the last column.
+func (r *Report) writeCSV(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{
+		"started_at", "profile", "mode", "llm", "model", "framing",
+		"approach", "index", "prompt_id", "prompt", "turns", "max_tokens", "expected_tokens", "error", "tokens", "ttft_ms", "avg_tbt_ms", "total_ms",
+		"app_bytes", "wire_bytes", "wire_bytes_in", "wire_bytes_out", "packets_in", "packets_out",
+		"handshake_bytes", "repaired", "reconnects", "recovery_ms", "queue_ms", "token_times_ms",
+	})
+	f64 := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	i64 := func(v int64) string { return strconv.FormatInt(v, 10) }
+	for _, p := range r.Prompts {
+		times := make([]string, len(p.TokenTimesMs))
+		for i, t := range p.TokenTimesMs {
+			times[i] = f64(t)
+		}
+		w.Write([]string{
+			r.StartedAt.Format(time.RFC3339), r.Profile, r.Mode, r.Env.LLM, r.Env.Model, r.Env.Framing,
+			p.Approach, strconv.Itoa(p.Index), p.PromptID, p.Prompt, strconv.Itoa(p.Turns), strconv.Itoa(p.MaxTokens), strconv.Itoa(p.ExpectedTokens), p.Error, strconv.Itoa(p.Tokens), f64(p.TTFTMs), f64(p.AvgTBTMs), f64(p.TotalMs),
+			i64(p.AppBytes), i64(p.WireBytes), i64(p.WireBytesIn), i64(p.WireBytesOut), i64(p.PacketsIn), i64(p.PacketsOut),
+			i64(p.HandshakeBytes), strconv.Itoa(p.Repaired), strconv.Itoa(p.Reconnects), f64(p.RecoveryMs), f64(p.QueueMs), strings.Join(times, " "),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readReport(path string) (*Report, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Report
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &r, nil
+}
+
+// =============================================
+// report subcommand
+// =============================================
+
+// runReport implements "benchmark report [-o file] report.json...": it
+// aggregates JSON reports into markdown tables, one per profile, mode and
+// load-test concurrency, followed by a wire-byte comparison across profiles.
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	out := fs.String("o", "", "Write markdown to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: benchmark report [-o file] report.json...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no report files given")
+	}
+
+	var reports []*Report
+	for _, path := range fs.Args() {
+		r, err := readReport(path)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, r)
+	}
+
+	if *out == "" {
+		writeMarkdown(os.Stdout, reports)
+		return nil
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	// The buffer keeps the first write error for Flush to report.
+	bw := bufio.NewWriter(f)
+	writeMarkdown(bw, reports)
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reportGroup collects the prompts of every report sharing a profile, mode
+// and load-test concurrency, keyed by approach.
+type reportGroup struct {
+	title      string
+	approaches []string
+	prompts    map[string][]PromptResult
+}
+
+func groupReports(reports []*Report) []*reportGroup {
+	var groups []*reportGroup
+	byKey := make(map[string]*reportGroup)
+	for _, r := range reports {
+		profile := r.Profile
+		if profile == "" {
+			profile = "unshaped"
+		}
+		title := fmt.Sprintf("%s (%s)", profile, r.Mode)
+		if r.Load != nil {
+			title = fmt.Sprintf("%s (%s, %d clients)", profile, r.Mode, r.Load.Concurrency)
+		}
+		g := byKey[title]
+		if g == nil {
+			g = &reportGroup{title: title, prompts: make(map[string][]PromptResult)}
+			byKey[title] = g
+			groups = append(groups, g)
+		}
+		for _, p := range r.Prompts {
+			if _, ok := g.prompts[p.Approach]; !ok {
+				g.approaches = append(g.approaches, p.Approach)
+			}
+			g.prompts[p.Approach] = append(g.prompts[p.Approach], p)
+		}
+	}
+	return groups
+}
+
+// approachSummary aggregates the successful prompts of one approach.
+type approachSummary struct {
+	n, errors          int
+	tokens             int
+	wireBytes, packets int64
+	appBytes           int64
+	ttfts              []float64
+	interTokenMs       float64
+	totalMs            float64
+}
+
+func summarize(prompts []PromptResult) approachSummary {
+	var s approachSummary
+	for _, p := range prompts {
+		if p.Error != "" {
+			s.errors++
+			continue
+		}
+		s.n++
+		s.tokens += p.Tokens
+		s.wireBytes += p.WireBytes
+		s.packets += p.PacketsIn + p.PacketsOut
+		s.appBytes += p.AppBytes
+		s.ttfts = append(s.ttfts, p.TTFTMs)
+		s.interTokenMs += p.AvgTBTMs * float64(max(p.Tokens-1, 0))
+		s.totalMs += p.TotalMs
+	}
+	return s
+}
+
+func writeMarkdown(w io.Writer, reports []*Report) {
+	groups := groupReports(reports)
+
+	fmt.Fprintln(w, "## Summary Tables")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "*Wire bytes are counted at the socket, in both directions, including TLS/QUIC overhead and estimated IP/TCP/UDP headers. App bytes are the response body or stream bytes. P50 TTFT is the median across prompts.*")
+	for _, g := range groups {
+		fmt.Fprintf(w, "\n### %s\n\n", g.title)
+		fmt.Fprintln(w, "| Approach | Avg Wire Bytes | P50 TTFT | Avg TBT | Avg Total | Avg Tokens | Wire B/tok | App B/tok | Errors |")
+		fmt.Fprintln(w, "|---|---|---|---|---|---|---|---|---|")
+		for _, a := range g.approaches {
+			s := summarize(g.prompts[a])
+			if s.n == 0 {
+				fmt.Fprintf(w, "| %s | N/A | N/A | N/A | N/A | N/A | N/A | N/A | %d |\n", a, s.errors)
+				continue
+			}
+			avgTBT := 0.0
+			if s.tokens > s.n {
+				avgTBT = s.interTokenMs / float64(s.tokens-s.n)
+			}
+			fmt.Fprintf(w, "| %s | %s | %s | %s | %s | %d | %s | %s | %d |\n",
+				a, commas(s.wireBytes/int64(s.n)), fmtMs(median(s.ttfts)), fmtMs(avgTBT), fmtMs(s.totalMs/float64(s.n)),
+				s.tokens/s.n, perToken(s.wireBytes, s.tokens), perToken(s.appBytes, s.tokens), s.errors)
+		}
+	}
+
+	// Wire-byte totals across profiles, one column per approach.
+	var approaches []string
+	for _, g := range groups {
+		for _, a := range g.approaches {
+			if !slices.Contains(approaches, a) {
+				approaches = append(approaches, a)
+			}
+		}
+	}
+	fmt.Fprintln(w, "\n## Wire Bytes")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "| Profile | %s |\n", strings.Join(approaches, " | "))
+	fmt.Fprintf(w, "|---|%s\n", strings.Repeat("---|", len(approaches)))
+	for _, g := range groups {
+		cells := make([]string, len(approaches))
+		for i, a := range approaches {
+			s := summarize(g.prompts[a])
+			if s.n == 0 {
+				cells[i] = "N/A"
+				continue
+			}
+			cells[i] = fmt.Sprintf("%s (%s pkts, %s B/tok)", commas(s.wireBytes), commas(s.packets), perToken(s.wireBytes, s.tokens))
+		}
+		fmt.Fprintf(w, "| %s | %s |\n", g.title, strings.Join(cells, " | "))
+	}
+}
+
+// median averages the two middle values of an even-length sample.
+func median(values []float64) float64 {
+	s := slices.Clone(values)
+	slices.Sort(s)
+	n := len(s)
+	if n == 0 {
+		return 0
+	}
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// fmtMs formats milliseconds the way the hand-written results do: "262ms",
+// "15.5s".
+func fmtMs(v float64) string {
+	d := time.Duration(v * float64(time.Millisecond))
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+func perToken(bytes int64, tokens int) string {
+	if tokens == 0 {
+		return "N/A"
+	}
+	return strconv.FormatFloat(float64(bytes)/float64(tokens), 'f', 1, 64)
+}
+
+// commas formats n with thousands separators.
+func commas(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	if neg {
+		return "-" + b.String()
+	}
+	return b.String()
+}
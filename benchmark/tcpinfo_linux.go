@@ -0,0 +1,29 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpSegments returns the segments received and sent on c according to the
+// kernel's TCP_INFO.
+func tcpSegments(c *net.TCPConn) (in, out int64, ok bool) {
+	if c == nil {
+		return 0, 0, false
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var info *unix.TCPInfo
+	raw.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || info == nil {
+		return 0, 0, false
+	}
+	return int64(info.Segs_in), int64(info.Segs_out), true
+}
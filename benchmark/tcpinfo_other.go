@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// tcpSegments is only implemented on Linux; elsewhere countingConn falls
+// back to counting reads and writes.
+func tcpSegments(c *net.TCPConn) (in, out int64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"llm-webtransport/tracing"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Estimated IPv4 + transport header sizes, added to socket-level byte counts
+// to approximate what tcpdump would see. TCP assumes the timestamp option.
+const (
+	udpHeaderBytes = 20 + 8
+	tcpHeaderBytes = 20 + 32
+)
+
+// WireStats counts traffic at the socket level in each direction. Bytes are
+// UDP payloads or TCP stream bytes, so QUIC and TLS overhead is included but
+// IP/UDP/TCP headers are not. Packets are datagrams, or TCP segments
+// (including pure ACKs) as reported by the kernel.
+type WireStats struct {
+	BytesIn, BytesOut     int64
+	PacketsIn, PacketsOut int64
+}
+
+func (w WireStats) Sub(o WireStats) WireStats {
+	return WireStats{w.BytesIn - o.BytesIn, w.BytesOut - o.BytesOut, w.PacketsIn - o.PacketsIn, w.PacketsOut - o.PacketsOut}
+}
+
+func (w WireStats) Add(o WireStats) WireStats {
+	return WireStats{w.BytesIn + o.BytesIn, w.BytesOut + o.BytesOut, w.PacketsIn + o.PacketsIn, w.PacketsOut + o.PacketsOut}
+}
+
+// Total returns bytes in both directions including estimated headers.
+func (w WireStats) Total(headerBytes int64) int64 {
+	return w.BytesIn + w.BytesOut + (w.PacketsIn+w.PacketsOut)*headerBytes
+}
+
+func (w WireStats) String() string {
+	return fmt.Sprintf("%d B in / %d B out, %d/%d pkts", w.BytesIn, w.BytesOut, w.PacketsIn, w.PacketsOut)
+}
+
+// wireMeter counts the traffic of all sockets a runner opens.
+type wireMeter struct {
+	headerBytes int64
+
+	bytesIn, bytesOut     atomic.Int64
+	packetsIn, packetsOut atomic.Int64 // UDP, plus TCP segments of closed conns
+	handshake             atomic.Int64 // bytes spent on TCP+TLS handshakes
+
+	mu   sync.Mutex
+	live map[*countingConn]struct{}
+}
+
+func newUDPMeter() *wireMeter { return &wireMeter{headerBytes: udpHeaderBytes} }
+func newTCPMeter() *wireMeter {
+	return &wireMeter{headerBytes: tcpHeaderBytes, live: make(map[*countingConn]struct{})}
+}
+
+func (m *wireMeter) snapshot() WireStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := WireStats{m.bytesIn.Load(), m.bytesOut.Load(), m.packetsIn.Load(), m.packetsOut.Load()}
+	for c := range m.live {
+		in, out := c.segments()
+		s.PacketsIn += in
+		s.PacketsOut += out
+	}
+	return s
+}
+
+// --- UDP (QUIC) ---
+
+// countingPacketConn counts datagrams and bytes through a net.PacketConn.
+type countingPacketConn struct {
+	net.PacketConn
+	m *wireMeter
+}
+
+func (c *countingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if n > 0 {
+		c.m.bytesIn.Add(int64(n))
+		c.m.packetsIn.Add(1)
+	}
+	return n, addr, err
+}
+
+func (c *countingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if n > 0 {
+		c.m.bytesOut.Add(int64(n))
+		c.m.packetsOut.Add(1)
+	}
+	return n, err
+}
+
+// SetReadBuffer and SetWriteBuffer let quic-go size the socket buffers
+// through the wrapper. Other optimizations (GSO, ECN) are deliberately
+// hidden so that every packet passes through ReadFrom/WriteTo.
+func (c *countingPacketConn) SetReadBuffer(n int) error {
+	return c.PacketConn.(*net.UDPConn).SetReadBuffer(n)
+}
+
+func (c *countingPacketConn) SetWriteBuffer(n int) error {
+	return c.PacketConn.(*net.UDPConn).SetWriteBuffer(n)
+}
+
+// dialQUIC is a webtransport.Dialer.DialAddr that sends through a counted
+// socket. The socket is closed with the connection.
+func (m *wireMeter) dialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: &countingPacketConn{PacketConn: udpConn, m: m}}
+	conn, err := tr.DialEarly(ctx, raddr, tlsConf, conf)
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		tr.Close()
+	}()
+	return conn, nil
+}
+
+// --- TCP (TLS) ---
+
+// countingConn counts bytes through a TCP connection. Segment counts come
+// from the kernel where supported (see tcpSegments), otherwise from the
+// number of reads and writes.
+type countingConn struct {
+	net.Conn
+	m            *wireMeter
+	tcp          *net.TCPConn
+	reads        atomic.Int64
+	writes       atomic.Int64
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	closeOnce    sync.Once
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.m.bytesIn.Add(int64(n))
+		c.bytesRead.Add(int64(n))
+		c.reads.Add(1)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.m.bytesOut.Add(int64(n))
+		c.bytesWritten.Add(int64(n))
+		c.writes.Add(1)
+	}
+	return n, err
+}
+
+func (c *countingConn) segments() (in, out int64) {
+	if in, out, ok := tcpSegments(c.tcp); ok {
+		return in, out
+	}
+	return c.reads.Load(), c.writes.Load()
+}
+
+func (c *countingConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.m.mu.Lock()
+		in, out := c.segments()
+		c.m.packetsIn.Add(in)
+		c.m.packetsOut.Add(out)
+		delete(c.m.live, c)
+		c.m.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// dialTLS is an http.Transport.DialTLSContext that counts the connection's
+// traffic and records the bytes spent on the TCP+TLS handshake.
+func (m *wireMeter) dialTLS(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	_, span := tracing.Start(ctx, "tls.dial", tracing.Client)
+	span.Set("net.peer", addr)
+	defer func() { span.End(err) }()
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cc := &countingConn{Conn: raw, m: m}
+	cc.tcp, _ = raw.(*net.TCPConn)
+	m.mu.Lock()
+	m.live[cc] = struct{}{}
+	m.mu.Unlock()
+
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConn := tls.Client(cc, &tls.Config{InsecureSkipVerify: true, ServerName: host})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		cc.Close()
+		return nil, err
+	}
+	in, out := cc.segments()
+	m.handshake.Add(cc.bytesRead.Load() + cc.bytesWritten.Load() + (in+out)*m.headerBytes)
+	return tlsConn, nil
+}
@@ -4,18 +4,86 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
+	"llm-webtransport/auth"
+	"llm-webtransport/config"
 	"llm-webtransport/message"
+	"llm-webtransport/tracing"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/webtransport-go"
 )
 
+var (
+	serverURL = config.URL("url", "https://localhost:4433/wt", "WebTransport endpoint")
+	legacy    = flag.Bool("legacy", false, "Use the legacy length-prefixed text framing instead of binary frames")
+	traceConf = config.TracingFlags()
+)
+
+const (
+	maxRetries = 5
+	retryDelay = 500 * time.Millisecond
+)
+
+// connect dials a session and opens the stream carrying the conversation.
+// The dial's trace context and the token in $LLMWT_TOKEN go to the server
+// in the CONNECT request.
+func connect(ctx context.Context, d *webtransport.Dialer) (*webtransport.Session, *message.Framer, error) {
+	dialCtx, span := tracing.Start(ctx, "webtransport.dial", tracing.Client)
+	header := make(http.Header)
+	tracing.Inject(dialCtx, header)
+	auth.SetToken(header)
+	_, session, err := d.Dial(dialCtx, *serverURL, header)
+	span.End(err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial failed: %w", err)
+	}
+	_, span = tracing.Start(dialCtx, "webtransport.open_stream", tracing.Internal)
+	stream, err := session.OpenStreamSync(ctx)
+	span.End(err)
+	if err != nil {
+		session.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("open stream failed: %w", err)
+	}
+	framer, err := message.NewFramer(stream, session.SessionState().ApplicationProtocol)
+	if err != nil {
+		session.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("framing: %w", err)
+	}
+	return session, framer, nil
+}
+
+// resume redials after losing the session and asks for the rest of the
+// response from token offset on. The conversation continues on the new
+// stream.
+func resume(ctx context.Context, d *webtransport.Dialer, responseID string, offset int) (*webtransport.Session, *message.Framer, error) {
+	session, framer, err := connect(ctx, d)
+	if err != nil {
+		return nil, nil, err
+	}
+	md := message.Metadata{ResponseID: responseID, Offset: offset, Traceparent: tracing.Traceparent(ctx)}
+	if err := framer.WriteJSON(message.FrameMetadata, md); err != nil {
+		session.CloseWithError(0, "")
+		return nil, nil, fmt.Errorf("resume request failed: %w", err)
+	}
+	return session, framer, nil
+}
+
 func main() {
+	config.Parse()
+	flushTraces, err := traceConf.Start("client")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer flushTraces()
+
 	d := webtransport.Dialer{
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true,
@@ -27,21 +95,16 @@ func main() {
 			EnableStreamResetPartialDelivery: true,
 		},
 	}
-
-	ctx := context.Background()
-	_, session, err := d.Dial(ctx, "https://localhost:4433/wt", nil)
-	if err != nil {
-		log.Fatalf("dial failed: %v", err)
+	if !*legacy {
+		d.ApplicationProtocols = []string{message.ProtocolV1}
 	}
-	defer session.CloseWithError(0, "client closed")
 
-	stream, err := session.OpenStreamSync(ctx)
+	ctx := context.Background()
+	session, framer, err := connect(ctx, &d)
 	if err != nil {
-		log.Fatalf("open stream failed: %v", err)
+		log.Fatal(err)
 	}
-	defer stream.Close()
-
-	reader := bufio.NewReader(stream)
+	defer func() { session.CloseWithError(0, "client closed") }()
 	scanner := bufio.NewScanner(os.Stdin)
 
 	fmt.Println("Connected. Type a message and press Enter to send. Ctrl+C to quit.")
@@ -55,7 +118,15 @@ func main() {
 			continue
 		}
 
-		if err := message.Write(stream, text); err != nil {
+		// Each prompt is a trace of its own. Its context goes ahead of it
+		// in a METADATA frame.
+		chatCtx, span := tracing.Start(ctx, "chat", tracing.Client)
+		if tp := tracing.Traceparent(chatCtx); tp != "" && !framer.Legacy() {
+			if err := framer.WriteJSON(message.FrameMetadata, message.Metadata{Traceparent: tp}); err != nil {
+				log.Fatalf("send failed: %v", err)
+			}
+		}
+		if err := framer.WriteToken(text); err != nil {
 			log.Fatalf("send failed: %v", err)
 		}
 
@@ -65,15 +136,70 @@ func main() {
 		var lastTokenTime time.Time
 
 		var totalInterTokenTime time.Duration
+		var usage *message.UsageStats
+		var responseID string
+		var respErr error
+		retries := 0
 
+	response:
 		for {
-			token, err := message.Read(reader)
+			frame, err := framer.ReadFrame()
 			if err != nil {
-				log.Fatalf("receive failed: %v", err)
+				// A server that shut down is not coming back.
+				var sessErr *webtransport.SessionError
+				if errors.As(err, &sessErr) && sessErr.ErrorCode == message.SessionGoingAway {
+					span.End(err)
+					fmt.Println("\n[server shut down]")
+					return
+				}
+				// Legacy framing has no response IDs, so there is nothing
+				// to resume.
+				if responseID == "" || retries == maxRetries {
+					log.Fatalf("receive failed: %v", err)
+				}
+				retries++
+				fmt.Printf("\n[session lost (%v), resuming at token %d]\n", err, tokenCount)
+				session.CloseWithError(0, "session lost")
+				time.Sleep(time.Duration(retries) * retryDelay)
+				s, f, err := resume(chatCtx, &d, responseID, tokenCount)
+				if err != nil {
+					// The next read fails on the closed session, retrying.
+					log.Printf("resume failed: %v", err)
+					continue
+				}
+				session, framer = s, f
+				continue
 			}
-			if token == "" {
-				break
+			switch frame.Type {
+			case message.FrameMetadata:
+				var md message.Metadata
+				if err := frame.DecodeJSON(&md); err == nil && md.ResponseID != "" {
+					responseID = md.ResponseID
+				}
+				continue
+			case message.FrameToken:
+				retries = 0
+			case message.FrameEnd:
+				break response
+			case message.FrameError:
+				fmt.Printf("\n[error: %s]", frame.Payload)
+				respErr = errors.New(string(frame.Payload))
+				break response
+			case message.FrameGoAway:
+				span.End(nil)
+				fmt.Printf("[server going away: %s]\n", frame.Payload)
+				return
+			case message.FrameUsageStats:
+				usage = new(message.UsageStats)
+				if err := frame.DecodeJSON(usage); err != nil {
+					log.Printf("bad usage stats: %v", err)
+					usage = nil
+				}
+				continue
+			default:
+				continue
 			}
+			token := string(frame.Payload)
 			now := time.Now()
 			tokenCount++
 			if tokenCount == 1 {
@@ -85,6 +211,10 @@ func main() {
 			fmt.Print(token)
 		}
 		fmt.Println()
+		span.Set("tokens", tokenCount)
+		span.Set("ttft", ttft)
+		span.Set("retries", retries)
+		span.End(respErr)
 
 		if tokenCount > 0 {
 			var avgTBT time.Duration
@@ -93,5 +223,13 @@ func main() {
 			}
 			fmt.Printf("[TTFT: %s | tokens: %d | avg TBT: %s]\n", ttft, tokenCount, avgTBT)
 		}
+		if usage != nil {
+			fmt.Printf("[usage: %s]\n", usage)
+			// The API's token count, unlike tokenCount, doesn't depend
+			// on how tokens were split into messages.
+			if usage.CompletionTokens > 1 && totalInterTokenTime > 0 {
+				fmt.Printf("[received: %.1f tok/s]\n", float64(usage.CompletionTokens-1)/totalInterTokenTime.Seconds())
+			}
+		}
 	}
 }
@@ -0,0 +1,400 @@
+// Package config loads the settings of the binaries. Every setting is a
+// command-line flag; any flag not given on the command line can instead be
+// set by an environment variable (LLMWT_ and the flag name in upper case,
+// with dashes as underscores: -llm-url is $LLMWT_LLM_URL) or by a key of the
+// same name in a config file, in that order of precedence. Config files are
+// flat YAML ("key: value") or TOML ("key = value"); see ParseFile.
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"llm-webtransport/auth"
+	"llm-webtransport/llm"
+	"llm-webtransport/logging"
+	"llm-webtransport/origin"
+	"llm-webtransport/tracing"
+)
+
+// EnvPrefix starts the name of every setting's environment variable.
+const EnvPrefix = "LLMWT_"
+
+var (
+	configFile  = flag.String("config", "", "Config file (YAML or TOML) of flag values; also $"+EnvPrefix+"CONFIG")
+	printConfig = flag.Bool("print-config", false, "Print the resulting configuration and exit")
+)
+
+// Parse parses the command line, then fills in the flags it did not set
+// from the environment and the config file, and validates the result. With
+// -print-config it prints the configuration and exits. Errors are fatal.
+func Parse() {
+	flag.Parse()
+	if err := load(flag.CommandLine, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+	if *printConfig {
+		Print(flag.CommandLine)
+		os.Exit(0)
+	}
+}
+
+// load fills in the flags of fs not set on its command line. Config file
+// keys that are not flags of fs are reported to warn and skipped, since a
+// file may be shared by binaries with different flags.
+func load(fs *flag.FlagSet, warn io.Writer) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		name := EnvName(f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("$%s: %w", name, err))
+			}
+			set[f.Name] = true
+		}
+	})
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if path != "" {
+		values, err := ParseFile(path)
+		if err != nil {
+			return err
+		}
+		for _, kv := range values {
+			f := fs.Lookup(kv.Key)
+			if f == nil {
+				fmt.Fprintf(warn, "config: %s:%d: ignoring %q, which is not a setting of %s\n", path, kv.Line, kv.Key, filepath.Base(fs.Name()))
+				continue
+			}
+			if set[kv.Key] {
+				continue
+			}
+			for _, v := range kv.Values {
+				if l, ok := f.Value.(*listValue); ok {
+					// A file lists the items, so commas are not separators.
+					*l.p = append(*l.p, v)
+					continue
+				}
+				if err := fs.Set(kv.Key, v); err != nil {
+					errs = append(errs, fmt.Errorf("%s:%d: %s: %w", path, kv.Line, kv.Key, err))
+				}
+			}
+		}
+	}
+
+	for _, check := range checks {
+		if err := check(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checks validate settings that no single flag can, run by Parse.
+var checks []func() error
+
+// Check registers a validation run once all settings are loaded.
+func Check(f func() error) { checks = append(checks, f) }
+
+// EnvName returns the environment variable setting the named flag.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Print writes the value of every flag of fs as a YAML config file, except
+// -config and -print-config.
+func Print(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		var v string
+		if l, ok := f.Value.(*listValue); ok {
+			var items []string
+			for _, item := range *l.p {
+				items = append(items, strconv.Quote(item))
+			}
+			v = "[" + strings.Join(items, ", ") + "]"
+		} else {
+			v = f.Value.String()
+			if _, err := strconv.ParseFloat(v, 64); err != nil && v != "true" && v != "false" {
+				v = strconv.Quote(v)
+			}
+		}
+		fmt.Printf("%s: %s\n", f.Name, v)
+	})
+}
+
+// List defines a repeatable flag, collecting its values in order. Each
+// value on the command line or in the environment may be a comma-separated
+// list, which is how an environment variable sets several. In a config file
+// it takes a list, whose items are kept whole.
+func List(name, usage string) *[]string {
+	p := new([]string)
+	flag.Var(&listValue{p}, name, usage)
+	return p
+}
+
+type listValue struct{ p *[]string }
+
+func (l *listValue) String() string {
+	if l.p == nil {
+		return ""
+	}
+	return strings.Join(*l.p, ",")
+}
+
+func (l *listValue) Set(v string) error {
+	for item := range strings.SplitSeq(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l.p = append(*l.p, item)
+		}
+	}
+	return nil
+}
+
+// Addr defines a flag holding a host:port address.
+func Addr(name, value, usage string) *string {
+	p := new(string)
+	AddrVar(p, name, value, usage)
+	return p
+}
+
+// AddrVar is like Addr but stores the value in p.
+func AddrVar(p *string, name, value, usage string) {
+	validated(p, name, value, usage, func(s string) error {
+		_, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return err
+		}
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return fmt.Errorf("invalid port %q", port)
+		}
+		return nil
+	})
+}
+
+// URL defines a flag holding an absolute http or https URL. An empty value
+// is allowed.
+func URL(name, value, usage string) *string {
+	p := new(string)
+	URLVar(p, name, value, usage)
+	return p
+}
+
+// URLVar is like URL but stores the value in p.
+func URLVar(p *string, name, value, usage string) {
+	validated(p, name, value, usage, func(s string) error {
+		if s == "" {
+			return nil
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%q is not an http(s) URL", s)
+		}
+		return nil
+	})
+}
+
+// validated defines a string flag whose values must pass check.
+func validated(p *string, name, value, usage string, check func(string) error) {
+	*p = value
+	flag.Var(&checkedString{p, check}, name, usage)
+}
+
+type checkedString struct {
+	p     *string
+	check func(string) error
+}
+
+func (s *checkedString) String() string {
+	if s.p == nil {
+		return ""
+	}
+	return *s.p
+}
+
+func (s *checkedString) Set(v string) error {
+	if err := s.check(v); err != nil {
+		return err
+	}
+	*s.p = v
+	return nil
+}
+
+// LLM selects the LLM API a server forwards prompts to. Its key is read
+// from $LLM_API_KEY rather than a flag, so that it never shows up in
+// process listings or -print-config.
+type LLM struct {
+	Kind  string
+	URL   string
+	Model string
+}
+
+// LLMFlags defines -llm, -llm-url and -model.
+func LLMFlags() *LLM {
+	c := &LLM{}
+	flag.StringVar(&c.Kind, "llm", llm.KindOpenAI, "LLM API: openai (OpenAI-compatible), ollama (native /api/chat) or anthropic; the key is read from $LLM_API_KEY")
+	URLVar(&c.URL, "llm-url", "", "LLM API base URL (default: local Ollama, or api.anthropic.com)")
+	flag.StringVar(&c.Model, "model", "gemma3:12b", "Model to request when a request names none")
+	Check(func() error {
+		_, err := c.Provider()
+		if err == nil && c.Model == "" {
+			err = errors.New("-model is empty")
+		}
+		return err
+	})
+	return c
+}
+
+// Provider returns the selected LLM API.
+func (c *LLM) Provider() (llm.Provider, error) {
+	return llm.NewProvider(c.Kind, c.URL, os.Getenv("LLM_API_KEY"))
+}
+
+// TLS is a server's certificate and key.
+type TLS struct {
+	CertFile string
+	KeyFile  string
+}
+
+// TLSFlags defines -tls-cert and -tls-key.
+func TLSFlags() *TLS {
+	c := &TLS{}
+	flag.StringVar(&c.CertFile, "tls-cert", "certs/cert.pem", "TLS certificate (PEM)")
+	flag.StringVar(&c.KeyFile, "tls-key", "certs/key.pem", "TLS private key (PEM)")
+	return c
+}
+
+// Load reads the certificate.
+func (c *TLS) Load() (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return cert, fmt.Errorf("load TLS certificate: %w (run ./generate_cert.sh first)", err)
+	}
+	return cert, nil
+}
+
+// Tracing is where spans are exported; see the tracing package.
+type Tracing struct {
+	Endpoint string
+	File     string
+}
+
+// TracingFlags defines -otlp-endpoint and -trace-file.
+func TracingFlags() *Tracing {
+	c := &Tracing{}
+	URLVar(&c.Endpoint, "otlp-endpoint", "", "OTLP/HTTP collector to export trace spans to, such as http://localhost:4318")
+	flag.StringVar(&c.File, "trace-file", "", "File to append trace spans to, as OTLP/JSON lines")
+	return c
+}
+
+// Start starts exporting the spans of the named service, if an endpoint or
+// file is set. The returned function flushes them.
+func (c *Tracing) Start(service string) (func(), error) {
+	return tracing.Setup(service, c.Endpoint, c.File)
+}
+
+// LogFlags defines -log-level, -log-format, -log-prompts and -log-prompt-len.
+func LogFlags() *logging.Options {
+	o := &logging.Options{}
+	flag.StringVar(&o.Level, "log-level", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&o.Format, "log-format", "json", "Log format: json or text")
+	flag.StringVar(&o.Prompts, "log-prompts", logging.PromptsRedact, "How prompts are logged: redact (size only), truncate (the first -log-prompt-len characters) or full")
+	flag.IntVar(&o.PromptLen, "log-prompt-len", 40, "Characters of a prompt logged with -log-prompts truncate")
+	Check(o.Validate)
+	return o
+}
+
+// Auth selects how a server authenticates its clients; see the auth
+// package. With neither file set, authentication is off.
+type Auth struct {
+	APIKeys  string
+	JWKS     string
+	Issuer   string
+	Audience string
+}
+
+// AuthFlags defines -api-keys, -jwks, -jwt-issuer and -jwt-audience.
+func AuthFlags() *Auth {
+	c := &Auth{}
+	flag.StringVar(&c.APIKeys, "api-keys", "", "File of API keys, one \"name key\" per line, that clients may send as bearer tokens")
+	flag.StringVar(&c.JWKS, "jwks", "", "JWKS file of HMAC keys verifying clients' JWT bearer tokens")
+	flag.StringVar(&c.Issuer, "jwt-issuer", "", "Issuer (iss) a JWT must have")
+	flag.StringVar(&c.Audience, "jwt-audience", "", "Audience (aud) a JWT must include")
+	Check(func() error {
+		if c.JWKS == "" && (c.Issuer != "" || c.Audience != "") {
+			return errors.New("-jwt-issuer and -jwt-audience need -jwks")
+		}
+		return nil
+	})
+	return c
+}
+
+// Load reads the key files, returning a nil Authenticator if
+// authentication is off.
+func (c *Auth) Load() (auth.Authenticator, error) {
+	var chain auth.Chain
+	if c.APIKeys != "" {
+		keys, err := auth.LoadAPIKeys(c.APIKeys)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, keys)
+	}
+	if c.JWKS != "" {
+		jwks, err := auth.LoadJWKS(c.JWKS, c.Issuer, c.Audience)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, jwks)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// Origins are the web origins, besides its own, whose pages may use a
+// server; see the origin package.
+type Origins struct {
+	Allowed []string
+}
+
+// OriginFlags defines -allowed-origins.
+func OriginFlags() *Origins {
+	c := &Origins{}
+	flag.Var(&listValue{&c.Allowed}, "allowed-origins", "Origin whose pages may use the server, such as https://app.example.com, https://*.example.com or * for any (repeatable, or comma-separated)")
+	Check(func() error {
+		_, err := c.Policy()
+		return err
+	})
+	return c
+}
+
+// Policy returns the origin policy.
+func (c *Origins) Policy() (*origin.Policy, error) {
+	return origin.NewPolicy(c.Allowed)
+}
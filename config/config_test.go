@@ -0,0 +1,176 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestListValueSet(t *testing.T) {
+	var got []string
+	l := &listValue{&got}
+	for _, v := range []string{"a", "b,c", " d , e ", "", "f,,"} {
+		if err := l.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"a", "b", "c", "d", "e", "f"}; !slices.Equal(got, want) {
+		t.Errorf("values = %q, want %q", got, want)
+	}
+	if s := l.String(); s != "a,b,c,d,e,f" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+// writeFile writes content to a file named name in a test directory and
+// returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseFile(t *testing.T) {
+	want := []Setting{
+		{Key: "addr", Values: []string{":8443"}, Line: 3},
+		{Key: "llm-url", Values: []string{"http://gpu-box:11434"}, Line: 4},
+		{Key: "model", Values: []string{"gemma3:12b"}, Line: 5},
+		{Key: "log-prompts", Values: []string{"a # not a comment"}, Line: 6},
+		{Key: "allowed-origins", Values: []string{"https://a.example.com", "https://b.example.com,https://c.example.com"}, Line: 7},
+		{Key: "prompts", Values: nil, Line: 8},
+	}
+	yaml := `---
+# servers
+addr: :8443
+llm_url: "http://gpu-box:11434"   # underscores for dashes
+model: 'gemma3:12b'
+log-prompts: "a # not a comment"
+allowed-origins: [https://a.example.com, "https://b.example.com,https://c.example.com"]
+prompts: []
+`
+	toml := `
+# servers
+addr = ":8443"
+llm_url = "http://gpu-box:11434"   # underscores for dashes
+model = 'gemma3:12b'
+log-prompts = "a # not a comment"
+allowed-origins = ["https://a.example.com", 'https://b.example.com,https://c.example.com']
+prompts = []
+`
+	for name, content := range map[string]string{"llmwt.yaml": yaml, "llmwt.toml": toml} {
+		got, err := ParseFile(writeFile(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\n got %q\nwant %q", name, got, want)
+		}
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"c.yaml", "llm:\n  url: x\n", ":2: nested settings are not supported"},
+		{"c.toml", "[llm]\nurl = 'x'\n", ":1: nested settings are not supported"},
+		{"c.yaml", "addr\n", ":1: expected key : value"},
+		{"c.toml", "addr: :8080\n", ":1: expected key = value"},
+		{"c.toml", "prompts = [a, b\n", ":1: prompts: unterminated list"},
+		{"c.toml", "model = 'gemma\n", ":1: model: unterminated string"},
+		{"c.toml", `model = "gemma` + "\n", ":1: model: invalid syntax"},
+	}
+	for _, tt := range tests {
+		_, err := ParseFile(writeFile(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: error = %v, want %q", tt.content, err, tt.want)
+		}
+	}
+}
+
+// testFlags returns a flag set like a binary's, and the values of its
+// flags.
+func testFlags() (*flag.FlagSet, map[string]*string, *[]string) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	values := map[string]*string{}
+	for _, name := range []string{"addr", "llm-url", "model"} {
+		values[name] = fs.String(name, "default", "")
+	}
+	origins := new([]string)
+	fs.Var(&listValue{origins}, "allowed-origins", "")
+	return fs, values, origins
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "llmwt.yaml", `addr: file
+llm-url: file
+model: file
+allowed-origins: ["https://a.example.com,x", https://b.example.com]
+prompts: [corpus.jsonl]
+`)
+	old := *configFile
+	*configFile = path
+	defer func() { *configFile = old }()
+	t.Setenv(EnvName("addr"), "env")
+	t.Setenv(EnvName("llm-url"), "env")
+
+	fs, values, origins := testFlags()
+	if err := fs.Parse([]string{"-addr", "flag"}); err != nil {
+		t.Fatal(err)
+	}
+	var warnings strings.Builder
+	if err := load(fs, &warnings); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"addr": "flag", "llm-url": "env", "model": "file"} {
+		if got := *values[name]; got != want {
+			t.Errorf("-%s = %q, want %q", name, got, want)
+		}
+	}
+	if want := []string{"https://a.example.com,x", "https://b.example.com"}; !slices.Equal(*origins, want) {
+		t.Errorf("-allowed-origins = %q, want the file's items whole: %q", *origins, want)
+	}
+	if w := warnings.String(); !strings.Contains(w, `:5: ignoring "prompts", which is not a setting of server`) {
+		t.Errorf("warnings = %q", w)
+	}
+
+	// The environment splits lists at commas, and wins over the file.
+	t.Setenv(EnvName("allowed-origins"), "https://c.example.com, https://d.example.com")
+	fs, _, origins = testFlags()
+	fs.Parse(nil)
+	if err := load(fs, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"https://c.example.com", "https://d.example.com"}; !slices.Equal(*origins, want) {
+		t.Errorf("-allowed-origins = %q, want %q", *origins, want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	old := *configFile
+	defer func() { *configFile = old }()
+
+	*configFile = filepath.Join(t.TempDir(), "missing.yaml")
+	fs, _, _ := testFlags()
+	if err := load(fs, io.Discard); err == nil {
+		t.Error("load() of a missing file succeeded")
+	}
+
+	*configFile = writeFile(t, "llmwt.yaml", "addr: file\n")
+	fs = flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.Int("addr", 0, "")
+	fs.Int("port", 0, "")
+	t.Setenv(EnvName("port"), "x")
+	err := load(fs, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "$LLMWT_PORT") || !strings.Contains(err.Error(), ":1: addr") {
+		t.Errorf("load() error = %v, want both bad values", err)
+	}
+}
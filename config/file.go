@@ -0,0 +1,136 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Setting is one key of a config file. Values holds one value, or each
+// element of a list for repeatable flags.
+type Setting struct {
+	Key    string
+	Values []string
+	Line   int
+}
+
+// ParseFile reads a flat config file: YAML ("key: value") if its name ends
+// in .yaml or .yml, TOML ("key = value") otherwise. Keys are flag names,
+// with underscores accepted for dashes. Values are bare, double- or
+// single-quoted, or an inline list ("[a, b]") for repeatable flags. Blank
+// lines and # comments are skipped; nesting (YAML indentation, TOML
+// tables) is an error.
+func ParseFile(path string) ([]Setting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sep := "="
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		sep = ":"
+	}
+	var settings []Setting
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := stripComment(sc.Text())
+		if strings.TrimSpace(line) == "" || line == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || line[0] == '[' {
+			return nil, fmt.Errorf("%s:%d: nested settings are not supported", path, n)
+		}
+		key, value, ok := strings.Cut(line, sep)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key %s value", path, n, sep)
+		}
+		key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		values, err := parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, key, err)
+		}
+		settings = append(settings, Setting{Key: key, Values: values, Line: n})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// stripComment removes a # comment that is not inside quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t")
+}
+
+func parseValue(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") {
+		v, err := unquote(s)
+		return []string{v}, err
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated list %s", s)
+	}
+	var values []string
+	for _, item := range splitList(s[1 : len(s)-1]) {
+		v, err := unquote(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// splitList splits the items of an inline list at commas outside quotes.
+func splitList(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var items []string
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+func unquote(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	}
+	return s, nil
+}
@@ -0,0 +1,59 @@
+// Package generation runs the servers' LLM requests independently of the
+// clients that made them. Each request's output is buffered in a Response,
+// so that a client that loses its connection can resume it from an offset
+// on a new one, and the generation is cancelled only once no client has
+// been attached for a window the server chooses.
+package generation
+
+import (
+	"context"
+	"log/slog"
+
+	"llm-webtransport/llm"
+	"llm-webtransport/logging"
+	"llm-webtransport/metrics"
+	"llm-webtransport/tracing"
+)
+
+// Run runs r's LLM request on provider, passing each token to add, which
+// appends it to r in the server's form. Its span is a child of the one in
+// reqCtx, and its outcome is logged, in a single record, by reqCtx's
+// logger and recorded in transport's metrics. The caller then releases r.
+func Run[T any](reqCtx context.Context, r *Response[T], provider llm.Provider, transport string, inputBytes int, add func(token string)) (llm.Stats, error) {
+	l := logging.FromContext(reqCtx)
+	ctx := logging.NewContext(tracing.ContextWithSpanContext(r.ctx, tracing.SpanContextFromContext(reqCtx)), l)
+	ctx, span := tracing.Start(ctx, "llm.stream_chat", tracing.Client)
+	stats, err := provider.StreamChat(ctx, r.Messages, r.Opts, func(token string) error {
+		add(token)
+		return nil
+	})
+	endSpan(span, stats, err)
+	logCompletion(l, inputBytes, stats, err, r.abandonReason())
+	metrics.Generation(transport, r.Opts.Model, r.Identity, stats, err)
+	return stats, err
+}
+
+// logCompletion writes the single record of a finished request: its input
+// size and the LLM's stats, at warning level if generation failed.
+// abandoned is why a cancelled generation was given up.
+func logCompletion(l *slog.Logger, inputBytes int, stats llm.Stats, err error, abandoned string) {
+	switch {
+	case stats.Cancelled:
+		l.Info("request complete", "input_bytes", inputBytes, slog.Any("", stats), "outcome", "abandoned: "+abandoned)
+	case err != nil:
+		l.Warn("request complete", "input_bytes", inputBytes, slog.Any("", stats), "outcome", "llm error", "err", err)
+	default:
+		l.Info("request complete", "input_bytes", inputBytes, slog.Any("", stats), "outcome", "ok")
+	}
+}
+
+// endSpan records the outcome of an LLM request on its span.
+func endSpan(span *tracing.Span, stats llm.Stats, err error) {
+	span.Set("llm.model", stats.Model)
+	span.Set("llm.prompt_tokens", stats.PromptTokens)
+	span.Set("llm.completion_tokens", stats.CompletionTokens)
+	span.Set("llm.finish_reason", stats.FinishReason)
+	span.Set("llm.first_token", stats.FirstToken)
+	span.Set("llm.cancelled", stats.Cancelled)
+	span.End(err)
+}
@@ -0,0 +1,157 @@
+package generation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"llm-webtransport/llm"
+	"llm-webtransport/logging"
+	"llm-webtransport/message"
+)
+
+// fakeProvider streams tokens, then waits to be cancelled if hang is set.
+type fakeProvider struct {
+	tokens []string
+	hang   bool
+	err    error
+}
+
+func (p fakeProvider) StreamChat(ctx context.Context, messages []llm.Message, opts llm.Options, onToken func(string) error) (llm.Stats, error) {
+	for _, t := range p.tokens {
+		onToken(t)
+	}
+	if p.hang {
+		<-ctx.Done()
+		return llm.Stats{Cancelled: true}, ctx.Err()
+	}
+	return llm.Stats{CompletionTokens: len(p.tokens)}, p.err
+}
+
+func (fakeProvider) CheckOptions(llm.Options) error               { return nil }
+func (fakeProvider) ListModels(context.Context) ([]string, error) { return nil, nil }
+
+var testMessages = []llm.Message{{Role: llm.RoleUser, Content: "hi"}}
+
+// run runs r on p and returns its result and the log it wrote.
+func run(t *testing.T, r *Response[string], p llm.Provider) (llm.Stats, error, string) {
+	t.Helper()
+	var log bytes.Buffer
+	ctx := logging.NewContext(context.Background(), slog.New(slog.NewTextHandler(&log, nil)))
+	stats, err := Run(ctx, r, p, "test", 2, r.Append)
+	return stats, err, log.String()
+}
+
+func TestRun(t *testing.T) {
+	s := NewStore[string]()
+	r := s.Start(testMessages, llm.Options{}, "", "alice")
+	stats, err, log := run(t, r, fakeProvider{tokens: []string{"a", "b"}})
+	if err != nil || stats.CompletionTokens != 2 {
+		t.Fatalf("Run() = %+v, %v", stats, err)
+	}
+	if !strings.Contains(log, "outcome=ok") || !strings.Contains(log, "input_bytes=2") {
+		t.Errorf("log = %s", log)
+	}
+	s.Release(r, message.UsageStats{CompletionTokens: 2}, nil)
+	tokens, usage, err := r.Result()
+	if strings.Join(tokens, "") != "ab" || usage.CompletionTokens != 2 || err != nil {
+		t.Errorf("Result() = %q, %+v, %v", tokens, usage, err)
+	}
+
+	r = s.Start(testMessages, llm.Options{}, "", "alice")
+	_, err, log = run(t, r, fakeProvider{err: errors.New("boom")})
+	if err == nil || !strings.Contains(log, "level=WARN") || !strings.Contains(log, `outcome="llm error"`) {
+		t.Errorf("failed Run() = %v, log = %s", err, log)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	tests := []struct {
+		name   string
+		window time.Duration
+		want   string
+	}{
+		{"at once", 0, "outcome=\"abandoned: client disconnected\""},
+		{"after window", 10 * time.Millisecond, "outcome=\"abandoned: no client for 10ms\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewStore[string]().Start(testMessages, llm.Options{}, "", "alice")
+			r.Attach()
+			r.Attach()
+			r.Detach(tt.window)
+			if r.ctx.Err() != nil {
+				t.Fatal("cancelled with a client attached")
+			}
+			r.Detach(tt.window)
+			stats, _, log := run(t, r, fakeProvider{hang: true})
+			if !stats.Cancelled || !strings.Contains(log, tt.want) {
+				t.Errorf("stats = %+v, log = %s", stats, log)
+			}
+		})
+	}
+}
+
+func TestAttachStopsAbandon(t *testing.T) {
+	s := NewStore[string]()
+	r := s.Start(testMessages, llm.Options{}, "", "alice")
+	r.Attach()
+	r.Detach(20 * time.Millisecond)
+	r.Attach()
+	time.Sleep(50 * time.Millisecond)
+	if r.ctx.Err() != nil {
+		t.Fatal("cancelled although a client came back")
+	}
+	s.Release(r, message.UsageStats{}, nil)
+	r.Detach(0)
+	if r.abandonReason() != "" {
+		t.Errorf("finished response abandoned: %q", r.abandonReason())
+	}
+}
+
+func TestSince(t *testing.T) {
+	s := NewStore[string]()
+	r := s.Start(testMessages, llm.Options{}, "", "alice")
+	r.Append("a")
+	items, changed, done := r.Since(0)
+	if len(items) != 1 || done {
+		t.Fatalf("Since(0) = %q, %v", items, done)
+	}
+	r.Append("b")
+	select {
+	case <-changed:
+	default:
+		t.Fatal("changed not closed by Append")
+	}
+	if items, _, _ := r.Since(1); len(items) != 1 || items[0] != "b" {
+		t.Errorf("Since(1) = %q", items)
+	}
+	if items, _, _ := r.Since(5); len(items) != 0 {
+		t.Errorf("Since(5) = %q", items)
+	}
+	s.Release(r, message.UsageStats{}, nil)
+	if _, _, done := r.Since(2); !done || r.ctx.Err() == nil {
+		t.Error("Release did not complete the response")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	s := NewStore[string]()
+	r := s.Start(testMessages, llm.Options{Model: "m"}, "conv", "alice")
+	got, err := s.Lookup(r.ID, "alice")
+	if err != nil || got != r || got.ConversationID != "conv" || got.Opts.Model != "m" {
+		t.Errorf("Lookup() = %+v, %v", got, err)
+	}
+	for _, tt := range []struct{ id, identity string }{
+		{r.ID, "bob"},
+		{"unknown", "alice"},
+	} {
+		if _, err := s.Lookup(tt.id, tt.identity); err == nil || !strings.Contains(err.Error(), "unknown or expired") {
+			t.Errorf("Lookup(%q, %q) error = %v", tt.id, tt.identity, err)
+		}
+	}
+}
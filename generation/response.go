@@ -0,0 +1,188 @@
+package generation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"llm-webtransport/llm"
+	"llm-webtransport/message"
+)
+
+// retainFor is how long a finished response stays available for replay.
+const retainFor = 60 * time.Second
+
+// Response buffers the output of one generation, items of type T, so that
+// a client that loses its connection can resume it on a new one.
+type Response[T any] struct {
+	ID             string
+	Messages       []llm.Message // the conversation answered, ending with the prompt
+	Opts           llm.Options
+	ConversationID string // the client's, if its protocol has one
+	Identity       string // the client's; only it may resume the response
+	ctx            context.Context
+	cancel         context.CancelFunc
+
+	mu          sync.Mutex
+	items       []T
+	done        bool
+	usage       message.UsageStats
+	err         error         // generation failed or was abandoned
+	changed     chan struct{} // closed and replaced on every change
+	subscribers int
+	abandon     *time.Timer
+	abandoned   string // why the generation was cancelled, for its log record
+}
+
+// Append adds an item of output.
+func (r *Response[T]) Append(item T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = append(r.items, item)
+	r.notify()
+}
+
+// Len returns the number of items so far.
+func (r *Response[T]) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.items)
+}
+
+func (r *Response[T]) finish(usage message.UsageStats, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done, r.usage, r.err = true, usage, err
+	if r.abandon != nil {
+		r.abandon.Stop()
+	}
+	r.notify()
+}
+
+func (r *Response[T]) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Since returns the items from index from on, a channel closed when more
+// arrive, and whether the response is complete.
+func (r *Response[T]) Since(from int) ([]T, <-chan struct{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var items []T
+	if from < len(r.items) {
+		items = r.items[from:len(r.items):len(r.items)]
+	}
+	return items, r.changed, r.done
+}
+
+// Result returns the outcome of a complete response, as given to Release.
+func (r *Response[T]) Result() (items []T, usage message.UsageStats, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.items[:len(r.items):len(r.items)], r.usage, r.err
+}
+
+// Attach registers a client delivering the response, keeping the
+// generation alive.
+func (r *Response[T]) Attach() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribers++
+	if r.abandon != nil {
+		r.abandon.Stop()
+		r.abandon = nil
+	}
+}
+
+// Detach unregisters a client. When the last one leaves mid-generation,
+// the generation is cancelled unless a client attaches within window: at
+// once if window is 0.
+func (r *Response[T]) Detach(window time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribers--
+	if r.subscribers > 0 || r.done {
+		return
+	}
+	if window <= 0 {
+		r.abandoned = "client disconnected"
+		r.cancel()
+		return
+	}
+	r.abandon = time.AfterFunc(window, func() {
+		r.mu.Lock()
+		r.abandoned = "no client for " + window.String()
+		r.mu.Unlock()
+		r.cancel()
+	})
+}
+
+// abandonReason returns why the generation was cancelled, or "".
+func (r *Response[T]) abandonReason() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.abandoned
+}
+
+// Store holds in-progress and recently finished responses.
+type Store[T any] struct {
+	mu        sync.Mutex
+	responses map[string]*Response[T]
+}
+
+// NewStore returns an empty store.
+func NewStore[T any]() *Store[T] {
+	return &Store[T]{responses: make(map[string]*Response[T])}
+}
+
+// Start registers a new response to messages, generated with opts for
+// identity. Its context is independent of any client's connection, so the
+// generation survives the client's disconnects.
+func (s *Store[T]) Start(messages []llm.Message, opts llm.Options, conversationID, identity string) *Response[T] {
+	b := make([]byte, 8)
+	rand.Read(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Response[T]{
+		ID:             hex.EncodeToString(b),
+		Messages:       slices.Clone(messages),
+		Opts:           opts,
+		ConversationID: conversationID,
+		Identity:       identity,
+		ctx:            ctx,
+		cancel:         cancel,
+		changed:        make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.responses[r.ID] = r
+	s.mu.Unlock()
+	return r
+}
+
+// Release marks r complete with its outcome and forgets it after
+// retainFor.
+func (s *Store[T]) Release(r *Response[T], usage message.UsageStats, err error) {
+	r.finish(usage, err)
+	r.cancel()
+	time.AfterFunc(retainFor, func() {
+		s.mu.Lock()
+		delete(s.responses, r.ID)
+		s.mu.Unlock()
+	})
+}
+
+// Lookup returns identity's response id. Other clients' responses are
+// unknown.
+func (s *Store[T]) Lookup(id, identity string) (*Response[T], error) {
+	s.mu.Lock()
+	r := s.responses[id]
+	s.mu.Unlock()
+	if r == nil || r.Identity != identity {
+		return nil, fmt.Errorf("unknown or expired response %q", id)
+	}
+	return r, nil
+}
@@ -3,21 +3,77 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
 	"time"
+
+	"llm-webtransport/auth"
+	"llm-webtransport/config"
+	"llm-webtransport/llm"
+	"llm-webtransport/message"
+	"llm-webtransport/sse"
 )
 
 type chatRequest struct {
-	Message string `json:"message"`
+	Messages []llm.Message `json:"messages"`
+}
+
+var chatURL = config.URL("url", "https://localhost:8080/chat", "HTTP SSE chat endpoint")
+
+const (
+	maxRetries = 5
+	retryDelay = 500 * time.Millisecond
+)
+
+// post sends the conversation, ending with a prompt, with the token in
+// $LLMWT_TOKEN.
+func post(client *http.Client, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, *chatURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	auth.SetToken(req.Header)
+	return client.Do(req)
+}
+
+// resume reconnects to an interrupted response; the server replays the
+// events after lastEventID and continues live.
+func resume(client *http.Client, lastEventID string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, *chatURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Last-Event-ID", lastEventID)
+	auth.SetToken(req.Header)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
 }
 
 func main() {
+	config.Parse()
+	// The server uses a self-signed certificate.
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
 	scanner := bufio.NewScanner(os.Stdin)
+	// The SSE endpoint is stateless, so the client sends the whole
+	// conversation with every prompt.
+	var history []llm.Message
 	fmt.Println("Connected. Type a message and press Enter to send. Ctrl+C to quit.")
 
 	for {
@@ -30,31 +86,79 @@ func main() {
 			continue
 		}
 
-		body, _ := json.Marshal(chatRequest{Message: text})
-		resp, err := http.Post("http://localhost:8080/chat", "application/json", bytes.NewReader(body))
+		history = append(history, llm.Message{Role: llm.RoleUser, Content: text})
+		body, _ := json.Marshal(chatRequest{Messages: history})
+		sendTime := time.Now()
+		resp, err := post(client, body)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s", resp.Status)
+			resp.Body.Close()
+		}
 		if err != nil {
 			log.Printf("request failed: %v", err)
+			history = history[:len(history)-1]
 			continue
 		}
-
-		sendTime := time.Now()
 		var ttft time.Duration
 		tokenCount := 0
 		var lastTokenTime time.Time
 		var totalInterTokenTime time.Duration
+		var reply strings.Builder
+		var usage *message.UsageStats
 
-		sseScanner := bufio.NewScanner(resp.Body)
-		for sseScanner.Scan() {
-			line := sseScanner.Text()
-			if line == "" {
+		events := sse.NewReader(resp.Body)
+		var lastEventID string
+		retries := 0
+		goingAway := false
+	response:
+		for {
+			ev, err := events.Next()
+			if err != nil {
+				// The stream ended before "done": resume from the last
+				// event we saw.
+				resp.Body.Close()
+				if lastEventID == "" || retries == maxRetries {
+					log.Printf("\nresponse lost: %v", err)
+					break
+				}
+				retries++
+				fmt.Printf("\n[connection lost (%v), resuming after %s]\n", err, lastEventID)
+				time.Sleep(time.Duration(retries) * retryDelay)
+				if resp, err = resume(client, lastEventID); err != nil {
+					log.Printf("resume failed: %v", err)
+					break
+				}
+				events = sse.NewReader(resp.Body)
 				continue
 			}
-			if !strings.HasPrefix(line, "data: ") {
+			if ev.Event == sse.EventGoAway {
+				// Carries no ID; the response continues.
+				fmt.Printf("\n[server going away: %s]\n", ev.Data)
+				goingAway = true
 				continue
 			}
-			data := line[len("data: "):]
-			if data == "[DONE]" {
-				break
+			lastEventID, retries = ev.ID, 0
+			var token string
+			switch ev.Event {
+			case sse.EventToken:
+				if token, err = sse.ParseToken(ev.Data); err != nil {
+					log.Printf("\nbad token event: %v", err)
+					continue
+				}
+			case sse.EventDone:
+				break response
+			case sse.EventError:
+				fmt.Printf("\n[error: %s]", ev.Data)
+				continue
+			case sse.EventUsage:
+				usage = new(message.UsageStats)
+				if err := json.Unmarshal([]byte(ev.Data), usage); err != nil {
+					log.Printf("bad usage stats: %v", err)
+					usage = nil
+				}
+				continue
+			default:
+				continue
 			}
 
 			now := time.Now()
@@ -65,11 +169,18 @@ func main() {
 				totalInterTokenTime += now.Sub(lastTokenTime)
 			}
 			lastTokenTime = now
-			fmt.Print(data)
+			reply.WriteString(token)
+			fmt.Print(token)
 		}
 		resp.Body.Close()
 		fmt.Println()
 
+		if reply.Len() > 0 {
+			history = append(history, llm.Message{Role: llm.RoleAssistant, Content: reply.String()})
+		} else {
+			history = history[:len(history)-1]
+		}
+
 		if tokenCount > 0 {
 			var avgTBT time.Duration
 			if tokenCount > 1 {
@@ -77,5 +188,17 @@ func main() {
 			}
 			fmt.Printf("[TTFT: %s | tokens: %d | avg TBT: %s]\n", ttft, tokenCount, avgTBT)
 		}
+		if usage != nil {
+			fmt.Printf("[usage: %s]\n", usage)
+			// The API's token count, unlike tokenCount, doesn't depend
+			// on how tokens were split into messages.
+			if usage.CompletionTokens > 1 && totalInterTokenTime > 0 {
+				fmt.Printf("[received: %.1f tok/s]\n", float64(usage.CompletionTokens-1)/totalInterTokenTime.Seconds())
+			}
+		}
+		if goingAway {
+			fmt.Println("[server shut down]")
+			return
+		}
 	}
 }
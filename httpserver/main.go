@@ -1,34 +1,221 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"fmt"
+	"flag"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"llm-webtransport/auth"
+	"llm-webtransport/config"
+	"llm-webtransport/generation"
 	"llm-webtransport/llm"
+	"llm-webtransport/logging"
+	"llm-webtransport/message"
+	"llm-webtransport/metrics"
+	"llm-webtransport/origin"
+	"llm-webtransport/sse"
+	"llm-webtransport/tracing"
 )
 
+// chatRequest is the /chat body. Message is a single user turn; Messages
+// carries a full conversation (system, user and assistant turns). When both
+// are set, Message is appended to Messages as the final user turn. The
+// generation options (model, temperature, top_p, max_tokens, stop, seed)
+// sit alongside them; the model defaults to -model.
 type chatRequest struct {
-	Message string `json:"message"`
+	Message  string        `json:"message,omitempty"`
+	Messages []llm.Message `json:"messages,omitempty"`
+	llm.Options
 }
 
+var (
+	addr         = config.Addr("addr", ":8080", "TCP address to listen on")
+	metricsAddr  = config.Addr("metrics-addr", ":9091", "TCP address serving Prometheus metrics at /metrics over plain HTTP")
+	resumeWindow = flag.Duration("resume-window", 5*time.Second, "How long a generation keeps running after its client disconnected, waiting for it to reconnect with Last-Event-ID (0 cancels it at once)")
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "On SIGINT or SIGTERM, how long in-flight responses may take to finish before connections are closed")
+	llmConf      = config.LLMFlags()
+	tlsConf      = config.TLSFlags()
+	traceConf    = config.TracingFlags()
+	logConf      = config.LogFlags()
+	authConf     = config.AuthFlags()
+	originConf   = config.OriginFlags()
+)
+
+// provider is the LLM API selected by -llm, set up by main.
+var provider llm.Provider
+
+// authenticator checks clients' tokens, or is nil if authentication is off.
+var authenticator auth.Authenticator
+
+// origins are the origins whose pages may use /chat.
+var origins *origin.Policy
+
+// The methods and request headers browsers may use on /chat from another
+// origin.
+const (
+	corsMethods = "GET, POST"
+	corsHeaders = "Authorization, Content-Type, Last-Event-ID, traceparent"
+)
+
+// draining is done once the server starts shutting down.
+var draining, startDrain = context.WithCancel(context.Background())
+
+// handleChat starts a generation with POST, or resumes one with GET and a
+// Last-Event-ID header (or last_event_id query parameter). Pages from
+// allowed origins get CORS headers, even on errors, so that they can read
+// them.
 func handleChat(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	if !origins.Allowed(r) {
+		logging.FromContext(r.Context()).Warn("origin rejected", "origin", r.Header.Get("Origin"), "method", r.Method)
+		metrics.OriginRejections.With(metrics.SSE).Inc()
+		http.Error(w, "origin not allowed", http.StatusForbidden)
 		return
 	}
+	if origin.CORS(w, r, corsMethods, corsHeaders) {
+		return
+	}
+	if draining.Err() != nil {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ctx, span := tracing.Start(tracing.Extract(r.Context(), r.Header), r.Method+" /chat", tracing.Server)
+	defer span.End(nil)
+	l := logging.FromContext(ctx)
+	id, err := auth.Authenticate(authenticator, r)
+	if err != nil {
+		l.Warn("authentication failed", "err", err)
+		metrics.AuthFailures.With(metrics.SSE, auth.Reason(err)).Inc()
+		span.Set("auth.failure", auth.Reason(err))
+		auth.Unauthorized(w, err)
+		return
+	}
+	span.Set("identity", id.Name)
+	r = r.WithContext(logging.NewContext(ctx, l.With("identity", id.Name)))
+	switch r.Method {
+	case http.MethodPost:
+		startChat(w, r, id)
+	case http.MethodGet:
+		resumeChat(w, r, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
+func startChat(w http.ResponseWriter, r *http.Request, id auth.Identity) {
+	received := time.Now()
 	var req chatRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid JSON body", http.StatusBadRequest)
 		return
 	}
-	if req.Message == "" {
-		http.Error(w, "message is required", http.StatusBadRequest)
+	messages := req.Messages
+	if req.Message != "" {
+		messages = append(messages, llm.Message{Role: llm.RoleUser, Content: req.Message})
+	}
+	if len(messages) == 0 {
+		http.Error(w, "message or messages is required", http.StatusBadRequest)
+		return
+	}
+	if err := llm.ValidateMessages(messages); err != nil {
+		http.Error(w, "invalid messages: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := req.Options
+	if err := opts.Validate(); err != nil {
+		http.Error(w, "invalid options: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := provider.CheckOptions(opts); err != nil {
+		http.Error(w, "invalid options: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if opts.Model == "" {
+		opts.Model = llmConf.Model
+	}
+
+	inputBytes := 0
+	for _, m := range messages {
+		inputBytes += len(m.Content)
+	}
+	prompt := messages[len(messages)-1].Content
+
+	metrics.Requests.With(metrics.SSE, metrics.Model(opts.Model), metrics.Identity(id.Name)).Inc()
+	resp := responses.Start(messages, opts, "", id.Name)
+	r = withRequestLogger(r, resp.ID)
+	logging.FromContext(r.Context()).Info("request received", logging.Prompt(prompt), "input_bytes", inputBytes, "messages", len(messages), "model", opts.Model)
+	resp.Attach()
+	go generate(r.Context(), resp, inputBytes)
+	streamResponse(w, r, resp, 0, received)
+}
 
+func resumeChat(w http.ResponseWriter, r *http.Request, id auth.Identity) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID == "" {
+		http.Error(w, "Last-Event-ID is required", http.StatusBadRequest)
+		return
+	}
+	resp, from, err := lookup(lastEventID, id.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r = withRequestLogger(r, resp.ID)
+	logging.FromContext(r.Context()).Info("resuming response", "event", from)
+	resp.Attach()
+	streamResponse(w, r, resp, from, time.Time{})
+}
+
+// withRequestLogger returns r with a logger tagged with the response ID
+// and trace ID, added to its connection's logger.
+func withRequestLogger(r *http.Request, responseID string) *http.Request {
+	ctx := r.Context()
+	l := logging.WithTrace(ctx, logging.FromContext(ctx).With("request_id", responseID))
+	return r.WithContext(logging.NewContext(ctx, l))
+}
+
+// generate runs the LLM request for resp, buffering its events. It is
+// cancelled only when no client has been attached for -resume-window. Its
+// span is a child of the one in reqCtx, and its outcome is logged, in a
+// single record, by reqCtx's logger.
+func generate(reqCtx context.Context, resp *response, inputBytes int) {
+	stats, err := generation.Run(reqCtx, resp, provider, metrics.SSE, inputBytes, func(token string) {
+		appendEvent(resp, sse.EventToken, sse.TokenData(token))
+	})
+	usage := message.NewUsageStats(stats)
+	switch {
+	case stats.Cancelled:
+		appendEvent(resp, sse.EventError, "response abandoned")
+	case err != nil:
+		appendEvent(resp, sse.EventError, err.Error())
+	default:
+		data, _ := json.Marshal(usage)
+		appendEvent(resp, sse.EventUsage, string(data))
+	}
+	appendEvent(resp, sse.EventDone, "")
+	responses.Release(resp, usage, err)
+}
+
+// streamResponse writes resp's events from index from on, following the
+// generation live until it completes or the client goes away. received is
+// when the prompt arrived, for the TTFT metric, or zero for a resume. The
+// caller must have attached to resp.
+func streamResponse(w http.ResponseWriter, r *http.Request, resp *response, from int, received time.Time) {
+	defer resp.Detach(*resumeWindow)
+	l := logging.FromContext(r.Context())
+	metrics.ActiveStreams.With(metrics.SSE).Inc()
+	defer metrics.ActiveStreams.With(metrics.SSE).Dec()
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "streaming not supported", http.StatusInternalServerError)
@@ -39,34 +226,127 @@ func handleChat(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	inputBytes := len(req.Message)
-	log.Printf("received: %s (%d bytes)", req.Message, inputBytes)
-
-	stats, err := llm.StreamChatCompletion("http://127.0.0.1:11434", "gemma3:12b", req.Message, func(token string) error {
-		_, err := fmt.Fprintf(w, "data: %s\n\n", token)
-		if err != nil {
-			return err
+	timer := metrics.NewTokenTimer(metrics.SSE, resp.Opts.Model, received)
+	goAway := draining.Done()
+	for {
+		evs, changed, done := resp.Since(from)
+		tokens := false
+		for _, ev := range evs {
+			if err := sse.WriteEvent(w, ev); err != nil {
+				l.Info("client disconnected", "event", from, "err", err)
+				return
+			}
+			from++
+			tokens = tokens || ev.Event == sse.EventToken
 		}
 		flusher.Flush()
-		return nil
-	})
-	if err != nil {
-		log.Printf("llm error: %v", err)
-		fmt.Fprintf(w, "data: \n[error: %s]\n\n", err.Error())
-		flusher.Flush()
+		if tokens {
+			// The tokens of a batch reach the client together: one write.
+			timer.Written()
+		}
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-goAway:
+			// Once only; the response carries on until done.
+			goAway = nil
+			if err := sse.WriteEvent(w, sse.Event{Event: sse.EventGoAway, Data: "server shutting down"}); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			l.Info("client disconnected", "event", from, "err", r.Context().Err())
+			return
+		}
 	}
-
-	fmt.Fprint(w, "data: [DONE]\n\n")
-	flusher.Flush()
-
-	log.Printf("stats: input=%d bytes, from_llm=%d bytes, to_client=%d bytes, prompt_tokens=%d, completion_tokens=%d",
-		inputBytes, stats.BytesReceived, stats.BytesSent, stats.PromptTokens, stats.CompletionTokens)
 }
 
 func main() {
+	config.Parse()
+	var err error
+	if err := logging.Setup(os.Stderr, *logConf); err != nil {
+		log.Fatal(err)
+	}
+	provider, err = llmConf.Provider()
+	if err != nil {
+		logging.Fatal("invalid LLM settings", "err", err)
+	}
+	authenticator, err = authConf.Load()
+	if err != nil {
+		logging.Fatal("auth setup failed", "err", err)
+	}
+	origins, err = originConf.Policy()
+	if err != nil {
+		logging.Fatal("invalid origins", "err", err)
+	}
+	flushTraces, err := traceConf.Start("httpserver")
+	if err != nil {
+		logging.Fatal("tracing setup failed", "err", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := llm.CheckModel(ctx, provider, llmConf.Model); err != nil {
+		slog.Warn("model check failed", "err", err)
+	}
+	cancel()
+	metrics.SetModels(llmConf.Model)
+	metrics.SetIdentities(auth.Anonymous.Name)
+	metrics.SetIdentities(auth.Names(authenticator)...)
+
+	tlsCert, err := tlsConf.Load()
+	if err != nil {
+		logging.Fatal("TLS setup failed", "err", err)
+	}
+	srv := &http.Server{
+		Addr:      *addr,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{tlsCert}},
+		// Each connection gets a logger with its own ID.
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return logging.NewContext(ctx, slog.With("conn_id", logging.NewID(), "remote", c.RemoteAddr().String()))
+		},
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				metrics.ActiveSessions.With(metrics.SSE).Inc()
+			case http.StateHijacked, http.StateClosed:
+				metrics.ActiveSessions.With(metrics.SSE).Dec()
+			}
+		},
+	}
 	http.HandleFunc("/chat", handleChat)
-	log.Println("HTTP SSE server listening on :8080 (TLS)")
-	if err := http.ListenAndServeTLS(":8080", "certs/cert.pem", "certs/key.pem", nil); err != nil {
-		log.Fatalf("server error: %v", err)
+
+	go func() {
+		// Metrics stay off the public listener, which serves browsers.
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		slog.Info("metrics listening", "addr", *metricsAddr)
+		if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+			logging.Fatal("metrics server failed", "err", err)
+		}
+	}()
+
+	sig, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		slog.Info("HTTP SSE server listening", "addr", *addr, "tls", true)
+		if err := srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			logging.Fatal("server failed", "err", err)
+		}
+	}()
+
+	<-sig.Done()
+	stop() // a second signal kills the server at once
+	slog.Info("shutting down", "drain_timeout", *drainTimeout)
+	startDrain()
+	ctx, cancel = context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("drain deadline passed", "err", err)
+		srv.Close()
+	} else {
+		slog.Info("all responses drained")
 	}
+	flushTraces()
+	slog.Info("server stopped")
 }
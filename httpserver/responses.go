@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"llm-webtransport/generation"
+	"llm-webtransport/sse"
+)
+
+// response is a generation's buffered events. Event IDs are
+// "<response id>:<seq>".
+type response = generation.Response[sse.Event]
+
+// responses buffers generations so that clients can resume them.
+var responses = generation.NewStore[sse.Event]()
+
+// appendEvent adds an event to resp, assigning it the next ID. Only the
+// generation appends, so no two events get the same one.
+func appendEvent(resp *response, event, data string) {
+	resp.Append(sse.Event{ID: resp.ID + ":" + strconv.Itoa(resp.Len()), Event: event, Data: data})
+}
+
+// lookup resolves a Last-Event-ID to identity's response and the index of
+// the first event the client has not seen. Other clients' responses are
+// unknown.
+func lookup(lastEventID, identity string) (*response, int, error) {
+	id, seq, ok := strings.Cut(lastEventID, ":")
+	n, err := strconv.Atoi(seq)
+	if !ok || err != nil || n < 0 {
+		return nil, 0, fmt.Errorf("malformed event ID %q", lastEventID)
+	}
+	r, err := responses.Lookup(id, identity)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n >= r.Len() {
+		return nil, 0, fmt.Errorf("event ID %q is ahead of the response", lastEventID)
+	}
+	return r, n + 1, nil
+}
@@ -0,0 +1,181 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"llm-webtransport/sse"
+)
+
+// anthropicVersion is the Messages API version requested.
+const anthropicVersion = "2023-06-01"
+
+// Anthropic is the Anthropic Messages API.
+type Anthropic struct {
+	BaseURL   string
+	APIKey    string
+	MaxTokens int          // default for requests that set none; 0 means 4096
+	Client    *http.Client // nil for http.DefaultClient
+}
+
+type anthropicRequest struct {
+	Model         string    `json:"model"`
+	System        string    `json:"system,omitempty"`
+	Messages      []Message `json:"messages"`
+	MaxTokens     int       `json:"max_tokens"`
+	Stream        bool      `json:"stream"`
+	Temperature   *float64  `json:"temperature,omitempty"`
+	TopP          *float64  `json:"top_p,omitempty"`
+	StopSequences []string  `json:"stop_sequences,omitempty"`
+}
+
+// anthropicEvent is the data of any streamed event; each event type
+// fills in a subset of the fields.
+type anthropicEvent struct {
+	Message struct {
+		Model string         `json:"model"`
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"` // message_start
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"` // message_delta
+	} `json:"delta"` // content_block_delta
+	Usage anthropicUsage `json:"usage"` // message_delta
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"` // error
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func (p *Anthropic) header() http.Header {
+	h := make(http.Header)
+	h.Set("x-api-key", p.APIKey)
+	h.Set("anthropic-version", anthropicVersion)
+	return h
+}
+
+// StreamChat implements Provider using /v1/messages. Leading system
+// messages are joined into the request's system prompt.
+func (p *Anthropic) StreamChat(ctx context.Context, messages []Message, opts Options, onToken func(token string) error) (Stats, error) {
+	var stats Stats
+	if err := p.CheckOptions(opts); err != nil {
+		return stats, err
+	}
+	req := anthropicRequest{
+		Model:         opts.Model,
+		MaxTokens:     opts.MaxTokens,
+		Stream:        true,
+		Temperature:   opts.Temperature,
+		TopP:          opts.TopP,
+		StopSequences: opts.Stop,
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = p.MaxTokens
+	}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = 4096
+	}
+	var system []string
+	for len(messages) > 0 && messages[0].Role == RoleSystem {
+		system = append(system, messages[0].Content)
+		messages = messages[1:]
+	}
+	req.System = strings.Join(system, "\n\n")
+	req.Messages = messages
+
+	start := time.Now()
+	resp, err := do(ctx, p.Client, http.MethodPost, p.BaseURL+"/v1/messages", p.header(), req)
+	if err != nil {
+		return fail(ctx, stats, err)
+	}
+	defer resp.Body.Close()
+
+	events := sse.NewReader(resp.Body)
+	for {
+		ev, err := events.Next()
+		if err == io.EOF {
+			return fail(ctx, stats, io.ErrUnexpectedEOF) // no message_stop
+		}
+		if err != nil {
+			return fail(ctx, stats, err)
+		}
+
+		var data anthropicEvent
+		if err := json.Unmarshal([]byte(ev.Data), &data); err != nil {
+			continue
+		}
+		switch ev.Event {
+		case "message_start":
+			stats.Model = data.Message.Model
+			stats.PromptTokens = data.Message.Usage.InputTokens
+		case "content_block_delta":
+			if data.Delta.Type != "text_delta" || data.Delta.Text == "" {
+				continue
+			}
+			stats.BytesReceived += len("data: ") + len(ev.Data) + 1 // count only content-bearing lines
+			if err := emit(&stats, start, data.Delta.Text, onToken); err != nil {
+				return fail(ctx, stats, err)
+			}
+		case "message_delta":
+			stats.CompletionTokens = data.Usage.OutputTokens
+			stats.FinishReason = anthropicFinishReason(data.Delta.StopReason)
+		case "message_stop":
+			return stats, nil
+		case "error":
+			return fail(ctx, stats, errors.New(data.Error.Type+": "+data.Error.Message))
+		}
+	}
+}
+
+// CheckOptions implements Provider. The API's temperature range is [0, 1]
+// rather than OpenAI's [0, 2], and it has no seed.
+func (p *Anthropic) CheckOptions(opts Options) error {
+	if opts.Temperature != nil && *opts.Temperature > 1 {
+		return fmt.Errorf("temperature %v out of range [0, 1] for Anthropic", *opts.Temperature)
+	}
+	if opts.Seed != nil {
+		return errors.New("seed is not supported by Anthropic")
+	}
+	return nil
+}
+
+// anthropicFinishReason maps a stop reason to the OpenAI finish reasons
+// the other providers report.
+func anthropicFinishReason(stop string) string {
+	switch stop {
+	case "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	}
+	return stop
+}
+
+// ListModels implements Provider using /v1/models.
+func (p *Anthropic) ListModels(ctx context.Context) ([]string, error) {
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := getJSON(ctx, p.Client, p.BaseURL+"/v1/models", p.header(), &list); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range list.Data {
+		names = append(names, m.ID)
+	}
+	return names, nil
+}
@@ -0,0 +1,89 @@
+package llm
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var anthropicStream = []string{
+	"event: message_start\ndata: " + `{"type":"message_start","message":{"model":"claude-x","usage":{"input_tokens":5,"output_tokens":1}}}` + "\n\n",
+	"event: content_block_start\ndata: " + `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n",
+	"event: ping\ndata: " + `{"type":"ping"}` + "\n\n",
+	"event: content_block_delta\ndata: " + `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}` + "\n\n",
+	"event: content_block_delta\ndata: " + `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"lo"}}` + "\n\n",
+	"event: content_block_stop\ndata: " + `{"type":"content_block_stop","index":0}` + "\n\n",
+	"event: message_delta\ndata: " + `{"type":"message_delta","delta":{"stop_reason":"max_tokens"},"usage":{"output_tokens":2}}` + "\n\n",
+	"event: message_stop\ndata: " + `{"type":"message_stop"}` + "\n\n",
+}
+
+func TestAnthropicStream(t *testing.T) {
+	s := serve(t, "/v1/messages", anthropicStream, false)
+	tokens, stats, err := collect(context.Background(), &Anthropic{BaseURL: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tokens, []string{"Hel", "lo"}) {
+		t.Errorf("tokens = %q", tokens)
+	}
+	if stats.Model != "claude-x" || stats.FinishReason != "length" || stats.PromptTokens != 5 || stats.CompletionTokens != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestAnthropicError(t *testing.T) {
+	overloaded := "event: error\ndata: " + `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}` + "\n\n"
+	s := serve(t, "/v1/messages", []string{anthropicStream[0], anthropicStream[3], overloaded}, false)
+	tokens, _, err := collect(context.Background(), &Anthropic{BaseURL: s.URL})
+	if err == nil || err.Error() != "overloaded_error: Overloaded" {
+		t.Errorf("err = %v", err)
+	}
+	if len(tokens) != 1 {
+		t.Errorf("tokens = %q", tokens)
+	}
+
+	s = failing(t, 401, `{"type":"error","error":{"type":"authentication_error"}}`)
+	_, _, err = collect(context.Background(), &Anthropic{BaseURL: s.URL})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestAnthropicCancel(t *testing.T) {
+	s := serve(t, "/v1/messages", anthropicStream[:4], true)
+	testCancel(t, &Anthropic{BaseURL: s.URL})
+	testCallbackError(t, &Anthropic{BaseURL: s.URL})
+}
+
+func TestAnthropicCheckOptions(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	seed := int64(7)
+	tests := []struct {
+		name string
+		opts Options
+		ok   bool
+	}{
+		{"none", Options{}, true},
+		{"temperature 1", Options{Temperature: f(1)}, true},
+		{"temperature 1.5", Options{Temperature: f(1.5)}, false},
+		{"seed", Options{Seed: &seed}, false},
+	}
+	s := failing(t, 500, "must not be called")
+	p := &Anthropic{BaseURL: s.URL}
+	for _, tt := range tests {
+		if err := p.CheckOptions(tt.opts); (err == nil) != tt.ok {
+			t.Errorf("%s: CheckOptions() = %v", tt.name, err)
+		}
+	}
+	// StreamChat refuses them too, before sending anything.
+	_, err := p.StreamChat(context.Background(), testMessages, Options{Model: "m", Seed: &seed}, func(string) error { return nil })
+	if err == nil || strings.Contains(err.Error(), "500") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestAnthropicTruncated(t *testing.T) {
+	s := serve(t, "/v1/messages", anthropicStream[:7], false)
+	testTruncated(t, &Anthropic{BaseURL: s.URL})
+}
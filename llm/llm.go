@@ -1,102 +1,297 @@
+// Package llm streams chat completions from LLM APIs. Provider abstracts
+// over the wire format; OpenAI, Ollama and Anthropic implement it.
 package llm
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"llm-webtransport/logging"
+	"llm-webtransport/tracing"
 )
 
-type chatRequest struct {
-	Model    string        `json:"model"`
-	Messages []chatMessage `json:"messages"`
-	Stream   bool          `json:"stream"`
-}
+// Message roles accepted by the chat API.
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
 
-type chatMessage struct {
+// Message is one turn of a conversation.
+type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
 }
 
-type chatChunk struct {
-	Choices []struct {
-		Delta struct {
-			Content string `json:"content"`
-		} `json:"delta"`
-	} `json:"choices"`
-	Usage *chatUsage `json:"usage,omitempty"`
+// ValidateMessages checks that msgs is a well-formed conversation: at least
+// one message, only known roles, no empty content, system messages only at
+// the start, and ending with a user turn.
+func ValidateMessages(msgs []Message) error {
+	if len(msgs) == 0 {
+		return errors.New("messages is empty")
+	}
+	for i, m := range msgs {
+		switch m.Role {
+		case RoleSystem:
+			if i > 0 && msgs[i-1].Role != RoleSystem {
+				return fmt.Errorf("message %d: system messages must come first", i)
+			}
+		case RoleUser, RoleAssistant:
+		default:
+			return fmt.Errorf("message %d: unknown role %q", i, m.Role)
+		}
+		if m.Content == "" {
+			return fmt.Errorf("message %d: content is empty", i)
+		}
+	}
+	if msgs[len(msgs)-1].Role != RoleUser {
+		return errors.New("last message must have role user")
+	}
+	return nil
+}
+
+// Options are the generation parameters of a request. Unset fields leave
+// the API's defaults; Model is required by StreamChat.
+type Options struct {
+	Model       string   `json:"model,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"` // cap on the reply length
+	Stop        []string `json:"stop,omitempty"`       // sequences that end the reply
+	Seed        *int64   `json:"seed,omitempty"`       // for reproducible sampling, where supported
 }
 
-type chatUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
+// Validate checks that the options are in range.
+func (o Options) Validate() error {
+	if o.Temperature != nil && (*o.Temperature < 0 || *o.Temperature > 2) {
+		return fmt.Errorf("temperature %v out of range [0, 2]", *o.Temperature)
+	}
+	if o.TopP != nil && (*o.TopP <= 0 || *o.TopP > 1) {
+		return fmt.Errorf("top_p %v out of range (0, 1]", *o.TopP)
+	}
+	if o.MaxTokens < 0 {
+		return fmt.Errorf("max_tokens %d is negative", o.MaxTokens)
+	}
+	for _, s := range o.Stop {
+		if s == "" {
+			return errors.New("stop sequence is empty")
+		}
+	}
+	return nil
 }
 
+// Stats describes one streamed response.
 type Stats struct {
 	BytesReceived    int // total content bytes received from LLM (excluding reasoning)
 	BytesSent        int // total content bytes sent to client
 	PromptTokens     int
 	CompletionTokens int
+	Model            string // as reported by the API
+	FinishReason     string // "stop" or "length", or the API's own reason
+	Cancelled        bool   // ctx ended before the response completed
+
+	// Measured by StreamChat.
+	FirstToken time.Duration // from sending the request to the first token
+	Generation time.Duration // from the first token to the last
+
+	// Server-side timings, for APIs that report them (Ollama's native API).
+	LoadDuration       time.Duration // loading the model
+	PromptEvalDuration time.Duration // processing the prompt
+	EvalDuration       time.Duration // generating the reply
+	TotalDuration      time.Duration
 }
 
-// StreamChatCompletion sends a message to the OpenAI-compatible API and calls
-// onToken for each streamed token. It returns stats and any error.
-func StreamChatCompletion(baseURL, model, userMessage string, onToken func(token string) error) (Stats, error) {
-	var stats Stats
+// EvalRate returns the generation speed in tokens per second: from the
+// server's timing if it reported one, otherwise from Generation. It is 0
+// if the API reported no token count.
+func (s Stats) EvalRate() float64 {
+	switch {
+	case s.EvalDuration > 0:
+		return float64(s.CompletionTokens) / s.EvalDuration.Seconds()
+	case s.Generation > 0 && s.CompletionTokens > 1:
+		// Generation starts with the first token.
+		return float64(s.CompletionTokens-1) / s.Generation.Seconds()
+	}
+	return 0
+}
 
-	reqBody := chatRequest{
-		Model: model,
-		Messages: []chatMessage{
-			{Role: "user", Content: userMessage},
-		},
-		Stream: true,
+// LogValue implements slog.LogValuer, logging the stats as flat attributes;
+// the server-side timings are included if the API reported them.
+func (s Stats) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Int("from_llm_bytes", s.BytesReceived),
+		slog.Int("to_client_bytes", s.BytesSent),
+		slog.Int("prompt_tokens", s.PromptTokens),
+		slog.Int("completion_tokens", s.CompletionTokens),
+		slog.String("model", s.Model),
+		slog.String("finish", s.FinishReason),
+		slog.Bool("cancelled", s.Cancelled),
 	}
-	body, err := json.Marshal(reqBody)
-	if err != nil {
-		return stats, fmt.Errorf("marshal request: %w", err)
+	if s.BytesSent > 0 {
+		attrs = append(attrs,
+			slog.Duration("first_token", s.FirstToken),
+			slog.Duration("generation", s.Generation),
+			slog.Float64("tok_per_s", math.Round(s.EvalRate()*10)/10))
+	}
+	if s.EvalDuration > 0 {
+		attrs = append(attrs,
+			slog.Duration("load", s.LoadDuration),
+			slog.Duration("prompt_eval", s.PromptEvalDuration),
+			slog.Duration("eval", s.EvalDuration),
+			slog.Duration("total", s.TotalDuration))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Provider is an LLM API that streams chat completions.
+type Provider interface {
+	// StreamChat sends a conversation with the given options and calls
+	// onToken for each streamed token of the assistant's reply. It returns
+	// stats, including the token usage reported by the API, and any error.
+	// Cancelling ctx aborts the upstream request, which stops generation;
+	// the returned error is then ctx.Err() and stats.Cancelled is set. A
+	// stream that ends without the API's end marker is io.ErrUnexpectedEOF;
+	// a complete one is a success even if ctx has ended since.
+	StreamChat(ctx context.Context, messages []Message, opts Options, onToken func(token string) error) (Stats, error)
+	// CheckOptions reports an error for valid options the API can't
+	// honour, such as a parameter it lacks or a narrower range.
+	CheckOptions(opts Options) error
+	// ListModels returns the names of the models the API serves.
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// Provider kinds accepted by NewProvider.
+const (
+	KindOpenAI    = "openai"    // OpenAI-compatible /v1/chat/completions, e.g. Ollama's
+	KindOllama    = "ollama"    // Ollama's native /api/chat
+	KindAnthropic = "anthropic" // Anthropic Messages API
+)
+
+// Default base URLs, used when NewProvider is given none.
+const (
+	DefaultOllamaURL    = "http://127.0.0.1:11434"
+	DefaultAnthropicURL = "https://api.anthropic.com"
+)
+
+// NewProvider returns the provider of the given kind. An empty baseURL
+// selects the local Ollama server, or Anthropic's API for KindAnthropic.
+// apiKey may be empty for servers that need none.
+func NewProvider(kind, baseURL, apiKey string) (Provider, error) {
+	switch kind {
+	case KindOpenAI:
+		return &OpenAI{BaseURL: or(baseURL, DefaultOllamaURL), APIKey: apiKey}, nil
+	case KindOllama:
+		return &Ollama{BaseURL: or(baseURL, DefaultOllamaURL)}, nil
+	case KindAnthropic:
+		return &Anthropic{BaseURL: or(baseURL, DefaultAnthropicURL), APIKey: apiKey}, nil
 	}
+	return nil, fmt.Errorf("unknown LLM provider %q (want %s, %s or %s)", kind, KindOpenAI, KindOllama, KindAnthropic)
+}
 
-	resp, err := http.Post(baseURL+"/v1/chat/completions", "application/json", bytes.NewReader(body))
+// CheckModel reports an error if p does not list model.
+func CheckModel(ctx context.Context, p Provider, model string) error {
+	models, err := p.ListModels(ctx)
 	if err != nil {
-		return stats, fmt.Errorf("request failed: %w", err)
+		return fmt.Errorf("list models: %w", err)
 	}
-	defer resp.Body.Close()
+	if !slices.Contains(models, model) {
+		return fmt.Errorf("model %q is not available (have %s)", model, strings.Join(models, ", "))
+	}
+	return nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(resp.Body)
-		return stats, fmt.Errorf("API error %d: %s", resp.StatusCode, b)
+func or(s, def string) string {
+	if s == "" {
+		return def
 	}
+	return s
+}
 
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" || line == "data: [DONE]" {
-			continue
+// do sends a request with a JSON body (or none if body is nil) and returns
+// the response for a 200 status; any other status becomes an error
+// carrying the response body.
+func do(ctx context.Context, client *http.Client, method, url string, header http.Header, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("marshal request: %w", err)
 		}
-		const prefix = "data: "
-		if len(line) <= len(prefix) {
-			continue
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	tracing.Inject(ctx, req.Header)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		logging.FromContext(ctx).Debug("llm request failed", "method", method, "url", url, "err", err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		data := line[len(prefix):]
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	logging.FromContext(ctx).Debug("llm request", "method", method, "url", url, "status", resp.StatusCode, "header_time", time.Since(start))
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, b)
+	}
+	return resp, nil
+}
 
-		var chunk chatChunk
-		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
-			continue
-		}
-		if chunk.Usage != nil {
-			stats.PromptTokens = chunk.Usage.PromptTokens
-			stats.CompletionTokens = chunk.Usage.CompletionTokens
-		}
-		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
-			token := chunk.Choices[0].Delta.Content
-			stats.BytesReceived += len(line) + 1 // count only content-bearing lines
-			stats.BytesSent += len(token)
-			if err := onToken(token); err != nil {
-				return stats, err
-			}
-		}
+// getJSON fetches url and decodes the JSON response into v.
+func getJSON(ctx context.Context, client *http.Client, url string, header http.Header, v any) error {
+	resp, err := do(ctx, client, http.MethodGet, url, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// emit passes a token to onToken, counting it and timing it against the
+// request's start. Tokens are never empty.
+func emit(stats *Stats, start time.Time, token string, onToken func(string) error) error {
+	elapsed := time.Since(start)
+	if stats.BytesSent == 0 {
+		stats.FirstToken = elapsed
+	}
+	stats.Generation = elapsed - stats.FirstToken
+	stats.BytesSent += len(token)
+	return onToken(token)
+}
+
+// fail returns err, or ctx.Err() with stats.Cancelled set if ctx has ended,
+// since errors after cancellation are a consequence of it.
+func fail(ctx context.Context, stats Stats, err error) (Stats, error) {
+	if ctx.Err() != nil {
+		stats.Cancelled = true
+		return stats, ctx.Err()
 	}
-	return stats, scanner.Err()
+	return stats, err
 }
@@ -0,0 +1,121 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// serve answers requests to path with the chunks, flushing each, as an
+// LLM API streams them. If hang is set it then waits for the client to go
+// away instead of ending the response.
+func serve(t *testing.T, path string, chunks []string, hang bool) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		for _, c := range chunks {
+			w.Write([]byte(c))
+			w.(http.Flusher).Flush()
+		}
+		if hang {
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// failing answers every request with status and body.
+func failing(t *testing.T, status int, body string) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, body, status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// testTruncated checks that a stream cut off before its end marker is an
+// error rather than a short success, whatever tokens it carried.
+func testTruncated(t *testing.T, p Provider) {
+	t.Helper()
+	tokens, stats, err := collect(context.Background(), p)
+	if err != io.ErrUnexpectedEOF || stats.Cancelled {
+		t.Errorf("err = %v, cancelled = %v; want io.ErrUnexpectedEOF", err, stats.Cancelled)
+	}
+	if len(tokens) == 0 {
+		t.Error("no tokens before the cut")
+	}
+}
+
+var testMessages = []Message{{Role: RoleUser, Content: "Hi"}}
+
+// collect streams a reply from p and returns its tokens.
+func collect(ctx context.Context, p Provider) ([]string, Stats, error) {
+	var tokens []string
+	stats, err := p.StreamChat(ctx, testMessages, Options{Model: "m"}, func(token string) error {
+		tokens = append(tokens, token)
+		return nil
+	})
+	return tokens, stats, err
+}
+
+// testCancel checks that cancelling the context after the first token of
+// a response that never ends aborts it.
+func testCancel(t *testing.T, p Provider) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var tokens []string
+	stats, err := p.StreamChat(ctx, testMessages, Options{Model: "m"}, func(token string) error {
+		tokens = append(tokens, token)
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || !stats.Cancelled {
+		t.Errorf("err = %v, cancelled = %v; want context.Canceled and cancelled", err, stats.Cancelled)
+	}
+	if !slices.Equal(tokens, []string{"Hel"}) {
+		t.Errorf("tokens = %q, want [Hel]", tokens)
+	}
+}
+
+// testCallbackError checks that an error from onToken ends the stream and
+// is returned as is.
+func testCallbackError(t *testing.T, p Provider) {
+	t.Helper()
+	errStop := errors.New("client gone")
+	_, err := p.StreamChat(context.Background(), testMessages, Options{Model: "m"}, func(string) error { return errStop })
+	if err != errStop {
+		t.Errorf("err = %v, want %v", err, errStop)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name string
+		opts Options
+		ok   bool
+	}{
+		{"empty", Options{}, true},
+		{"all set", Options{Temperature: f(2), TopP: f(1), MaxTokens: 10, Stop: []string{"\n"}}, true},
+		{"temperature", Options{Temperature: f(2.1)}, false},
+		{"negative temperature", Options{Temperature: f(-0.1)}, false},
+		{"top_p zero", Options{TopP: f(0)}, false},
+		{"max_tokens", Options{MaxTokens: -1}, false},
+		{"empty stop", Options{Stop: []string{""}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Ollama is Ollama's native chat API, which streams newline-delimited JSON
+// objects rather than OpenAI-style server-sent events. Its final object
+// carries token counts and server-side timings, which StreamChat returns
+// in Stats.
+type Ollama struct {
+	BaseURL string
+	Client  *http.Client // nil for http.DefaultClient
+}
+
+type ollamaRequest struct {
+	Model    string        `json:"model"`
+	Messages []Message     `json:"messages"`
+	Stream   bool          `json:"stream"`
+	Options  ollamaOptions `json:"options"`
+}
+
+// ollamaOptions are the model parameters of a request.
+type ollamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+}
+
+type ollamaChunk struct {
+	Model   string `json:"model"`
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done               bool          `json:"done"`
+	DoneReason         string        `json:"done_reason"`
+	PromptEvalCount    int           `json:"prompt_eval_count"`
+	EvalCount          int           `json:"eval_count"`
+	LoadDuration       time.Duration `json:"load_duration"` // nanoseconds
+	PromptEvalDuration time.Duration `json:"prompt_eval_duration"`
+	EvalDuration       time.Duration `json:"eval_duration"`
+	TotalDuration      time.Duration `json:"total_duration"`
+	Error              string        `json:"error"`
+}
+
+// StreamChat implements Provider using /api/chat.
+func (p *Ollama) StreamChat(ctx context.Context, messages []Message, opts Options, onToken func(token string) error) (Stats, error) {
+	var stats Stats
+	start := time.Now()
+	resp, err := do(ctx, p.Client, http.MethodPost, p.BaseURL+"/api/chat", nil, ollamaRequest{
+		Model:    opts.Model,
+		Messages: messages,
+		Stream:   true,
+		Options: ollamaOptions{
+			Temperature: opts.Temperature,
+			TopP:        opts.TopP,
+			NumPredict:  opts.MaxTokens,
+			Stop:        opts.Stop,
+			Seed:        opts.Seed,
+		},
+	})
+	if err != nil {
+		return fail(ctx, stats, err)
+	}
+	defer resp.Body.Close()
+
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+			return fail(ctx, stats, io.ErrUnexpectedEOF) // no done chunk
+		}
+		if err != nil && err != io.EOF {
+			return fail(ctx, stats, err)
+		}
+
+		var chunk ollamaChunk
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			continue
+		}
+		if chunk.Error != "" {
+			return fail(ctx, stats, errors.New(chunk.Error))
+		}
+		if chunk.Message.Content != "" {
+			stats.BytesReceived += len(line) // count only content-bearing lines
+			if err := emit(&stats, start, chunk.Message.Content, onToken); err != nil {
+				return fail(ctx, stats, err)
+			}
+		}
+		if chunk.Done {
+			stats.Model = chunk.Model
+			stats.FinishReason = chunk.DoneReason
+			stats.PromptTokens = chunk.PromptEvalCount
+			stats.CompletionTokens = chunk.EvalCount
+			stats.LoadDuration = chunk.LoadDuration
+			stats.PromptEvalDuration = chunk.PromptEvalDuration
+			stats.EvalDuration = chunk.EvalDuration
+			stats.TotalDuration = chunk.TotalDuration
+			return stats, nil
+		}
+	}
+}
+
+// CheckOptions implements Provider. The API takes every option.
+func (p *Ollama) CheckOptions(opts Options) error { return nil }
+
+// ListModels implements Provider using /api/tags.
+func (p *Ollama) ListModels(ctx context.Context) ([]string, error) {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := getJSON(ctx, p.Client, p.BaseURL+"/api/tags", nil, &tags); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range tags.Models {
+		names = append(names, m.Name)
+	}
+	return names, nil
+}
@@ -0,0 +1,61 @@
+package llm
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ollamaStream = []string{
+	`{"model":"m-1","message":{"role":"assistant","content":"Hel"},"done":false}` + "\n",
+	`{"model":"m-1","message":{"role":"assistant","content":"lo"},"done":false}` + "\n",
+	`{"model":"m-1","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop",` +
+		`"prompt_eval_count":5,"eval_count":2,"load_duration":1000,"prompt_eval_duration":2000,"eval_duration":4000000,"total_duration":5000000}`,
+}
+
+func TestOllamaStream(t *testing.T) {
+	s := serve(t, "/api/chat", ollamaStream, false)
+	tokens, stats, err := collect(context.Background(), &Ollama{BaseURL: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tokens, []string{"Hel", "lo"}) {
+		t.Errorf("tokens = %q", tokens)
+	}
+	if stats.Model != "m-1" || stats.FinishReason != "stop" || stats.PromptTokens != 5 || stats.CompletionTokens != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats.EvalDuration != 4*time.Millisecond || stats.TotalDuration != 5*time.Millisecond || stats.EvalRate() != 500 {
+		t.Errorf("timings = %+v, rate %v", stats, stats.EvalRate())
+	}
+}
+
+func TestOllamaError(t *testing.T) {
+	s := serve(t, "/api/chat", []string{ollamaStream[0], `{"error":"out of memory"}` + "\n"}, false)
+	tokens, _, err := collect(context.Background(), &Ollama{BaseURL: s.URL})
+	if err == nil || err.Error() != "out of memory" {
+		t.Errorf("err = %v", err)
+	}
+	if len(tokens) != 1 {
+		t.Errorf("tokens = %q", tokens)
+	}
+
+	s = failing(t, 500, "model failed to load")
+	_, _, err = collect(context.Background(), &Ollama{BaseURL: s.URL})
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestOllamaCancel(t *testing.T) {
+	s := serve(t, "/api/chat", ollamaStream[:1], true)
+	testCancel(t, &Ollama{BaseURL: s.URL})
+	testCallbackError(t, &Ollama{BaseURL: s.URL})
+}
+
+func TestOllamaTruncated(t *testing.T) {
+	s := serve(t, "/api/chat", ollamaStream[:2], false)
+	testTruncated(t, &Ollama{BaseURL: s.URL})
+}
@@ -0,0 +1,140 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"llm-webtransport/sse"
+)
+
+// OpenAI is an OpenAI-compatible chat completions API, such as the one
+// Ollama serves under /v1.
+type OpenAI struct {
+	BaseURL string       // without the /v1 suffix
+	APIKey  string       // sent as a bearer token if set
+	Client  *http.Client // nil for http.DefaultClient
+}
+
+type chatRequest struct {
+	Model         string         `json:"model"`
+	Messages      []Message      `json:"messages"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+	Temperature   *float64       `json:"temperature,omitempty"`
+	TopP          *float64       `json:"top_p,omitempty"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	Stop          []string       `json:"stop,omitempty"`
+	Seed          *int64         `json:"seed,omitempty"`
+}
+
+// streamOptions asks for a final chunk carrying token usage, which is
+// otherwise omitted from streamed responses.
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type chatChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *chatUsage `json:"usage,omitempty"`
+}
+
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+func (p *OpenAI) header() http.Header {
+	h := make(http.Header)
+	if p.APIKey != "" {
+		h.Set("Authorization", "Bearer "+p.APIKey)
+	}
+	return h
+}
+
+// StreamChat implements Provider using /v1/chat/completions.
+func (p *OpenAI) StreamChat(ctx context.Context, messages []Message, opts Options, onToken func(token string) error) (Stats, error) {
+	var stats Stats
+	start := time.Now()
+	resp, err := do(ctx, p.Client, http.MethodPost, p.BaseURL+"/v1/chat/completions", p.header(), chatRequest{
+		Model:         opts.Model,
+		Messages:      messages,
+		Stream:        true,
+		StreamOptions: &streamOptions{IncludeUsage: true},
+		Temperature:   opts.Temperature,
+		TopP:          opts.TopP,
+		MaxTokens:     opts.MaxTokens,
+		Stop:          opts.Stop,
+		Seed:          opts.Seed,
+	})
+	if err != nil {
+		return fail(ctx, stats, err)
+	}
+	defer resp.Body.Close()
+
+	events := sse.NewReader(resp.Body)
+	for {
+		ev, err := events.Next()
+		if err == io.EOF {
+			return fail(ctx, stats, io.ErrUnexpectedEOF) // no [DONE]
+		}
+		if err != nil {
+			return fail(ctx, stats, err)
+		}
+		if ev.Data == "[DONE]" {
+			return stats, nil
+		}
+
+		var chunk chatChunk
+		if err := json.Unmarshal([]byte(ev.Data), &chunk); err != nil {
+			continue
+		}
+		if chunk.Model != "" {
+			stats.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			stats.PromptTokens = chunk.Usage.PromptTokens
+			stats.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if fr := chunk.Choices[0].FinishReason; fr != nil {
+			stats.FinishReason = *fr
+		}
+		if chunk.Choices[0].Delta.Content != "" {
+			stats.BytesReceived += len("data: ") + len(ev.Data) + 1 // count only content-bearing lines
+			if err := emit(&stats, start, chunk.Choices[0].Delta.Content, onToken); err != nil {
+				return fail(ctx, stats, err)
+			}
+		}
+	}
+}
+
+// CheckOptions implements Provider. The API takes every option.
+func (p *OpenAI) CheckOptions(opts Options) error { return nil }
+
+// ListModels implements Provider using /v1/models.
+func (p *OpenAI) ListModels(ctx context.Context) ([]string, error) {
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := getJSON(ctx, p.Client, p.BaseURL+"/v1/models", p.header(), &list); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range list.Data {
+		names = append(names, m.ID)
+	}
+	return names, nil
+}
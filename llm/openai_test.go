@@ -0,0 +1,54 @@
+package llm
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var openAIStream = []string{
+	`data: {"model":"m-1","choices":[{"delta":{"role":"assistant","content":""}}]}` + "\n\n",
+	`data: {"model":"m-1","choices":[{"delta":{"content":"Hel"}}]}` + "\n\n",
+	`data: {"model":"m-1","choices":[{"delta":{"content":"lo"},"finish_reason":null}]}` + "\n\n",
+	": keepalive\n\n",
+	`data: {"model":"m-1","choices":[{"delta":{},"finish_reason":"length"}]}` + "\n\n",
+	`data: {"model":"m-1","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":2}}` + "\n\n",
+	"data: [DONE]\n\n",
+}
+
+func TestOpenAIStream(t *testing.T) {
+	s := serve(t, "/v1/chat/completions", openAIStream, false)
+	tokens, stats, err := collect(context.Background(), &OpenAI{BaseURL: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tokens, []string{"Hel", "lo"}) {
+		t.Errorf("tokens = %q", tokens)
+	}
+	if stats.Model != "m-1" || stats.FinishReason != "length" || stats.PromptTokens != 5 || stats.CompletionTokens != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats.BytesSent != 5 || stats.Cancelled {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestOpenAIError(t *testing.T) {
+	s := failing(t, 404, `{"error":{"message":"model not found"}}`)
+	_, _, err := collect(context.Background(), &OpenAI{BaseURL: s.URL})
+	if err == nil || !strings.Contains(err.Error(), "404") || !strings.Contains(err.Error(), "model not found") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestOpenAICancel(t *testing.T) {
+	s := serve(t, "/v1/chat/completions", openAIStream[:2], true)
+	testCancel(t, &OpenAI{BaseURL: s.URL})
+	testCallbackError(t, &OpenAI{BaseURL: s.URL})
+}
+
+func TestOpenAITruncated(t *testing.T) {
+	s := serve(t, "/v1/chat/completions", openAIStream[:3], false)
+	testTruncated(t, &OpenAI{BaseURL: s.URL})
+}
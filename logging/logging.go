@@ -0,0 +1,137 @@
+// Package logging sets up the servers' structured logger (log/slog) and
+// carries per-request loggers, tagged with session, stream and request IDs,
+// through contexts. Prompts are user content, so they are logged only as
+// Options.Prompts allows.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"unicode/utf8"
+
+	"llm-webtransport/tracing"
+)
+
+// Prompt logging modes.
+const (
+	PromptsRedact   = "redact"   // log only the prompt's size
+	PromptsTruncate = "truncate" // log the start of the prompt
+	PromptsFull     = "full"     // log the whole prompt
+)
+
+// Options configure the logger.
+type Options struct {
+	Level     string // debug, info, warn or error
+	Format    string // text or json
+	Prompts   string // PromptsRedact, PromptsTruncate or PromptsFull
+	PromptLen int    // characters kept by PromptsTruncate
+}
+
+// Validate checks the options.
+func (o *Options) Validate() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.Level)); err != nil {
+		return fmt.Errorf("-log-level: %w", err)
+	}
+	if o.Format != "text" && o.Format != "json" {
+		return fmt.Errorf("-log-format: unknown format %q", o.Format)
+	}
+	switch o.Prompts {
+	case PromptsRedact, PromptsTruncate, PromptsFull:
+	default:
+		return fmt.Errorf("-log-prompts: unknown mode %q", o.Prompts)
+	}
+	if o.PromptLen < 0 {
+		return fmt.Errorf("-log-prompt-len %d is negative", o.PromptLen)
+	}
+	return nil
+}
+
+// prompts is the Options used by Prompt.
+var prompts = Options{Prompts: PromptsRedact}
+
+// Setup makes a logger writing to w the default, both for slog and for the
+// log package.
+func Setup(w io.Writer, o Options) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	var level slog.Level
+	level.UnmarshalText([]byte(o.Level))
+	hopts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(w, hopts)
+	if o.Format == "json" {
+		h = slog.NewJSONHandler(w, hopts)
+	}
+	slog.SetDefault(slog.New(h))
+	prompts = o
+	return nil
+}
+
+// Prompt returns the attributes logging a prompt: its size, and the prompt
+// itself or its start unless prompts are redacted.
+func Prompt(prompt string) slog.Attr {
+	attrs := []any{slog.Int("bytes", len(prompt))}
+	switch prompts.Prompts {
+	case PromptsFull:
+		attrs = append(attrs, slog.String("text", prompt))
+	case PromptsTruncate:
+		attrs = append(attrs, slog.String("text", truncate(prompt, prompts.PromptLen)))
+	}
+	return slog.Group("prompt", attrs...)
+}
+
+// truncate shortens s to n characters, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	i := 0
+	for range n {
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return s[:i] + "…"
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying l.
+func NewContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// WithTrace returns l with the ID of the trace carried by ctx, if any, so
+// that log records can be matched to spans.
+func WithTrace(ctx context.Context, l *slog.Logger) *slog.Logger {
+	if sc := tracing.SpanContextFromContext(ctx); sc.IsValid() {
+		return l.With("trace_id", sc.TraceID.String())
+	}
+	return l
+}
+
+// Fatal logs msg at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// NewID returns a random ID for a session or connection.
+func NewID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
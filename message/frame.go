@@ -0,0 +1,401 @@
+package message
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"llm-webtransport/llm"
+)
+
+// ProtocolV1 is the WebTransport application protocol name for version 1 of
+// the binary frame format. Sessions that negotiate no protocol use the
+// legacy text format (see Read and Write).
+const ProtocolV1 = "llm-frames-v1"
+
+// FrameType identifies the payload of a frame.
+type FrameType byte
+
+const (
+	FrameToken      FrameType = 0x01 // UTF-8 text: a response token, or a prompt from the client
+	FrameEnd        FrameType = 0x02 // end of response, empty payload
+	FrameError      FrameType = 0x03 // UTF-8 error message, or JSON Error (see Request); the response is over
+	FrameUsageStats FrameType = 0x04 // JSON UsageStats
+	FrameMetadata   FrameType = 0x05 // JSON Metadata
+	FramePing       FrameType = 0x06 // keepalive, empty payload
+	FrameRepair     FrameType = 0x07 // <seq:uvarint><token>: a datagram token resent reliably
+	FrameRequest    FrameType = 0x08 // JSON Request, from the client
+	FrameGoAway     FrameType = 0x09 // UTF-8 reason; the server is shutting down and takes no more prompts
+)
+
+// SessionGoingAway is the WebTransport session error code with which a
+// shutting-down server closes the sessions still open after its drain
+// deadline.
+const SessionGoingAway = 0x1
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameToken:
+		return "TOKEN"
+	case FrameEnd:
+		return "END"
+	case FrameError:
+		return "ERROR"
+	case FrameUsageStats:
+		return "USAGE_STATS"
+	case FrameMetadata:
+		return "METADATA"
+	case FramePing:
+		return "PING"
+	case FrameRepair:
+		return "REPAIR"
+	case FrameRequest:
+		return "REQUEST"
+	case FrameGoAway:
+		return "GOAWAY"
+	}
+	return fmt.Sprintf("FrameType(%#x)", byte(t))
+}
+
+// Frame is a single typed message.
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// UsageStats is the payload of a USAGE_STATS frame, sent once a response
+// completes. Token counts come from the LLM API, not from counting frames.
+type UsageStats struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	BytesFromLLM     int     `json:"bytes_from_llm"`
+	BytesToClient    int     `json:"bytes_to_client"`
+	Model            string  `json:"model,omitempty"`
+	FinishReason     string  `json:"finish_reason,omitempty"`     // "stop" or "length"
+	FirstTokenMs     float64 `json:"first_token_ms,omitempty"`    // LLM request to first token, at the server
+	GenerationMs     float64 `json:"generation_ms,omitempty"`     // first token to last, at the server
+	TokensPerSecond  float64 `json:"tokens_per_second,omitempty"` // generation speed (see llm.Stats.EvalRate)
+}
+
+// NewUsageStats returns the usage of a response generated with stats.
+func NewUsageStats(stats llm.Stats) UsageStats {
+	return UsageStats{
+		PromptTokens:     stats.PromptTokens,
+		CompletionTokens: stats.CompletionTokens,
+		BytesFromLLM:     stats.BytesReceived,
+		BytesToClient:    stats.BytesSent,
+		Model:            stats.Model,
+		FinishReason:     stats.FinishReason,
+		FirstTokenMs:     float64(stats.FirstToken) / float64(time.Millisecond),
+		GenerationMs:     float64(stats.Generation) / float64(time.Millisecond),
+		TokensPerSecond:  stats.EvalRate(),
+	}
+}
+
+func (u UsageStats) String() string {
+	s := fmt.Sprintf("prompt_tokens=%d completion_tokens=%d", u.PromptTokens, u.CompletionTokens)
+	if u.Model != "" {
+		s += " model=" + u.Model
+	}
+	if u.FinishReason != "" {
+		s += " finish=" + u.FinishReason
+	}
+	if u.TokensPerSecond > 0 {
+		s += fmt.Sprintf(" server: first token %.0fms, %.1f tok/s", u.FirstTokenMs, u.TokensPerSecond)
+	}
+	return s
+}
+
+// Request is the payload of a REQUEST frame, which a client may send as the
+// first prompt of a stream instead of a bare TOKEN. It mirrors an OpenAI
+// chat completion request: Messages is the conversation, ending with the
+// user turn to answer, and the generation options sit alongside it.
+// Later prompts on the stream are TOKEN frames, answered in the same
+// conversation with the same options and delivery mode.
+type Request struct {
+	Messages []llm.Message `json:"messages"`
+	llm.Options
+	Delivery       string `json:"delivery,omitempty"`        // DeliveryStream (default) or DeliveryDatagram
+	ConversationID string `json:"conversation_id,omitempty"` // client-chosen, echoed in METADATA
+	Traceparent    string `json:"traceparent,omitempty"`     // W3C trace context of the client's span
+}
+
+// Validate checks the request, returning an ErrInvalidRequest error naming
+// the offending field.
+func (r *Request) Validate() *Error {
+	if err := llm.ValidateMessages(r.Messages); err != nil {
+		return &Error{Code: ErrInvalidRequest, Param: "messages", Message: err.Error()}
+	}
+	if err := r.Options.Validate(); err != nil {
+		return &Error{Code: ErrInvalidRequest, Message: err.Error()}
+	}
+	switch r.Delivery {
+	case "", DeliveryStream, DeliveryDatagram:
+	default:
+		return &Error{Code: ErrInvalidRequest, Param: "delivery", Message: "unknown delivery mode " + r.Delivery}
+	}
+	return nil
+}
+
+// Error codes of an Error.
+const (
+	ErrInvalidRequest = "invalid_request" // malformed frame or invalid field
+	ErrNotFound       = "not_found"       // unknown or expired response ID
+	ErrLLM            = "llm_error"       // the LLM API failed
+	ErrCancelled      = "cancelled"       // generation was abandoned
+)
+
+// Error is the payload of an ERROR frame on a stream that opened with a
+// REQUEST frame. Streams opened with a bare prompt get only the Message,
+// as text.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   string `json:"param,omitempty"` // the request field at fault
+}
+
+func (e *Error) Error() string {
+	if e.Param != "" {
+		return e.Code + ": " + e.Param + ": " + e.Message
+	}
+	return e.Code + ": " + e.Message
+}
+
+// ParseError decodes the payload of an ERROR frame, JSON or text.
+func ParseError(payload []byte) *Error {
+	var e Error
+	if json.Unmarshal(payload, &e) == nil && e.Code != "" {
+		return &e
+	}
+	return &Error{Message: string(payload)}
+}
+
+// Delivery modes for response tokens.
+const (
+	DeliveryStream   = "stream"   // TOKEN frames on the request stream (default)
+	DeliveryDatagram = "datagram" // sequence-numbered datagrams, repaired over the stream
+)
+
+// Metadata is the payload of a METADATA frame. A client may send one before
+// its prompt to choose the delivery mode and generation Options, which hold
+// for the rest of the stream, and before its first prompt to seed the
+// stream's conversation with History; the server sends one at the
+// start of each response. In datagram mode the server sends another with
+// TokenCount once generation ends, unless it sent no tokens, and the client
+// answers with Missing, even if it is empty.
+//
+// A client that lost its session resumes a response by sending ResponseID
+// and Offset, the number of its tokens already received, as the first
+// frame of a stream on a new session. The server replays the remaining
+// tokens, continues live and then carries on the conversation on that
+// stream.
+type Metadata struct {
+	Model          string        `json:"model,omitempty"`
+	Delivery       string        `json:"delivery,omitempty"`
+	ResponseID     string        `json:"response_id,omitempty"`     // identifies a response for resuming it
+	ConversationID string        `json:"conversation_id,omitempty"` // from the stream's REQUEST
+	Offset         int           `json:"offset,omitempty"`          // resume from this token
+	Options        *llm.Options  `json:"options,omitempty"`         // generation options; the model defaults to the server's
+	History        []llm.Message `json:"history,omitempty"`         // earlier turns, ending with an assistant reply
+	DatagramID     uint64        `json:"datagram_id,omitempty"`     // tags this response's datagrams
+	TokenCount     int           `json:"token_count,omitempty"`     // tokens sent as datagrams
+	Missing        []uint64      `json:"missing,omitempty"`         // sequence numbers to repair
+	Traceparent    string        `json:"traceparent,omitempty"`     // W3C trace context of the next prompt
+}
+
+// ReadFrame reads a binary frame from the stream.
+// Wire format: <type:1 byte><length:uvarint><payload>
+func ReadFrame(r *bufio.Reader) (Frame, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return Frame{}, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	if length > MaxSize {
+		return Frame{}, fmt.Errorf("frame too large: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	return Frame{Type: FrameType(t), Payload: payload}, nil
+}
+
+// WriteFrame writes a binary frame to the stream in a single Write call.
+// Wire format: <type:1 byte><length:uvarint><payload>
+func WriteFrame(w io.Writer, f Frame) error {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(f.Payload))
+	buf = append(buf, byte(f.Type))
+	buf = binary.AppendUvarint(buf, uint64(len(f.Payload)))
+	buf = append(buf, f.Payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Framer reads and writes frames on a stream using either the binary format
+// or the legacy text format. In legacy mode TOKEN frames map to text
+// messages, END to an empty message and ERROR to "\n[error: ...]" text
+// followed by an empty message; other frame types have no legacy encoding
+// and are silently dropped.
+type Framer struct {
+	r          *bufio.Reader
+	w          io.Writer
+	legacy     bool
+	jsonErrors bool
+}
+
+// NewFramer returns a Framer for the given negotiated application protocol.
+// An empty protocol selects the legacy text format.
+func NewFramer(rw io.ReadWriter, protocol string) (*Framer, error) {
+	f := &Framer{r: bufio.NewReader(rw), w: rw}
+	switch protocol {
+	case ProtocolV1:
+	case "":
+		f.legacy = true
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", protocol)
+	}
+	return f, nil
+}
+
+// Legacy reports whether the Framer uses the legacy text format.
+func (f *Framer) Legacy() bool { return f.legacy }
+
+// ReadFrame reads the next frame.
+func (f *Framer) ReadFrame() (Frame, error) {
+	if !f.legacy {
+		return ReadFrame(f.r)
+	}
+	msg, err := Read(f.r)
+	if err != nil {
+		return Frame{}, err
+	}
+	if msg == "" {
+		return Frame{Type: FrameEnd}, nil
+	}
+	return Frame{Type: FrameToken, Payload: []byte(msg)}, nil
+}
+
+// WriteFrame writes a frame.
+func (f *Framer) WriteFrame(fr Frame) error {
+	if !f.legacy {
+		return WriteFrame(f.w, fr)
+	}
+	switch fr.Type {
+	case FrameToken:
+		return Write(f.w, string(fr.Payload))
+	case FrameEnd:
+		return Write(f.w, "")
+	case FrameError:
+		if err := Write(f.w, "\n[error: "+string(fr.Payload)+"]"); err != nil {
+			return err
+		}
+		return Write(f.w, "")
+	}
+	return nil
+}
+
+// WriteToken writes a TOKEN frame.
+func (f *Framer) WriteToken(token string) error {
+	return f.WriteFrame(Frame{Type: FrameToken, Payload: []byte(token)})
+}
+
+// WriteEnd writes an END frame.
+func (f *Framer) WriteEnd() error {
+	return f.WriteFrame(Frame{Type: FrameEnd})
+}
+
+// WriteError writes an ERROR frame.
+func (f *Framer) WriteError(msg string) error {
+	return f.WriteFrame(Frame{Type: FrameError, Payload: []byte(msg)})
+}
+
+// SetJSONErrors makes WriteErr send JSON Error payloads, for a stream that
+// opened with a REQUEST frame.
+func (f *Framer) SetJSONErrors() { f.jsonErrors = true }
+
+// WriteErr writes an ERROR frame carrying e: as JSON if SetJSONErrors was
+// called, otherwise just its message.
+func (f *Framer) WriteErr(e *Error) error {
+	if !f.jsonErrors || f.legacy {
+		return f.WriteError(e.Message)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return f.WriteFrame(Frame{Type: FrameError, Payload: b})
+}
+
+// WriteJSON writes a frame whose payload is v encoded as JSON.
+func (f *Framer) WriteJSON(t FrameType, v any) error {
+	if f.legacy {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return f.WriteFrame(Frame{Type: t, Payload: b})
+}
+
+// DecodeJSON decodes the payload of a USAGE_STATS, METADATA or REQUEST
+// frame.
+func (fr Frame) DecodeJSON(v any) error {
+	if fr.Type != FrameUsageStats && fr.Type != FrameMetadata && fr.Type != FrameRequest {
+		return errors.New("frame " + fr.Type.String() + " has no JSON payload")
+	}
+	return json.Unmarshal(fr.Payload, v)
+}
+
+// RepairFrame returns a REPAIR frame resending the token with sequence
+// number seq.
+func RepairFrame(seq uint64, token string) Frame {
+	payload := binary.AppendUvarint(nil, seq)
+	return Frame{Type: FrameRepair, Payload: append(payload, token...)}
+}
+
+// ParseRepair decodes the payload of a REPAIR frame.
+func (fr Frame) ParseRepair() (seq uint64, token string, err error) {
+	seq, n := binary.Uvarint(fr.Payload)
+	if n <= 0 {
+		return 0, "", errors.New("invalid repair frame")
+	}
+	return seq, string(fr.Payload[n:]), nil
+}
+
+// AppendDatagram appends a token datagram to buf.
+// Wire format: <response id:uvarint><seq:uvarint><token>
+func AppendDatagram(buf []byte, id, seq uint64, token string) []byte {
+	buf = binary.AppendUvarint(buf, id)
+	buf = binary.AppendUvarint(buf, seq)
+	return append(buf, token...)
+}
+
+// ParseDatagram decodes a token datagram.
+func ParseDatagram(b []byte) (id, seq uint64, token string, err error) {
+	id, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, "", errors.New("invalid datagram id")
+	}
+	b = b[n:]
+	seq, n = binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, "", errors.New("invalid datagram sequence number")
+	}
+	return id, seq, string(b[n:]), nil
+}
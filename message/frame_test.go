@@ -0,0 +1,303 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"llm-webtransport/llm"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Type: FrameToken, Payload: []byte("Hello")},
+		{Type: FrameEnd, Payload: []byte{}},
+		{Type: FrameError, Payload: []byte("upstream failed")},
+		{Type: FrameToken, Payload: bytes.Repeat([]byte("x"), 300)}, // two-byte length
+		{Type: FrameToken, Payload: bytes.Repeat([]byte("y"), MaxSize)},
+		{Type: FrameType(0x7f), Payload: []byte("unknown types pass through")},
+	}
+	var wire bytes.Buffer
+	for _, f := range frames {
+		if err := WriteFrame(&wire, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(&wire)
+	for i, want := range frames {
+		got, err := ReadFrame(r)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("frame %d = %v %.20q, want %v %.20q", i, got.Type, got.Payload, want.Type, want.Payload)
+		}
+	}
+	if _, err := ReadFrame(r); err != io.EOF {
+		t.Errorf("after the last frame: %v, want io.EOF", err)
+	}
+}
+
+func TestWriteFrameWireFormat(t *testing.T) {
+	var wire bytes.Buffer
+	WriteFrame(&wire, Frame{Type: FrameToken, Payload: bytes.Repeat([]byte("a"), 200)})
+	if got := wire.Bytes()[:3]; !bytes.Equal(got, []byte{0x01, 0xc8, 0x01}) {
+		t.Errorf("header = % x, want 01 c8 01", got)
+	}
+	wire.Reset()
+	WriteFrame(&wire, Frame{Type: FramePing})
+	if got := wire.Bytes(); !bytes.Equal(got, []byte{0x06, 0x00}) {
+		t.Errorf("PING = % x, want 06 00", got)
+	}
+}
+
+func TestReadFrameMalformed(t *testing.T) {
+	tooLarge := binary.AppendUvarint([]byte{0x01}, MaxSize+1)
+	tests := []struct {
+		name string
+		wire []byte
+		want string // error text
+	}{
+		{"type only", []byte{0x01}, io.ErrUnexpectedEOF.Error()},
+		{"length cut off", []byte{0x01, 0x80}, io.ErrUnexpectedEOF.Error()},
+		{"payload cut off", []byte{0x01, 0x05, 'a', 'b'}, io.ErrUnexpectedEOF.Error()},
+		{"too large", tooLarge, "frame too large"},
+		{"length overflows", append([]byte{0x01}, bytes.Repeat([]byte{0xff}, 11)...), "overflow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadFrame(bufio.NewReader(bytes.NewReader(tt.wire)))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ReadFrame() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacyReadWrite(t *testing.T) {
+	var wire bytes.Buffer
+	for _, msg := range []string{"hello, world!", "", "13:not a prefix"} {
+		if err := Write(&wire, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := wire.String(); got != "13:hello, world!0:15:13:not a prefix" {
+		t.Errorf("wire = %q", got)
+	}
+	r := bufio.NewReader(&wire)
+	for _, want := range []string{"hello, world!", "", "13:not a prefix"} {
+		if got, err := Read(r); err != nil || got != want {
+			t.Errorf("Read() = %q, %v; want %q", got, err, want)
+		}
+	}
+
+	for _, wire := range []string{"x:abc", "-1:", ":", "2097152:", "5:abc"} {
+		if msg, err := Read(bufio.NewReader(strings.NewReader(wire))); err == nil {
+			t.Errorf("Read(%q) = %q, want an error", wire, msg)
+		}
+	}
+}
+
+func TestNewFramer(t *testing.T) {
+	for _, tt := range []struct {
+		protocol string
+		legacy   bool
+		ok       bool
+	}{
+		{ProtocolV1, false, true},
+		{"", true, true},
+		{"llm-frames-v2", false, false},
+	} {
+		f, err := NewFramer(&bytes.Buffer{}, tt.protocol)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewFramer(%q) error = %v", tt.protocol, err)
+			continue
+		}
+		if err == nil && f.Legacy() != tt.legacy {
+			t.Errorf("NewFramer(%q).Legacy() = %v", tt.protocol, f.Legacy())
+		}
+	}
+}
+
+// TestLegacyFramer checks the mapping of frames to legacy text messages:
+// TOKEN to a message, END to an empty one, ERROR to error text and an
+// empty message, and nothing for the rest.
+func TestLegacyFramer(t *testing.T) {
+	var wire bytes.Buffer
+	f, _ := NewFramer(&wire, "")
+	f.SetJSONErrors() // legacy errors are always text
+	f.WriteJSON(FrameMetadata, Metadata{Model: "m"})
+	f.WriteToken("Hi")
+	f.WriteFrame(Frame{Type: FramePing})
+	f.WriteFrame(RepairFrame(1, "x"))
+	f.WriteEnd()
+	f.WriteErr(&Error{Code: ErrLLM, Message: "boom"})
+	if got, want := wire.String(), "2:Hi0:14:\n[error: boom]0:"; got != want {
+		t.Fatalf("wire = %q, want %q", got, want)
+	}
+
+	var types []FrameType
+	var payloads []string
+	for {
+		fr, err := f.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, fr.Type)
+		payloads = append(payloads, string(fr.Payload))
+	}
+	wantTypes := []FrameType{FrameToken, FrameEnd, FrameToken, FrameEnd}
+	wantPayloads := []string{"Hi", "", "\n[error: boom]", ""}
+	for i := range wantTypes {
+		if i >= len(types) || types[i] != wantTypes[i] || payloads[i] != wantPayloads[i] {
+			t.Fatalf("frames = %v %q, want %v %q", types, payloads, wantTypes, wantPayloads)
+		}
+	}
+}
+
+func TestFramerErrors(t *testing.T) {
+	var wire bytes.Buffer
+	f, _ := NewFramer(&wire, ProtocolV1)
+	e := &Error{Code: ErrInvalidRequest, Param: "messages", Message: "messages is empty"}
+	f.WriteErr(e)
+	f.SetJSONErrors()
+	f.WriteErr(e)
+	for i, want := range []string{"messages is empty", `{"code":"invalid_request","message":"messages is empty","param":"messages"}`} {
+		fr, err := f.ReadFrame()
+		if err != nil || fr.Type != FrameError || string(fr.Payload) != want {
+			t.Fatalf("error %d = %v %q, %v; want %q", i, fr.Type, fr.Payload, err, want)
+		}
+		if got := ParseError(fr.Payload); i == 1 && *got != *e || i == 0 && *got != (Error{Message: want}) {
+			t.Errorf("ParseError(%q) = %+v", fr.Payload, got)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    Error
+	}{
+		{`{"code":"not_found","param":"response_id","message":"expired"}`, Error{Code: ErrNotFound, Param: "response_id", Message: "expired"}},
+		{`{"code":"llm_error","message":"overloaded"}`, Error{Code: ErrLLM, Message: "overloaded"}},
+		{`{"message":"no code"}`, Error{Message: `{"message":"no code"}`}},
+		{`{"code":`, Error{Message: `{"code":`}},
+		{"plain text", Error{Message: "plain text"}},
+		{"", Error{}},
+	}
+	for _, tt := range tests {
+		if got := ParseError([]byte(tt.payload)); *got != tt.want {
+			t.Errorf("ParseError(%q) = %+v, want %+v", tt.payload, *got, tt.want)
+		}
+	}
+	e := Error{Code: ErrInvalidRequest, Param: "delivery", Message: "unknown"}
+	if got := e.Error(); got != "invalid_request: delivery: unknown" {
+		t.Errorf("Error() = %q", got)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	var md Metadata
+	if err := (Frame{Type: FrameMetadata, Payload: []byte(`{"model":"m","missing":[1,3]}`)}).DecodeJSON(&md); err != nil || md.Model != "m" || len(md.Missing) != 2 {
+		t.Errorf("DecodeJSON() = %+v, %v", md, err)
+	}
+	if err := (Frame{Type: FrameToken, Payload: []byte(`{}`)}).DecodeJSON(&md); err == nil {
+		t.Error("DecodeJSON() of a TOKEN frame succeeded")
+	}
+}
+
+func TestRequestValidate(t *testing.T) {
+	user := []llm.Message{{Role: llm.RoleUser, Content: "Hi"}}
+	hot := 2.5
+	tests := []struct {
+		name  string
+		req   Request
+		param string // of the error, or "-" for none
+	}{
+		{"valid", Request{Messages: user}, "-"},
+		{"datagram", Request{Messages: user, Delivery: DeliveryDatagram}, "-"},
+		{"no messages", Request{}, "messages"},
+		{"ends with assistant", Request{Messages: append(user, llm.Message{Role: llm.RoleAssistant, Content: "Hello"})}, "messages"},
+		{"bad options", Request{Messages: user, Options: llm.Options{Temperature: &hot}}, ""},
+		{"unknown delivery", Request{Messages: user, Delivery: "carrier pigeon"}, "delivery"},
+	}
+	for _, tt := range tests {
+		e := tt.req.Validate()
+		switch {
+		case tt.param == "-":
+			if e != nil {
+				t.Errorf("%s: Validate() = %v", tt.name, e)
+			}
+		case e == nil:
+			t.Errorf("%s: Validate() = nil, want an error", tt.name)
+		case e.Code != ErrInvalidRequest || e.Param != tt.param:
+			t.Errorf("%s: Validate() = %+v, want invalid_request on %q", tt.name, e, tt.param)
+		}
+	}
+}
+
+func TestRepairRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		seq   uint64
+		token string
+	}{{0, "Hello"}, {1, ""}, {300, " world"}, {1 << 40, "\x00\x80"}} {
+		fr := RepairFrame(tt.seq, tt.token)
+		if fr.Type != FrameRepair {
+			t.Fatalf("RepairFrame type = %v", fr.Type)
+		}
+		seq, token, err := fr.ParseRepair()
+		if err != nil || seq != tt.seq || token != tt.token {
+			t.Errorf("ParseRepair() = %d %q %v, want %d %q", seq, token, err, tt.seq, tt.token)
+		}
+	}
+	for _, payload := range [][]byte{nil, {0x80}, bytes.Repeat([]byte{0xff}, 11)} {
+		if _, _, err := (Frame{Type: FrameRepair, Payload: payload}).ParseRepair(); err == nil {
+			t.Errorf("ParseRepair(% x) succeeded", payload)
+		}
+	}
+}
+
+func TestDatagramRoundTrip(t *testing.T) {
+	prefix := []byte("kept")
+	b := AppendDatagram(prefix, 7, 300, "tok")
+	if !bytes.HasPrefix(b, prefix) {
+		t.Fatalf("AppendDatagram dropped the buffer's contents: % x", b)
+	}
+	id, seq, token, err := ParseDatagram(b[len(prefix):])
+	if err != nil || id != 7 || seq != 300 || token != "tok" {
+		t.Errorf("ParseDatagram() = %d %d %q %v", id, seq, token, err)
+	}
+	if _, _, token, err := ParseDatagram(AppendDatagram(nil, 1, 2, "")); err != nil || token != "" {
+		t.Errorf("empty token: %q, %v", token, err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"empty", nil, "invalid datagram id"},
+		{"id cut off", []byte{0x80}, "invalid datagram id"},
+		{"no sequence number", []byte{0x07}, "invalid datagram sequence number"},
+		{"sequence number cut off", []byte{0x07, 0x80}, "invalid datagram sequence number"},
+	} {
+		if _, _, _, err := ParseDatagram(tt.b); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: ParseDatagram() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestFrameTypeString(t *testing.T) {
+	if s := FrameGoAway.String(); s != "GOAWAY" {
+		t.Errorf("FrameGoAway = %s", s)
+	}
+	if s := FrameType(0x42).String(); s != "FrameType(0x42)" {
+		t.Errorf("unknown type = %s", s)
+	}
+}
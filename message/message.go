@@ -21,6 +21,9 @@ func Read(r *bufio.Reader) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("invalid length prefix: %w", err)
 	}
+	if length < 0 {
+		return "", fmt.Errorf("invalid length prefix: %d", length)
+	}
 	if length > MaxSize {
 		return "", fmt.Errorf("message too large: %d bytes", length)
 	}
@@ -0,0 +1,255 @@
+// Package metrics implements counters, gauges and histograms with labels,
+// exposed in the Prometheus text format by Handler. It covers just what
+// the servers need, without a client library.
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// families holds every metric defined, in definition order.
+var (
+	mu       sync.Mutex
+	families []*family
+)
+
+// family is a metric name with one series per combination of label values.
+type family struct {
+	name, help, typ string
+	labels          []string
+	newSeries       func() series
+
+	mu     sync.Mutex
+	series map[string]series // by joined label values
+	values map[string][]string
+}
+
+type series interface {
+	// write appends the series' samples, each with the given label pairs.
+	write(w *bufio.Writer, name, labels string)
+}
+
+func define(name, help, typ string, labels []string, newSeries func() series) *family {
+	f := &family{
+		name:      name,
+		help:      help,
+		typ:       typ,
+		labels:    labels,
+		newSeries: newSeries,
+		series:    make(map[string]series),
+		values:    make(map[string][]string),
+	}
+	mu.Lock()
+	families = append(families, f)
+	mu.Unlock()
+	return f
+}
+
+// with returns the series for the label values, creating it on first use.
+func (f *family) with(values []string) series {
+	if len(values) != len(f.labels) {
+		panic("metrics: " + f.name + ": want " + strconv.Itoa(len(f.labels)) + " label values, got " + strconv.Itoa(len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = f.newSeries()
+		f.series[key] = s
+		f.values[key] = slices.Clone(values)
+	}
+	return s
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	f.mu.Unlock()
+
+	w.WriteString("# HELP " + f.name + " " + f.help + "\n")
+	w.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+	for _, k := range keys {
+		f.mu.Lock()
+		s, values := f.series[k], f.values[k]
+		f.mu.Unlock()
+		var labels []string
+		for i, l := range f.labels {
+			labels = append(labels, l+`="`+escape(values[i])+`"`)
+		}
+		s.write(w, f.name, strings.Join(labels, ","))
+	}
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(v string) string { return escaper.Replace(v) }
+
+// sample writes one line of the exposition format.
+func sample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves every metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		mu.Lock()
+		fs := slices.Clone(families)
+		mu.Unlock()
+		for _, f := range fs {
+			f.write(bw)
+		}
+		bw.Flush()
+	})
+}
+
+// float is a float64 updated atomically.
+type float struct{ bits atomic.Uint64 }
+
+func (f *float) add(d float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+d)) {
+			return
+		}
+	}
+}
+
+func (f *float) load() float64 { return math.Float64frombits(f.bits.Load()) }
+
+// Counter is a value that only goes up.
+type Counter struct{ v float }
+
+// Inc adds 1.
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add adds d, which must not be negative.
+func (c *Counter) Add(d float64) {
+	if d < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.v.add(d)
+}
+
+func (c *Counter) write(w *bufio.Writer, name, labels string) {
+	sample(w, name, labels, c.v.load())
+}
+
+// CounterVec is a counter with labels.
+type CounterVec struct{ f *family }
+
+// NewCounterVec defines a counter. By convention its name ends in _total.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{define(name, help, "counter", labels, func() series { return new(Counter) })}
+}
+
+// With returns the counter for the label values, in the order of the labels.
+func (v *CounterVec) With(values ...string) *Counter { return v.f.with(values).(*Counter) }
+
+// Gauge is a value that goes up and down.
+type Gauge struct{ v float }
+
+// Inc adds 1.
+func (g *Gauge) Inc() { g.v.add(1) }
+
+// Dec subtracts 1.
+func (g *Gauge) Dec() { g.v.add(-1) }
+
+func (g *Gauge) write(w *bufio.Writer, name, labels string) {
+	sample(w, name, labels, g.v.load())
+}
+
+// GaugeVec is a gauge with labels.
+type GaugeVec struct{ f *family }
+
+// NewGaugeVec defines a gauge.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{define(name, help, "gauge", labels, func() series { return new(Gauge) })}
+}
+
+// With returns the gauge for the label values, in the order of the labels.
+func (v *GaugeVec) With(values ...string) *Gauge { return v.f.with(values).(*Gauge) }
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	bounds []float64 // upper bounds, ascending, without +Inf
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, the last for +Inf
+	sum    float64
+}
+
+// Observe records a value.
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+func (h *Histogram) write(w *bufio.Writer, name, labels string) {
+	h.mu.Lock()
+	counts, sum := slices.Clone(h.counts), h.sum
+	h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var n uint64
+	for i, c := range counts {
+		n += c
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		sample(w, name+"_bucket", labels+sep+`le="`+formatFloat(le)+`"`, float64(n))
+	}
+	sample(w, name+"_sum", labels, sum)
+	sample(w, name+"_count", labels, float64(n))
+}
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct{ f *family }
+
+// NewHistogramVec defines a histogram with the given bucket upper bounds,
+// in ascending order; a +Inf bucket is added.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !slices.IsSorted(buckets) {
+		panic("metrics: " + name + ": buckets not sorted")
+	}
+	return &HistogramVec{define(name, help, "histogram", labels, func() series {
+		return &Histogram{bounds: buckets, counts: make([]uint64, len(buckets)+1)}
+	})}
+}
+
+// With returns the histogram for the label values, in the order of the
+// labels.
+func (v *HistogramVec) With(values ...string) *Histogram { return v.f.with(values).(*Histogram) }
@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// exposition returns the text format of the given metrics only, rather
+// than of every metric defined, as Handler does.
+func exposition(fs ...*family) string {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	for _, f := range fs {
+		f.write(w)
+	}
+	w.Flush()
+	return b.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_counter_total", "A counter.", "b", "a")
+	c.With("2", "x").Inc()
+	c.With("1", "y").Add(2.5)
+	c.With("1", "y").Inc()
+	c.With(`back\slash "quoted"`, "new\nline").Inc()
+	want := `# HELP test_counter_total A counter.
+# TYPE test_counter_total counter
+test_counter_total{b="1",a="y"} 3.5
+test_counter_total{b="2",a="x"} 1
+test_counter_total{b="back\\slash \"quoted\"",a="new\nline"} 1
+`
+	if got := exposition(c.f); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGaugeVec(t *testing.T) {
+	g := NewGaugeVec("test_gauge", "A gauge.")
+	g.With().Inc()
+	g.With().Inc()
+	g.With().Dec()
+	want := `# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 1
+`
+	if got := exposition(g.f); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_seconds", "A histogram.", []float64{0.1, 1}, "op")
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.With("read").Observe(v)
+	}
+	h.With("write").Observe(1)
+	want := `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="read",le="0.1"} 2
+test_seconds_bucket{op="read",le="1"} 3
+test_seconds_bucket{op="read",le="+Inf"} 4
+test_seconds_sum{op="read"} 2.65
+test_seconds_count{op="read"} 4
+test_seconds_bucket{op="write",le="0.1"} 0
+test_seconds_bucket{op="write",le="1"} 1
+test_seconds_bucket{op="write",le="+Inf"} 1
+test_seconds_sum{op="write"} 1
+test_seconds_count{op="write"} 1
+`
+	if got := exposition(h.f); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	u := NewHistogramVec("test_unlabelled_seconds", "A histogram without labels.", []float64{1})
+	u.With().Observe(3)
+	want = `# HELP test_unlabelled_seconds A histogram without labels.
+# TYPE test_unlabelled_seconds histogram
+test_unlabelled_seconds_bucket{le="1"} 0
+test_unlabelled_seconds_bucket{le="+Inf"} 1
+test_unlabelled_seconds_sum 3
+test_unlabelled_seconds_count 1
+`
+	if got := exposition(u.f); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	NewCounterVec("test_handler_total", "Served by Handler.").With().Inc()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE llmwt_requests_total counter\n",
+		"# TYPE test_handler_total counter\ntest_handler_total 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body lacks %q", want)
+		}
+	}
+}
+
+func TestPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func()
+	}{
+		{"label count", func() { NewCounterVec("test_panic_total", "", "a").With("1", "2") }},
+		{"negative add", func() { NewCounterVec("test_negative_total", "").With().Add(-1) }},
+		{"unsorted buckets", func() { NewHistogramVec("test_unsorted", "", []float64{1, 0.5}) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("did not panic")
+				}
+			}()
+			tt.f()
+		})
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	SetIdentities("anonymous", "alice")
+	for name, want := range map[string]string{
+		"anonymous": "anonymous",
+		"alice":     "alice",
+		"jwt-sub-1": OtherIdentity,
+		"":          OtherIdentity,
+	} {
+		if got := Identity(name); got != want {
+			t.Errorf("Identity(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
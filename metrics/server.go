@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"time"
+
+	"llm-webtransport/llm"
+)
+
+// Transport labels.
+const (
+	WebTransport = "webtransport"
+	SSE          = "sse"
+)
+
+// latencyBuckets are the bucket bounds, in seconds, of TTFT and inter-token
+// latency: 1ms to 10s.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// The streaming servers' metrics. Per-response metrics are labelled by
+// transport and by the model requested, as mapped by Model, and those that
+// account for usage also by the client's identity, as mapped by Identity.
+var (
+	ActiveSessions = NewGaugeVec("llmwt_active_sessions",
+		"Open client sessions: WebTransport sessions or HTTP connections.", "transport")
+	ActiveStreams = NewGaugeVec("llmwt_active_streams",
+		"Open streams: WebTransport streams or SSE responses being written.", "transport")
+	AuthFailures = NewCounterVec("llmwt_auth_failures_total",
+		"Requests rejected for a missing or invalid bearer token.", "transport", "reason")
+	OriginRejections = NewCounterVec("llmwt_origin_rejections_total",
+		"Browser requests rejected because their origin is not allowed.", "transport")
+	Requests = NewCounterVec("llmwt_requests_total",
+		"Prompts received.", "transport", "model", "identity")
+	TTFT = NewHistogramVec("llmwt_time_to_first_token_seconds",
+		"Time from receiving a prompt to writing the first token to the client.", latencyBuckets, "transport", "model")
+	InterToken = NewHistogramVec("llmwt_inter_token_seconds",
+		"Time between consecutive token writes to the client.", latencyBuckets, "transport", "model")
+	LLMBytes = NewCounterVec("llmwt_llm_bytes_total",
+		"Content-bearing bytes received from the LLM API.", "transport", "model", "identity")
+	ClientBytes = NewCounterVec("llmwt_client_bytes_total",
+		"Token bytes generated for the client.", "transport", "model", "identity")
+	UpstreamErrors = NewCounterVec("llmwt_upstream_errors_total",
+		"Generations that failed with an LLM API error.", "transport", "model")
+	Cancellations = NewCounterVec("llmwt_cancellations_total",
+		"Generations cancelled because no client was left.", "transport", "model")
+)
+
+// OtherModel is the model label of requests for models not set by
+// SetModels.
+const OtherModel = "other"
+
+// models are the model label values other than OtherModel.
+var models = map[string]bool{}
+
+// SetModels sets the models that get a label value of their own, such as
+// the server's default. Clients choose the model, so labelling every name
+// they send would let them grow the metrics without bound. It must be
+// called before serving.
+func SetModels(names ...string) {
+	for _, name := range names {
+		models[name] = true
+	}
+}
+
+// Model returns the label value of a requested model.
+func Model(name string) string {
+	if models[name] {
+		return name
+	}
+	return OtherModel
+}
+
+// OtherIdentity is the identity label of clients not set by SetIdentities.
+const OtherIdentity = "other"
+
+// identities are the identity label values other than OtherIdentity.
+var identities = map[string]bool{}
+
+// SetIdentities sets the client identities that get a label value of their
+// own, such as the names of the API keys. JWT subjects are chosen by the
+// token issuer and unbounded, so they are labelled OtherIdentity unless
+// set. It must be called before serving.
+func SetIdentities(names ...string) {
+	for _, name := range names {
+		identities[name] = true
+	}
+}
+
+// Identity returns the label value of a client identity.
+func Identity(name string) string {
+	if identities[name] {
+		return name
+	}
+	return OtherIdentity
+}
+
+// Generation records the outcome of one LLM request made for identity.
+func Generation(transport, model, identity string, stats llm.Stats, err error) {
+	model, identity = Model(model), Identity(identity)
+	LLMBytes.With(transport, model, identity).Add(float64(stats.BytesReceived))
+	ClientBytes.With(transport, model, identity).Add(float64(stats.BytesSent))
+	switch {
+	case stats.Cancelled:
+		Cancellations.With(transport, model).Inc()
+	case err != nil:
+		UpstreamErrors.With(transport, model).Inc()
+	}
+}
+
+// TokenTimer times the token writes of one response to a client.
+type TokenTimer struct {
+	ttft, interToken *Histogram
+	received, last   time.Time
+}
+
+// NewTokenTimer starts timing a response to a prompt received at the given
+// time. A zero time, as for a resumed response, records no TTFT.
+func NewTokenTimer(transport, model string, received time.Time) *TokenTimer {
+	model = Model(model)
+	return &TokenTimer{
+		ttft:       TTFT.With(transport, model),
+		interToken: InterToken.With(transport, model),
+		received:   received,
+	}
+}
+
+// Written records that a token was written.
+func (t *TokenTimer) Written() {
+	now := time.Now()
+	switch {
+	case !t.last.IsZero():
+		t.interToken.Observe(now.Sub(t.last).Seconds())
+	case !t.received.IsZero():
+		t.ttft.Observe(now.Sub(t.received).Seconds())
+	}
+	t.last = now
+}
@@ -0,0 +1,125 @@
+package mockllm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"llm-webtransport/sse"
+)
+
+// --- Anthropic Messages API types (local copies) ---
+
+type anthropicRequest struct {
+	Model     string        `json:"model"`
+	System    string        `json:"system"`
+	Messages  []chatMessage `json:"messages"`
+	MaxTokens int           `json:"max_tokens"`
+	Stream    bool          `json:"stream"`
+}
+
+type anthropicMessage struct {
+	ID         string             `json:"id"`
+	Type       string             `json:"type"`
+	Role       string             `json:"role"`
+	Content    []anthropicContent `json:"content"`
+	Model      string             `json:"model"`
+	StopReason *string            `json:"stop_reason"`
+	Usage      anthropicUsage     `json:"usage"`
+}
+
+type anthropicContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens,omitempty"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func anthropicError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": "invalid_request_error", "message": msg},
+	})
+}
+
+func (s *Server) handleAnthropicMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		anthropicError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req anthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		anthropicError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if len(req.Messages) == 0 {
+		anthropicError(w, http.StatusBadRequest, "messages: at least one message is required")
+		return
+	}
+	if req.MaxTokens <= 0 {
+		anthropicError(w, http.StatusBadRequest, "max_tokens: field required")
+		return
+	}
+
+	// Key the reply as the OpenAI endpoint would see the conversation.
+	msgs := req.Messages
+	if req.System != "" {
+		msgs = append([]chatMessage{{Role: "system", Content: req.System}}, msgs...)
+	}
+	rp := s.reply(msgs, req.MaxTokens, 0)
+	stop := "end_turn"
+	if rp.truncated {
+		stop = "max_tokens"
+	}
+	msg := anthropicMessage{
+		ID:      fmt.Sprintf("msg_%016x", fnvHash(rp.key)),
+		Type:    "message",
+		Role:    "assistant",
+		Content: []anthropicContent{},
+		Model:   req.Model,
+		Usage:   anthropicUsage{InputTokens: rp.promptTokens},
+	}
+
+	if !req.Stream {
+		msg.Content = []anthropicContent{{Type: "text", Text: strings.Join(rp.tokens, "")}}
+		msg.StopReason = &stop
+		msg.Usage.OutputTokens = len(rp.tokens)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		anthropicError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	writeEvent := func(event string, data map[string]any) {
+		data["type"] = event
+		b, _ := json.Marshal(data)
+		sse.WriteEvent(w, sse.Event{Event: event, Data: string(b)})
+		flusher.Flush()
+	}
+
+	writeEvent("message_start", map[string]any{"message": msg})
+	writeEvent("content_block_start", map[string]any{"index": 0, "content_block": anthropicContent{Type: "text"}})
+	if !s.stream(r.Context(), rp, func(token string) {
+		writeEvent("content_block_delta", map[string]any{"index": 0, "delta": map[string]string{"type": "text_delta", "text": token}})
+	}) {
+		return
+	}
+	writeEvent("content_block_stop", map[string]any{"index": 0})
+	writeEvent("message_delta", map[string]any{
+		"delta": map[string]any{"stop_reason": stop, "stop_sequence": nil},
+		"usage": anthropicUsage{OutputTokens: len(rp.tokens)},
+	})
+	writeEvent("message_stop", map[string]any{})
+}
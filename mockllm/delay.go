@@ -0,0 +1,104 @@
+package mockllm
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Delay produces inter-token delays drawn from a distribution.
+type Delay interface {
+	Next(r *rand.Rand) time.Duration
+	String() string
+}
+
+type constDelay struct{ d time.Duration }
+
+func (c constDelay) Next(*rand.Rand) time.Duration { return c.d }
+func (c constDelay) String() string                { return "const:" + c.d.String() }
+
+type uniformDelay struct{ min, max time.Duration }
+
+func (u uniformDelay) Next(r *rand.Rand) time.Duration {
+	if u.max <= u.min {
+		return u.min
+	}
+	return u.min + time.Duration(r.Int63n(int64(u.max-u.min)+1))
+}
+func (u uniformDelay) String() string { return "uniform:" + u.min.String() + "-" + u.max.String() }
+
+type normalDelay struct{ mean, stddev time.Duration }
+
+func (n normalDelay) Next(r *rand.Rand) time.Duration {
+	d := time.Duration(r.NormFloat64()*float64(n.stddev)) + n.mean
+	return max(d, 0)
+}
+func (n normalDelay) String() string { return "normal:" + n.mean.String() + "," + n.stddev.String() }
+
+type expDelay struct{ mean time.Duration }
+
+func (e expDelay) Next(r *rand.Rand) time.Duration {
+	return time.Duration(math.Round(r.ExpFloat64() * float64(e.mean)))
+}
+func (e expDelay) String() string { return "exp:" + e.mean.String() }
+
+// ParseDelay parses a delay distribution spec.
+// Supported forms:
+//
+//	const:35ms            fixed delay
+//	uniform:20ms-50ms     uniform between min and max
+//	normal:35ms,5ms       normal with mean and stddev (clamped at 0)
+//	exp:35ms              exponential with mean
+//
+// A bare duration ("35ms") is shorthand for const.
+func ParseDelay(spec string) (Delay, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok {
+		kind, arg = "const", spec
+	}
+	switch kind {
+	case "const":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %q: %w", spec, err)
+		}
+		return constDelay{d}, nil
+	case "uniform":
+		lo, hi, ok := strings.Cut(arg, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid delay %q: want uniform:<min>-<max>", spec)
+		}
+		min, err := time.ParseDuration(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %q: %w", spec, err)
+		}
+		max, err := time.ParseDuration(hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %q: %w", spec, err)
+		}
+		return uniformDelay{min, max}, nil
+	case "normal":
+		m, s, ok := strings.Cut(arg, ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid delay %q: want normal:<mean>,<stddev>", spec)
+		}
+		mean, err := time.ParseDuration(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %q: %w", spec, err)
+		}
+		stddev, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %q: %w", spec, err)
+		}
+		return normalDelay{mean, stddev}, nil
+	case "exp":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %q: %w", spec, err)
+		}
+		return expDelay{d}, nil
+	}
+	return nil, fmt.Errorf("unknown delay distribution %q", kind)
+}
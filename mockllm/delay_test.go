@@ -0,0 +1,65 @@
+package mockllm
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDelay(t *testing.T) {
+	tests := []struct {
+		spec, want string // want is the parsed delay's String, or an error
+	}{
+		{"35ms", "const:35ms"},
+		{"const:1s", "const:1s"},
+		{"uniform:20ms-50ms", "uniform:20ms-50ms"},
+		{"normal:35ms,5ms", "normal:35ms,5ms"},
+		{"exp:35ms", "exp:35ms"},
+
+		{"fast", `invalid delay "fast"`},
+		{"const:", `invalid delay "const:"`},
+		{"uniform:20ms", "want uniform:<min>-<max>"},
+		{"uniform:20ms-x", `invalid delay "uniform:20ms-x"`},
+		{"normal:35ms", "want normal:<mean>,<stddev>"},
+		{"normal:35ms,x", `invalid delay "normal:35ms,x"`},
+		{"exp:", `invalid delay "exp:"`},
+		{"gauss:35ms", `unknown delay distribution "gauss"`},
+	}
+	for _, tt := range tests {
+		d, err := ParseDelay(tt.spec)
+		switch {
+		case err != nil:
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParseDelay(%q) error = %v, want %q", tt.spec, err, tt.want)
+			}
+		case d.String() != tt.want:
+			t.Errorf("ParseDelay(%q) = %s, want %s", tt.spec, d, tt.want)
+		}
+	}
+}
+
+func TestDelayRanges(t *testing.T) {
+	tests := []struct {
+		spec     string
+		min, max time.Duration
+	}{
+		{"const:35ms", 35 * time.Millisecond, 35 * time.Millisecond},
+		{"uniform:20ms-50ms", 20 * time.Millisecond, 50 * time.Millisecond},
+		{"uniform:50ms-20ms", 50 * time.Millisecond, 50 * time.Millisecond},
+		{"normal:1ms,10ms", 0, time.Hour}, // clamped at 0
+		{"exp:35ms", 0, time.Hour},
+	}
+	for _, tt := range tests {
+		d, err := ParseDelay(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := rand.New(rand.NewSource(1))
+		for range 1000 {
+			if got := d.Next(r); got < tt.min || got > tt.max {
+				t.Fatalf("%s: Next() = %v, want within [%v, %v]", tt.spec, got, tt.min, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,413 @@
+// Package mockllm implements a deterministic stand-in for the streaming
+// chat APIs the llm package speaks: Ollama's OpenAI-compatible and native
+// endpoints, and Anthropic's Messages API. Every prompt maps to a fixed
+// token sequence and a fixed sequence of inter-token delays, so all
+// benchmark runners see byte-identical streams without a GPU.
+package mockllm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// created is the fixed "created" timestamp stamped on every response so
+// that repeated runs produce identical bytes; createdAt is the same time
+// for APIs that use RFC 3339 timestamps.
+const (
+	created   = 1735689600
+	createdAt = "2025-01-01T00:00:00Z"
+)
+
+// Config controls the token streams produced by the mock server.
+type Config struct {
+	Seed            int64               // mixed into the per-prompt RNG seed
+	MinTokens       int                 // minimum generated response length
+	MaxTokens       int                 // maximum generated response length
+	FirstTokenDelay Delay               // delay before the first token
+	TokenDelay      Delay               // delay between subsequent tokens
+	Script          map[string][]string // fixed token sequences keyed by prompt
+	Models          []string            // model names listed by the API
+}
+
+// DefaultConfig returns a config roughly matching gemma3:12b on the
+// hardware used for the published results.
+func DefaultConfig() Config {
+	return Config{
+		MinTokens:       400,
+		MaxTokens:       500,
+		FirstTokenDelay: constDelay{200 * time.Millisecond},
+		TokenDelay:      constDelay{35 * time.Millisecond},
+		Models:          []string{"gemma3:12b"},
+	}
+}
+
+// Server serves the mock API.
+type Server struct {
+	cfg Config
+}
+
+// New returns a mock server using cfg. Zero-valued fields fall back to
+// DefaultConfig.
+func New(cfg Config) *Server {
+	def := DefaultConfig()
+	if cfg.MinTokens <= 0 {
+		cfg.MinTokens = def.MinTokens
+	}
+	if cfg.MaxTokens < cfg.MinTokens {
+		cfg.MaxTokens = max(def.MaxTokens, cfg.MinTokens)
+	}
+	if cfg.FirstTokenDelay == nil {
+		cfg.FirstTokenDelay = def.FirstTokenDelay
+	}
+	if cfg.TokenDelay == nil {
+		cfg.TokenDelay = def.TokenDelay
+	}
+	if len(cfg.Models) == 0 {
+		cfg.Models = def.Models
+	}
+	return &Server{cfg: cfg}
+}
+
+// Handler returns an http.Handler serving /v1/chat/completions,
+// /v1/models, Ollama's /api/chat and /api/tags, and Anthropic's
+// /v1/messages. /v1/models answers in Anthropic's format when the request
+// has an anthropic-version header.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", s.handleChatCompletions)
+	mux.HandleFunc("/v1/models", s.handleModels)
+	mux.HandleFunc("/api/chat", s.handleOllamaChat)
+	mux.HandleFunc("/api/tags", s.handleOllamaTags)
+	mux.HandleFunc("/v1/messages", s.handleAnthropicMessages)
+	return mux
+}
+
+// reply is the mock's answer to one conversation.
+type reply struct {
+	key          string
+	tokens       []string
+	delays       []time.Duration // before each token
+	truncated    bool            // cut off by the request's token limit
+	promptTokens int
+}
+
+// reply returns the answer to msgs, cut to maxTokens if that is set. A
+// request's seed, if any, is mixed into the prompt's RNG seed.
+func (s *Server) reply(msgs []chatMessage, maxTokens int, seed int64) reply {
+	key := promptKey(msgs)
+	rng := s.rng(key, seed)
+	rp := reply{key: key, promptTokens: countTokens(msgs)}
+	rp.tokens = s.tokens(key, rng)
+	if maxTokens > 0 && len(rp.tokens) > maxTokens {
+		rp.tokens, rp.truncated = rp.tokens[:maxTokens], true
+	}
+	for i := range rp.tokens {
+		d := s.cfg.TokenDelay
+		if i == 0 {
+			d = s.cfg.FirstTokenDelay
+		}
+		rp.delays = append(rp.delays, d.Next(rng))
+	}
+	return rp
+}
+
+// stream calls emit for each token of rp after its delay. It returns false
+// if ctx ends first.
+func (s *Server) stream(ctx context.Context, rp reply, emit func(token string)) bool {
+	for i, token := range rp.tokens {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(rp.delays[i]):
+		}
+		emit(token)
+	}
+	return true
+}
+
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	type model struct {
+		ID          string `json:"id"`
+		Object      string `json:"object,omitempty"`
+		Created     int64  `json:"created,omitempty"`
+		OwnedBy     string `json:"owned_by,omitempty"`
+		Type        string `json:"type,omitempty"`
+		DisplayName string `json:"display_name,omitempty"`
+		CreatedAt   string `json:"created_at,omitempty"`
+	}
+	anthropic := r.Header.Get("anthropic-version") != ""
+	var data []model
+	for _, name := range s.cfg.Models {
+		if anthropic {
+			data = append(data, model{ID: name, Type: "model", DisplayName: name, CreatedAt: createdAt})
+		} else {
+			data = append(data, model{ID: name, Object: "model", Created: created, OwnedBy: "library"})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if anthropic {
+		json.NewEncoder(w).Encode(map[string]any{"data": data, "has_more": false})
+	} else {
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": data})
+	}
+}
+
+// --- OpenAI request/response types (local copies) ---
+
+type chatRequest struct {
+	Model         string         `json:"model"`
+	Messages      []chatMessage  `json:"messages"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	Seed          int64          `json:"seed,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatChunk struct {
+	ID                string        `json:"id"`
+	Object            string        `json:"object"`
+	Created           int64         `json:"created"`
+	Model             string        `json:"model"`
+	SystemFingerprint string        `json:"system_fingerprint"`
+	Choices           []chunkChoice `json:"choices"`
+	Usage             *chatUsage    `json:"usage,omitempty"`
+}
+
+type chunkChoice struct {
+	Index        int         `json:"index"`
+	Delta        chatMessage `json:"delta"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type chatCompletion struct {
+	ID                string             `json:"id"`
+	Object            string             `json:"object"`
+	Created           int64              `json:"created"`
+	Model             string             `json:"model"`
+	SystemFingerprint string             `json:"system_fingerprint"`
+	Choices           []completionChoice `json:"choices"`
+	Usage             chatUsage          `json:"usage"`
+}
+
+type completionChoice struct {
+	Index        int         `json:"index"`
+	Message      chatMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req chatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Messages) == 0 {
+		http.Error(w, "messages is required", http.StatusBadRequest)
+		return
+	}
+
+	rp := s.reply(req.Messages, req.MaxTokens, req.Seed)
+	tokens := rp.tokens
+	finish := "stop"
+	if rp.truncated {
+		finish = "length"
+	}
+	usage := chatUsage{
+		PromptTokens:     rp.promptTokens,
+		CompletionTokens: len(tokens),
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	id := fmt.Sprintf("chatcmpl-%d", fnvHash(rp.key)%1000)
+
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(chatCompletion{
+			ID:                id,
+			Object:            "chat.completion",
+			Created:           created,
+			Model:             req.Model,
+			SystemFingerprint: "fp_ollama",
+			Choices: []completionChoice{{
+				Message:      chatMessage{Role: "assistant", Content: strings.Join(tokens, "")},
+				FinishReason: finish,
+			}},
+			Usage: usage,
+		})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	writeChunk := func(c chatChunk) {
+		c.ID, c.Object, c.Created, c.Model, c.SystemFingerprint = id, "chat.completion.chunk", created, req.Model, "fp_ollama"
+		b, _ := json.Marshal(c)
+		fmt.Fprintf(w, "data: %s\n\n", b)
+		flusher.Flush()
+	}
+
+	if !s.stream(r.Context(), rp, func(token string) {
+		writeChunk(chatChunk{Choices: []chunkChoice{{
+			Delta: chatMessage{Role: "assistant", Content: token},
+		}}})
+	}) {
+		return
+	}
+
+	writeChunk(chatChunk{Choices: []chunkChoice{{
+		Delta:        chatMessage{Role: "assistant"},
+		FinishReason: &finish,
+	}}})
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		writeChunk(chatChunk{Choices: []chunkChoice{}, Usage: &usage})
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// rng returns the random source for a prompt. It is seeded from the
+// prompt itself so each prompt gets the same delays on every run.
+func (s *Server) rng(key string, seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(int64(fnvHash(key)) ^ s.cfg.Seed ^ seed))
+}
+
+// tokens returns the token sequence for a prompt: the scripted response if
+// there is one, otherwise a walk through the built-in corpus.
+func (s *Server) tokens(key string, rng *rand.Rand) []string {
+	if t, ok := s.cfg.Script[key]; ok {
+		return t
+	}
+	n := s.cfg.MinTokens + rng.Intn(s.cfg.MaxTokens-s.cfg.MinTokens+1)
+	start := rng.Intn(len(vocab))
+	out := make([]string, n)
+	for i := range out {
+		out[i] = vocab[(start+i)%len(vocab)]
+	}
+	out[0] = strings.TrimLeft(out[0], " \t")
+	return out
+}
+
+// promptKey identifies a conversation. A single user message is keyed by
+// its content alone so that scripts can be written as plain prompts.
+func promptKey(msgs []chatMessage) string {
+	if len(msgs) == 1 {
+		return msgs[0].Content
+	}
+	var sb strings.Builder
+	for _, m := range msgs {
+		sb.WriteString(m.Role)
+		sb.WriteByte(':')
+		sb.WriteString(m.Content)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func countTokens(msgs []chatMessage) int {
+	n := 0
+	for _, m := range msgs {
+		n += len(tokenRE.FindAllString(m.Content, -1))
+	}
+	return n
+}
+
+func fnvHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// LoadScript reads fixed responses from a JSONL file. Each line is
+// {"prompt": "...", "tokens": ["...", ...]}; a "response" string may be
+// given instead of "tokens" and is split using the built-in tokenizer.
+func LoadScript(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	script := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry struct {
+			Prompt   string   `json:"prompt"`
+			Tokens   []string `json:"tokens"`
+			Response string   `json:"response"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		tokens := entry.Tokens
+		if tokens == nil {
+			tokens = tokenRE.FindAllString(entry.Response, -1)
+		}
+		script[entry.Prompt] = tokens
+	}
+	return script, scanner.Err()
+}
+
+// tokenRE splits text into BPE-like pieces: words carry their leading
+// space, punctuation and runs of newlines stand alone. Any other
+// whitespace is kept as its own token so no input bytes are lost.
+var tokenRE = regexp.MustCompile(`\n+|[ \t]*[A-Za-z0-9']+|[ \t]*[^A-Za-z0-9'\s]|\s+`)
+
+var vocab = tokenRE.FindAllString(corpus, -1)
+
+const corpus = `A stack is a last-in, first-out collection: the most recently pushed element is the first one popped. A queue is first-in, first-out, so elements leave in the order they arrived.
+
+Here are the key differences:
+
+* **Ordering:** stacks reverse the insertion order, queues preserve it.
+* **Operations:** a stack exposes push and pop, while a queue exposes enqueue and dequeue.
+* **Use cases:** stacks back function calls, undo history and depth-first search; queues back task scheduling, buffering and breadth-first search.
+
+A hash table stores key-value pairs in an array of buckets. A hash function turns each key into an index, so lookups, inserts and deletes take constant time on average. When two keys land in the same bucket the table resolves the collision, either by chaining entries in a list or by probing for the next free slot.
+
+` + "```go\nfunc Reverse(s string) string {\n\tr := []rune(s)\n\tfor i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {\n\t\tr[i], r[j] = r[j], r[i]\n\t}\n\treturn string(r)\n}\n```" + `
+
+TCP is a connection-oriented protocol that guarantees ordered, reliable delivery with flow and congestion control. UDP is connectionless and sends independent datagrams with no delivery guarantees. TCP suits file transfer and web pages, while UDP suits real-time traffic such as voice, video and games.
+
+Binary search runs in O(log n) time because every comparison halves the remaining search space. After k steps only n / 2^k candidates remain, so at most about log2(n) comparisons are needed to find the target or prove it is absent.
+
+The observer pattern defines a one-to-many dependency between objects. When the subject changes state it notifies every registered observer, which then updates itself. This decouples the subject from the concrete observers and is the basis of most event systems.
+
+A rainbow appears when sunlight enters raindrops, refracts, reflects off the back of the drop and refracts again on the way out. Each wavelength bends by a slightly different amount, spreading white light into its component colors.
+`
@@ -0,0 +1,150 @@
+package mockllm
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"llm-webtransport/llm"
+)
+
+func testConfig(seed int64) Config {
+	return Config{
+		Seed:            seed,
+		MinTokens:       20,
+		MaxTokens:       40,
+		FirstTokenDelay: constDelay{0},
+		TokenDelay:      constDelay{0},
+	}
+}
+
+var prompt = []chatMessage{{Role: "user", Content: "What is a stack?"}}
+
+func TestReplyIsReproducible(t *testing.T) {
+	cfg := testConfig(7)
+	cfg.TokenDelay = normalDelay{35e6, 5e6}
+	a, b := New(cfg).reply(prompt, 0, 0), New(cfg).reply(prompt, 0, 0)
+	if !slices.Equal(a.tokens, b.tokens) || !slices.Equal(a.delays, b.delays) {
+		t.Fatal("two servers with the same seed gave different replies")
+	}
+	if n := len(a.tokens); n < 20 || n > 40 {
+		t.Errorf("reply has %d tokens, want 20 to 40", n)
+	}
+	if c := New(testConfig(8)).reply(prompt, 0, 0); slices.Equal(a.tokens, c.tokens) {
+		t.Error("the server's seed did not change the reply")
+	}
+	if c := New(cfg).reply(prompt, 0, 99); slices.Equal(a.tokens, c.tokens) {
+		t.Error("the request's seed did not change the reply")
+	}
+	other := []chatMessage{{Role: "user", Content: "What is a queue?"}}
+	if c := New(cfg).reply(other, 0, 0); slices.Equal(a.tokens, c.tokens) {
+		t.Error("two prompts got the same reply")
+	}
+
+	cut := New(cfg).reply(prompt, 5, 0)
+	if !cut.truncated || !slices.Equal(cut.tokens, a.tokens[:5]) {
+		t.Errorf("max_tokens 5: truncated %v, tokens %q", cut.truncated, cut.tokens)
+	}
+}
+
+// writeScript writes a script file and returns its path.
+func writeScript(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.jsonl")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScript(t *testing.T) {
+	script, err := LoadScript(writeScript(t, `{"prompt": "hi", "tokens": ["Hel", "lo", "!"]}
+
+{"prompt": "split", "response": "Two words.\n\nDone"}
+{"prompt": "empty", "tokens": []}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"hi":    {"Hel", "lo", "!"},
+		"split": {"Two", " words", ".", "\n\n", "Done"},
+		"empty": {},
+	}
+	for prompt, tokens := range want {
+		if got, ok := script[prompt]; !ok || !slices.Equal(got, tokens) {
+			t.Errorf("script[%q] = %q, want %q", prompt, got, tokens)
+		}
+	}
+	if len(script) != len(want) {
+		t.Errorf("script has %d entries, want %d", len(script), len(want))
+	}
+
+	rp := New(Config{Script: script}).reply([]chatMessage{{Role: "user", Content: "hi"}}, 0, 0)
+	if !slices.Equal(rp.tokens, want["hi"]) || len(rp.delays) != 3 {
+		t.Errorf("scripted reply = %q with %d delays", rp.tokens, len(rp.delays))
+	}
+}
+
+func TestLoadScriptErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"not JSON", "{\"prompt\": \"a\", \"tokens\": []}\nhello\n", ":2: invalid character"},
+		{"tokens not strings", `{"prompt": "a", "tokens": [1]}`, ":1: json: cannot unmarshal"},
+		{"cut off", `{"prompt": "a"`, ":1: unexpected end"},
+	}
+	for _, tt := range tests {
+		_, err := LoadScript(writeScript(t, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: LoadScript() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+	if _, err := LoadScript(filepath.Join(t.TempDir(), "missing.jsonl")); err == nil {
+		t.Error("LoadScript() of a missing file succeeded")
+	}
+}
+
+// TestProviders checks that every llm.Provider gets the same reply from
+// the mock, with usage and finish reasons, and lists its models.
+func TestProviders(t *testing.T) {
+	s := httptest.NewServer(New(testConfig(1)).Handler())
+	defer s.Close()
+	msgs := []llm.Message{{Role: llm.RoleUser, Content: "What is a stack?"}}
+	want := New(testConfig(1)).reply(prompt, 0, 0).tokens
+
+	for _, kind := range []string{llm.KindOpenAI, llm.KindOllama, llm.KindAnthropic} {
+		t.Run(kind, func(t *testing.T) {
+			p, err := llm.NewProvider(kind, s.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := llm.CheckModel(context.Background(), p, "gemma3:12b"); err != nil {
+				t.Error(err)
+			}
+			var tokens []string
+			stats, err := p.StreamChat(context.Background(), msgs, llm.Options{Model: "gemma3:12b"}, func(token string) error {
+				tokens = append(tokens, token)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(tokens, want) {
+				t.Errorf("tokens = %q, want %q", tokens, want)
+			}
+			if stats.CompletionTokens != len(want) || stats.PromptTokens == 0 || stats.FinishReason != "stop" {
+				t.Errorf("stats = %+v", stats)
+			}
+
+			stats, err = p.StreamChat(context.Background(), msgs, llm.Options{Model: "gemma3:12b", MaxTokens: 3}, func(string) error { return nil })
+			if err != nil || stats.CompletionTokens != 3 || stats.FinishReason != "length" {
+				t.Errorf("max_tokens 3: stats = %+v, err %v", stats, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package mockllm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// --- Ollama native API types (local copies) ---
+
+type ollamaRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   *bool         `json:"stream"` // default true
+	Options  struct {
+		NumPredict int   `json:"num_predict"`
+		Seed       int64 `json:"seed"`
+	} `json:"options"`
+}
+
+type ollamaChunk struct {
+	Model              string      `json:"model"`
+	CreatedAt          string      `json:"created_at"`
+	Message            chatMessage `json:"message"`
+	DoneReason         string      `json:"done_reason,omitempty"`
+	Done               bool        `json:"done"`
+	TotalDuration      int64       `json:"total_duration,omitempty"` // nanoseconds
+	LoadDuration       int64       `json:"load_duration,omitempty"`
+	PromptEvalCount    int         `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64       `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int         `json:"eval_count,omitempty"`
+	EvalDuration       int64       `json:"eval_duration,omitempty"`
+}
+
+type ollamaModel struct {
+	Name       string `json:"name"`
+	Model      string `json:"model"`
+	ModifiedAt string `json:"modified_at"`
+}
+
+func (s *Server) handleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ollamaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid JSON body"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Messages) == 0 {
+		http.Error(w, `{"error":"messages is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	rp := s.reply(req.Messages, req.Options.NumPredict, req.Options.Seed)
+	final := ollamaChunk{
+		Model:           req.Model,
+		CreatedAt:       createdAt,
+		Message:         chatMessage{Role: "assistant"},
+		DoneReason:      "stop",
+		Done:            true,
+		PromptEvalCount: rp.promptTokens,
+		EvalCount:       len(rp.tokens),
+	}
+	if rp.truncated {
+		final.DoneReason = "length"
+	}
+	// Report the scripted delays as timings, so they are deterministic:
+	// the first token's delay is prompt processing, the rest generation.
+	for i, d := range rp.delays {
+		if i == 0 {
+			final.PromptEvalDuration = int64(d)
+		} else {
+			final.EvalDuration += int64(d)
+		}
+	}
+	final.TotalDuration = final.PromptEvalDuration + final.EvalDuration
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w) // one object per line
+	if req.Stream != nil && !*req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		final.Message.Content = strings.Join(rp.tokens, "")
+		enc.Encode(final)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if !s.stream(r.Context(), rp, func(token string) {
+		enc.Encode(ollamaChunk{
+			Model:     req.Model,
+			CreatedAt: createdAt,
+			Message:   chatMessage{Role: "assistant", Content: token},
+		})
+		flusher.Flush()
+	}) {
+		return
+	}
+	enc.Encode(final)
+	flusher.Flush()
+}
+
+func (s *Server) handleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	var models []ollamaModel
+	for _, name := range s.cfg.Models {
+		models = append(models, ollamaModel{Name: name, Model: name, ModifiedAt: createdAt})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"models": models})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"llm-webtransport/config"
+	"llm-webtransport/mockllm"
+)
+
+func main() {
+	addr := config.Addr("addr", "127.0.0.1:11434", "Listen address (defaults to Ollama's so the servers need no changes)")
+	seed := flag.Int64("seed", 0, "Seed mixed into every per-prompt token and delay sequence")
+	minTokens := flag.Int("min-tokens", 400, "Minimum generated response length in tokens")
+	maxTokens := flag.Int("max-tokens", 500, "Maximum generated response length in tokens")
+	firstDelay := flag.String("first-token-delay", "200ms", "Delay before the first token (const:, uniform:, normal:, exp:)")
+	tokenDelay := flag.String("token-delay", "35ms", "Delay between tokens (const:, uniform:, normal:, exp:)")
+	scriptPath := flag.String("script", "", "Optional JSONL file of fixed responses ({\"prompt\":...,\"tokens\":[...]})")
+	config.Parse()
+
+	cfg := mockllm.Config{
+		Seed:      *seed,
+		MinTokens: *minTokens,
+		MaxTokens: *maxTokens,
+	}
+	var err error
+	if cfg.FirstTokenDelay, err = mockllm.ParseDelay(*firstDelay); err != nil {
+		log.Fatalf("-first-token-delay: %v", err)
+	}
+	if cfg.TokenDelay, err = mockllm.ParseDelay(*tokenDelay); err != nil {
+		log.Fatalf("-token-delay: %v", err)
+	}
+	if *scriptPath != "" {
+		if cfg.Script, err = mockllm.LoadScript(*scriptPath); err != nil {
+			log.Fatalf("load script: %v", err)
+		}
+		log.Printf("loaded %d scripted responses from %s", len(cfg.Script), *scriptPath)
+	}
+
+	log.Printf("mock LLM server listening on %s (first token %s, token delay %s)", *addr, cfg.FirstTokenDelay, cfg.TokenDelay)
+	if err := http.ListenAndServe(*addr, mockllm.New(cfg).Handler()); err != nil {
+		log.Fatalf("server error: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+// Package netem emulates impaired networks in user space. Relays listen on a
+// local port and forward to a target, applying delay, jitter, loss,
+// reordering and a bandwidth cap to traffic in each direction, so the
+// benchmark's network profiles run without root or dummynet.
+package netem
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profile describes the impairment applied to each direction of a relay.
+type Profile struct {
+	Name         string
+	Delay        time.Duration // one-way delay
+	Jitter       time.Duration // delay varies uniformly by +/- Jitter
+	Loss         float64       // probability a packet is dropped
+	Reorder      float64       // probability a packet is held back so later ones overtake it
+	ReorderDelay time.Duration // how long a reordered packet is held back (default 20ms)
+	Bandwidth    int64         // bits per second, 0 for unlimited
+	QueueBytes   int           // bottleneck queue size; UDP packets beyond it are dropped (default 64 KiB)
+}
+
+// Profiles are the named profiles used by benchmark/benchmark.sh.
+var Profiles = map[string]Profile{
+	"baseline":      {Name: "baseline"},
+	"latency-200ms": {Name: "latency-200ms", Delay: 200 * time.Millisecond},
+	"loss-5pct":     {Name: "loss-5pct", Loss: 0.05},
+	"bw-100kbps":    {Name: "bw-100kbps", Bandwidth: 100_000},
+	"degraded":      {Name: "degraded", Delay: 200 * time.Millisecond, Loss: 0.05, Bandwidth: 100_000},
+}
+
+// ProfileNames returns the names of the built-in profiles in a stable order.
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseProfile returns a built-in profile by name, or parses a custom one
+// from comma-separated key=value pairs, e.g.
+//
+//	delay=50ms,jitter=10ms,loss=0.01,reorder=0.02,bw=1mbit
+func ParseProfile(spec string) (Profile, error) {
+	if p, ok := Profiles[spec]; ok {
+		return p, nil
+	}
+	p := Profile{Name: spec}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return Profile{}, fmt.Errorf("unknown profile %q (built-in: %s)", spec, strings.Join(ProfileNames(), ", "))
+		}
+		var err error
+		switch k {
+		case "delay":
+			p.Delay, err = time.ParseDuration(v)
+		case "jitter":
+			p.Jitter, err = time.ParseDuration(v)
+		case "loss":
+			p.Loss, err = strconv.ParseFloat(v, 64)
+		case "reorder":
+			p.Reorder, err = strconv.ParseFloat(v, 64)
+		case "reorder-delay":
+			p.ReorderDelay, err = time.ParseDuration(v)
+		case "bw":
+			p.Bandwidth, err = parseBandwidth(v)
+		case "queue":
+			p.QueueBytes, err = strconv.Atoi(v)
+		default:
+			return Profile{}, fmt.Errorf("profile %q: unknown key %q", spec, k)
+		}
+		if err != nil {
+			return Profile{}, fmt.Errorf("profile %q: %s: %w", spec, k, err)
+		}
+	}
+	return p, nil
+}
+
+// parseBandwidth parses a rate such as "100kbit", "1.5mbit" or "64000".
+func parseBandwidth(s string) (int64, error) {
+	mult := 1.0
+	lower := strings.ToLower(s)
+	for _, u := range []struct {
+		suffix string
+		mult   float64
+	}{{"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1}} {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mult = strings.TrimSuffix(lower, u.suffix), u.mult
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(lower, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f * mult), nil
+}
+
+func (p Profile) String() string {
+	var parts []string
+	if p.Delay > 0 {
+		parts = append(parts, "delay="+p.Delay.String())
+	}
+	if p.Jitter > 0 {
+		parts = append(parts, "jitter="+p.Jitter.String())
+	}
+	if p.Loss > 0 {
+		parts = append(parts, "loss="+strconv.FormatFloat(p.Loss, 'g', -1, 64))
+	}
+	if p.Reorder > 0 {
+		parts = append(parts, "reorder="+strconv.FormatFloat(p.Reorder, 'g', -1, 64))
+	}
+	if p.Bandwidth > 0 {
+		parts = append(parts, "bw="+strconv.FormatInt(p.Bandwidth, 10)+"bit")
+	}
+	if len(parts) == 0 {
+		return "no impairment"
+	}
+	return strings.Join(parts, ",")
+}
+
+// minRTO is the retransmission timeout floor of common TCP stacks.
+const minRTO = 200 * time.Millisecond
+
+// link models one direction of a bottleneck: packets are serialized at the
+// profile's bandwidth behind a bounded queue, then delayed.
+type link struct {
+	p Profile
+
+	// The clock, replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	free time.Time // when the bottleneck finishes sending what is queued
+}
+
+func newLink(p Profile, seed int64) *link {
+	if p.ReorderDelay == 0 {
+		p.ReorderDelay = 20 * time.Millisecond
+	}
+	if p.QueueBytes == 0 {
+		p.QueueBytes = 64 * 1024
+	}
+	return &link{p: p, now: time.Now, sleep: time.Sleep, rng: rand.New(rand.NewSource(seed))}
+}
+
+// schedule returns when a packet of n bytes offered now leaves the link, or
+// drop if it is lost or the bottleneck queue is full. Reliable (TCP)
+// traffic is never dropped: the relay only sees the byte stream, so a lost
+// segment is modelled as being held back for a retransmission (one RTT plus
+// minRTO), and a full queue blocks the caller until there is room.
+func (l *link) schedule(n int, reliable bool) (at time.Time, drop bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var extra time.Duration
+	if l.p.Loss > 0 && l.rng.Float64() < l.p.Loss {
+		if !reliable {
+			return time.Time{}, true
+		}
+		extra = 2*l.p.Delay + minRTO
+	}
+	sent := now
+	if l.p.Bandwidth > 0 {
+		for {
+			l.free = later(l.free, now)
+			backlog := int(l.free.Sub(now).Seconds() * float64(l.p.Bandwidth) / 8)
+			if backlog+n <= l.p.QueueBytes || backlog == 0 {
+				break
+			}
+			if !reliable {
+				return time.Time{}, true
+			}
+			wait := l.txTime(backlog + n - l.p.QueueBytes)
+			l.mu.Unlock()
+			l.sleep(wait)
+			l.mu.Lock()
+			now = l.now()
+		}
+		l.free = l.free.Add(l.txTime(n))
+		sent = l.free
+	}
+	delay := l.p.Delay + extra
+	if l.p.Jitter > 0 {
+		delay += time.Duration(l.rng.Int63n(int64(2*l.p.Jitter)+1)) - l.p.Jitter
+	}
+	if !reliable && l.p.Reorder > 0 && l.rng.Float64() < l.p.Reorder {
+		delay += l.p.ReorderDelay
+	}
+	return sent.Add(max(delay, 0)), false
+}
+
+// txTime returns how long the bottleneck takes to send n bytes.
+func (l *link) txTime(n int) time.Duration {
+	return time.Duration(float64(n) * 8 / float64(l.p.Bandwidth) * float64(time.Second))
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,233 @@
+package netem
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Profile
+	}{
+		{"baseline", Profiles["baseline"]},
+		{"degraded", Profiles["degraded"]},
+		{"delay=50ms", Profile{Name: "delay=50ms", Delay: 50 * time.Millisecond}},
+		{"delay=50ms,jitter=10ms,loss=0.01,reorder=0.02,reorder-delay=5ms,bw=1.5mbit,queue=1000", Profile{
+			Name:  "delay=50ms,jitter=10ms,loss=0.01,reorder=0.02,reorder-delay=5ms,bw=1.5mbit,queue=1000",
+			Delay: 50 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.01, Reorder: 0.02,
+			ReorderDelay: 5 * time.Millisecond, Bandwidth: 1_500_000, QueueBytes: 1000,
+		}},
+	}
+	for _, tt := range tests {
+		got, err := ParseProfile(tt.spec)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseProfile(%q) = %+v, %v; want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ spec, want string }{
+		{"lossy", "unknown profile"},
+		{"delay=50ms,fast", "unknown profile"},
+		{"delay=50", `delay: time: missing unit`},
+		{"loss=x", "loss: strconv.ParseFloat"},
+		{"bw=fast", "bw: strconv.ParseFloat"},
+		{"queue=1k", "queue: strconv.Atoi"},
+		{"mtu=1500", `unknown key "mtu"`},
+	} {
+		if _, err := ParseProfile(tt.spec); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseProfile(%q) error = %v, want %q", tt.spec, err, tt.want)
+		}
+	}
+}
+
+func TestParseBandwidth(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want int64
+	}{
+		{"64000", 64_000},
+		{"800bit", 800},
+		{"100kbit", 100_000},
+		{"1.5mbit", 1_500_000},
+		{"2Gbit", 2_000_000_000},
+	} {
+		if got, err := parseBandwidth(tt.s); err != nil || got != tt.want {
+			t.Errorf("parseBandwidth(%q) = %d, %v; want %d", tt.s, got, err, tt.want)
+		}
+	}
+	if _, err := parseBandwidth("kbit"); err == nil {
+		t.Error("parseBandwidth(kbit) succeeded")
+	}
+}
+
+func TestProfileString(t *testing.T) {
+	if s := Profiles["baseline"].String(); s != "no impairment" {
+		t.Errorf("baseline = %q", s)
+	}
+	if s := Profiles["degraded"].String(); s != "delay=200ms,loss=0.05,bw=100000bit" {
+		t.Errorf("degraded = %q", s)
+	}
+}
+
+// testLink returns a link on a fake clock starting at t0, and the total
+// time its senders slept.
+func testLink(p Profile, seed int64) (*link, *time.Duration) {
+	l := newLink(p, seed)
+	now := t0
+	slept := new(time.Duration)
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) { now = now.Add(d); *slept += d }
+	return l, slept
+}
+
+var t0 = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// near reports whether two times are within a microsecond, allowing for
+// the rounding of bandwidth arithmetic.
+func near(a, b time.Time) bool { return a.Sub(b).Abs() <= time.Microsecond }
+
+func TestScheduleDelay(t *testing.T) {
+	l, _ := testLink(Profile{}, 1)
+	if at, drop := l.schedule(1000, false); drop || !at.Equal(t0) {
+		t.Errorf("no impairment: %v, drop %v", at.Sub(t0), drop)
+	}
+	l, _ = testLink(Profile{Delay: 50 * time.Millisecond}, 1)
+	if at, drop := l.schedule(1000, false); drop || !at.Equal(t0.Add(50*time.Millisecond)) {
+		t.Errorf("delay: %v, drop %v", at.Sub(t0), drop)
+	}
+}
+
+func TestScheduleJitter(t *testing.T) {
+	p := Profile{Delay: 50 * time.Millisecond, Jitter: 10 * time.Millisecond}
+	delays := func(seed int64) []time.Duration {
+		l, _ := testLink(p, seed)
+		var ds []time.Duration
+		for range 1000 {
+			at, _ := l.schedule(100, false)
+			ds = append(ds, at.Sub(t0))
+		}
+		return ds
+	}
+	ds := delays(1)
+	if lo, hi := slices.Min(ds), slices.Max(ds); lo < 40*time.Millisecond || hi > 60*time.Millisecond || hi-lo < 18*time.Millisecond {
+		t.Errorf("delays span [%v, %v], want most of [40ms, 60ms]", lo, hi)
+	}
+	if !slices.Equal(ds, delays(1)) {
+		t.Error("the same seed gave different delays")
+	}
+	if slices.Equal(ds, delays(2)) {
+		t.Error("different seeds gave the same delays")
+	}
+
+	// Jitter larger than the delay never schedules into the past.
+	l, _ := testLink(Profile{Delay: time.Millisecond, Jitter: 10 * time.Millisecond}, 1)
+	for range 100 {
+		if at, _ := l.schedule(100, false); at.Before(t0) {
+			t.Fatalf("scheduled %v before now", at.Sub(t0))
+		}
+	}
+}
+
+func TestScheduleLoss(t *testing.T) {
+	p := Profile{Delay: 50 * time.Millisecond, Loss: 0.1}
+	drops := func(seed int64) []bool {
+		l, _ := testLink(p, seed)
+		var d []bool
+		for range 10000 {
+			_, drop := l.schedule(100, false)
+			d = append(d, drop)
+		}
+		return d
+	}
+	d := drops(3)
+	n := 0
+	for _, drop := range d {
+		if drop {
+			n++
+		}
+	}
+	if rate := float64(n) / float64(len(d)); math.Abs(rate-0.1) > 0.01 {
+		t.Errorf("loss rate %.3f, want 0.1", rate)
+	}
+	if !slices.Equal(d, drops(3)) {
+		t.Error("the same seed dropped different packets")
+	}
+
+	// Reliable traffic is never dropped; a lost segment is held back for a
+	// retransmission.
+	l, _ := testLink(p, 3)
+	retransmit := t0.Add(2*p.Delay + minRTO + p.Delay)
+	for i, lost := range d[:1000] {
+		at, drop := l.schedule(100, true)
+		want := t0.Add(p.Delay)
+		if lost {
+			want = retransmit
+		}
+		if drop || !at.Equal(want) {
+			t.Fatalf("segment %d (lost %v): at %v, drop %v", i, lost, at.Sub(t0), drop)
+		}
+	}
+}
+
+func TestScheduleReorder(t *testing.T) {
+	p := Profile{Delay: 10 * time.Millisecond, Reorder: 0.5, ReorderDelay: 5 * time.Millisecond}
+	l, _ := testLink(p, 1)
+	held := 0
+	for range 1000 {
+		at, _ := l.schedule(100, false)
+		switch at.Sub(t0) {
+		case 15 * time.Millisecond:
+			held++
+		case 10 * time.Millisecond:
+		default:
+			t.Fatalf("delay %v", at.Sub(t0))
+		}
+	}
+	if held < 400 || held > 600 {
+		t.Errorf("%d of 1000 packets held back, want about 500", held)
+	}
+	l, _ = testLink(p, 1)
+	for range 100 {
+		if at, _ := l.schedule(100, true); !at.Equal(t0.Add(10 * time.Millisecond)) {
+			t.Fatalf("reliable segment reordered: %v", at.Sub(t0))
+		}
+	}
+}
+
+func TestScheduleBandwidth(t *testing.T) {
+	// 8000 bit/s sends 100 bytes in 100ms.
+	p := Profile{Delay: 10 * time.Millisecond, Bandwidth: 8000, QueueBytes: 250}
+	l, _ := testLink(p, 1)
+	for i := 1; i <= 2; i++ {
+		at, drop := l.schedule(100, false)
+		if want := t0.Add(time.Duration(i)*100*time.Millisecond + p.Delay); drop || !near(at, want) {
+			t.Errorf("packet %d: at %v, drop %v; want %v", i, at.Sub(t0), drop, want.Sub(t0))
+		}
+	}
+	// 200 bytes are queued, so another 100 overflow the queue.
+	if _, drop := l.schedule(100, false); !drop {
+		t.Error("packet 3 was not dropped from a full queue")
+	}
+
+	// Reliable traffic waits for room instead: 50 bytes' worth.
+	l, slept := testLink(p, 1)
+	l.schedule(100, true)
+	l.schedule(100, true)
+	at, drop := l.schedule(100, true)
+	if want := t0.Add(300*time.Millisecond + p.Delay); drop || !near(at, want) {
+		t.Errorf("segment 3: at %v, drop %v; want %v", at.Sub(t0), drop, want.Sub(t0))
+	}
+	if *slept < 49*time.Millisecond || *slept > 51*time.Millisecond {
+		t.Errorf("slept %v, want 50ms", *slept)
+	}
+
+	// A packet larger than the queue still goes through an idle link.
+	l, _ = testLink(p, 1)
+	if at, drop := l.schedule(1000, false); drop || !near(at, t0.Add(time.Second+p.Delay)) {
+		t.Errorf("large packet: at %v, drop %v", at.Sub(t0), drop)
+	}
+}
@@ -0,0 +1,260 @@
+package netem
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// segmentSize is the largest chunk a TCP relay reads and schedules at once,
+// so loss and bandwidth apply per segment rather than per read.
+const segmentSize = 1448
+
+// udpIdleTimeout is how long a UDP flow may be idle before it is forgotten.
+const udpIdleTimeout = 2 * time.Minute
+
+// Relay forwards traffic from a local listener to a target address,
+// impairing both directions according to a Profile.
+type Relay struct {
+	p      Profile
+	target string
+	ln     io.Closer
+	addr   net.Addr
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[io.Closer]struct{}
+	seed   int64
+}
+
+// Addr returns the address the relay listens on.
+func (r *Relay) Addr() net.Addr { return r.addr }
+
+// Close stops the relay and closes all relayed connections.
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	conns := r.conns
+	r.conns = nil
+	r.mu.Unlock()
+	for c := range conns {
+		c.Close()
+	}
+	return r.ln.Close()
+}
+
+// track registers c to be closed with the relay. It reports false if the
+// relay is already closed.
+func (r *Relay) track(c io.Closer) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.conns[c] = struct{}{}
+	return true
+}
+
+func (r *Relay) untrack(c io.Closer) {
+	r.mu.Lock()
+	delete(r.conns, c)
+	r.mu.Unlock()
+}
+
+// newLinks returns the client-to-target and target-to-client links of a
+// new flow. Seeds are deterministic so runs are reproducible.
+func (r *Relay) newLinks() (up, down *link) {
+	r.mu.Lock()
+	r.seed += 2
+	seed := r.seed
+	r.mu.Unlock()
+	return newLink(r.p, seed), newLink(r.p, seed+1)
+}
+
+// ListenTCP starts a TCP relay on addr forwarding to target.
+func ListenTCP(addr, target string, p Profile) (*Relay, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &Relay{p: p, target: target, ln: ln, addr: ln.Addr(), conns: make(map[io.Closer]struct{})}
+	go r.acceptTCP(ln)
+	return r, nil
+}
+
+func (r *Relay) acceptTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("netem: accept: %v", err)
+			}
+			return
+		}
+		go r.serveTCP(c)
+	}
+}
+
+func (r *Relay) serveTCP(client net.Conn) {
+	server, err := net.Dial("tcp", r.target)
+	if err != nil {
+		log.Printf("netem: dial %s: %v", r.target, err)
+		client.Close()
+		return
+	}
+	if !r.track(client) || !r.track(server) {
+		client.Close()
+		server.Close()
+		return
+	}
+	up, down := r.newLinks()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// The relay completes the client's TCP handshake locally, so hold the
+	// client's first bytes back by the RTT a real handshake would cost.
+	go func() { defer wg.Done(); pipeTCP(server, client, up, 2*r.p.Delay) }()
+	go func() { defer wg.Done(); pipeTCP(client, server, down, 0) }()
+	wg.Wait()
+	client.Close()
+	server.Close()
+	r.untrack(client)
+	r.untrack(server)
+}
+
+type segment struct {
+	data []byte
+	at   time.Time
+}
+
+// pipeTCP copies src to dst through l. Segments are delivered in order, so
+// a delayed segment holds back everything behind it as it would in TCP.
+// The first segment is additionally delayed by hold.
+func pipeTCP(dst, src net.Conn, l *link, hold time.Duration) {
+	segs := make(chan segment, 64)
+	go func() {
+		defer close(segs)
+		for {
+			buf := make([]byte, segmentSize)
+			n, err := src.Read(buf)
+			if n > 0 {
+				at, _ := l.schedule(n, true)
+				segs <- segment{buf[:n], at.Add(hold)}
+				hold = 0
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var last time.Time
+	for seg := range segs {
+		last = later(seg.at, last)
+		time.Sleep(time.Until(last))
+		if _, err := dst.Write(seg.data); err != nil {
+			src.Close()
+			for range segs {
+			}
+			return
+		}
+	}
+	// Propagate the half-close.
+	if tc, ok := dst.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// ListenUDP starts a UDP relay on addr forwarding to target. Each client
+// address gets its own upstream socket, so the target sees one flow per
+// client as it would without the relay.
+func ListenUDP(addr, target string, p Profile) (*Relay, error) {
+	raddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &Relay{p: p, target: target, ln: pc, addr: pc.LocalAddr(), conns: make(map[io.Closer]struct{})}
+	go r.serveUDP(pc, raddr)
+	return r, nil
+}
+
+type udpFlow struct {
+	upstream *net.UDPConn
+	up       *link
+}
+
+func (r *Relay) serveUDP(pc net.PacketConn, target *net.UDPAddr) {
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("netem: read: %v", err)
+			}
+			return
+		}
+		key := from.String()
+		mu.Lock()
+		flow := flows[key]
+		mu.Unlock()
+		if flow == nil {
+			upstream, err := net.DialUDP("udp", nil, target)
+			if err != nil {
+				log.Printf("netem: dial %s: %v", target, err)
+				continue
+			}
+			if !r.track(upstream) {
+				upstream.Close()
+				return
+			}
+			up, down := r.newLinks()
+			flow = &udpFlow{upstream: upstream, up: up}
+			mu.Lock()
+			flows[key] = flow
+			mu.Unlock()
+			go func() {
+				r.replyUDP(pc, from, upstream, down)
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+				r.untrack(upstream)
+				upstream.Close()
+			}()
+		}
+		at, drop := flow.up.schedule(n, false)
+		if drop {
+			continue
+		}
+		data := append([]byte(nil), buf[:n]...)
+		time.AfterFunc(time.Until(at), func() { flow.upstream.Write(data) })
+	}
+}
+
+// replyUDP relays datagrams from the target back to the client until the
+// flow has been idle for udpIdleTimeout.
+func (r *Relay) replyUDP(pc net.PacketConn, client net.Addr, upstream *net.UDPConn, l *link) {
+	buf := make([]byte, 64*1024)
+	for {
+		upstream.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		at, drop := l.schedule(n, false)
+		if drop {
+			continue
+		}
+		data := append([]byte(nil), buf[:n]...)
+		time.AfterFunc(time.Until(at), func() { pc.WriteTo(data, client) })
+	}
+}
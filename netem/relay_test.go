@@ -0,0 +1,127 @@
+package netem
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPRelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() { // echo
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	const delay = 20 * time.Millisecond
+	r, err := ListenTCP("127.0.0.1:0", ln.Addr().String(), Profile{Delay: delay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	c, err := net.Dial("tcp", r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	msg := make([]byte, 3*segmentSize) // several segments
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	// The half-close reaches the echo server, which then closes too.
+	c.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if string(got) != string(msg) {
+		t.Fatalf("echoed %d bytes, want the %d sent", len(got), len(msg))
+	}
+	// The handshake's RTT, then one delay each way.
+	if elapsed < 4*delay {
+		t.Errorf("round trip took %v, want at least %v", elapsed, 4*delay)
+	}
+}
+
+func TestUDPRelay(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() { // echo
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+
+	const delay = 10 * time.Millisecond
+	for _, tt := range []struct {
+		name string
+		p    Profile
+		echo bool
+	}{
+		{"delay", Profile{Delay: delay}, true},
+		{"total loss", Profile{Loss: 1}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ListenUDP("127.0.0.1:0", pc.LocalAddr().String(), tt.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			c, err := net.Dial("udp", r.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			start := time.Now()
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			buf := make([]byte, 64)
+			n, err := c.Read(buf)
+			if !tt.echo {
+				if err == nil {
+					t.Errorf("got %q through a link losing everything", buf[:n])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != "ping" {
+				t.Errorf("echo = %q", buf[:n])
+			}
+			if elapsed := time.Since(start); elapsed < 2*delay {
+				t.Errorf("round trip took %v, want at least %v", elapsed, 2*delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Package origin decides which web origins may use the servers from a
+// browser, and answers CORS requests for those that may. Requests without
+// an Origin header, which don't come from a browser page, and same-origin
+// requests are always allowed.
+package origin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Policy is an allow-list of origins.
+type Policy struct {
+	any       bool
+	exact     map[string]bool // scheme://host[:port]
+	wildcards []wildcard
+}
+
+// wildcard matches the subdomains of a domain, at any depth.
+type wildcard struct {
+	scheme string
+	suffix string // ".example.com"
+	port   string // "" for the scheme's default
+}
+
+// NewPolicy returns a policy allowing the origins matching patterns: an
+// exact origin such as https://app.example.com or http://localhost:3000,
+// a wildcard such as https://*.example.com, which matches every subdomain
+// of example.com but not example.com itself, or * for any origin. A
+// pattern may also be a comma-separated list of them.
+func NewPolicy(patterns []string) (*Policy, error) {
+	p := &Policy{exact: make(map[string]bool)}
+	for _, list := range patterns {
+		for pattern := range strings.SplitSeq(list, ",") {
+			if err := p.add(strings.TrimSpace(pattern)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+func (p *Policy) add(pattern string) error {
+	if pattern == "*" {
+		p.any = true
+		return nil
+	}
+	scheme, host, port, err := parse(pattern)
+	if err != nil {
+		return fmt.Errorf("origin %q: %w", pattern, err)
+	}
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		if rest == "" || strings.Contains(rest, "*") {
+			return fmt.Errorf("origin %q: a wildcard must be followed by a domain", pattern)
+		}
+		p.wildcards = append(p.wildcards, wildcard{scheme, "." + rest, port})
+		return nil
+	}
+	if strings.Contains(host, "*") {
+		return fmt.Errorf("origin %q: a wildcard must be the first label", pattern)
+	}
+	p.exact[format(scheme, host, port)] = true
+	return nil
+}
+
+// parse splits an origin into its lower-case scheme, host and port, with
+// the scheme's default port left out.
+func parse(origin string) (scheme, host, port string, err error) {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", "", "", errors.New("not an http(s) origin")
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", "", "", errors.New("an origin has only a scheme, host and port")
+	}
+	scheme, host, port = u.Scheme, strings.ToLower(u.Hostname()), u.Port()
+	if scheme == "http" && port == "80" || scheme == "https" && port == "443" {
+		port = ""
+	}
+	return scheme, host, port, nil
+}
+
+func format(scheme, host, port string) string {
+	if port != "" {
+		host += ":" + port
+	}
+	return scheme + "://" + host
+}
+
+// sameHost reports whether an origin is the request's own host, r.Host.
+func sameHost(scheme, host, port, requestHost string) bool {
+	h, p, err := net.SplitHostPort(requestHost)
+	if err != nil {
+		h, p = requestHost, ""
+	}
+	if scheme == "http" && p == "80" || scheme == "https" && p == "443" {
+		p = ""
+	}
+	return strings.EqualFold(h, host) && p == port
+}
+
+// Allowed reports whether r may be served: it carries no Origin header,
+// comes from the page's own origin, or comes from an allowed one.
+func (p *Policy) Allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if p.any {
+		return true
+	}
+	scheme, host, port, err := parse(origin)
+	if err != nil {
+		return false // including "null", sent by sandboxed and file pages
+	}
+	if sameHost(scheme, host, port, r.Host) {
+		return true
+	}
+	if p.exact[format(scheme, host, port)] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if w.scheme == scheme && w.port == port && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS adds the CORS headers letting the page that sent r, whose origin
+// must be Allowed, read the response. A preflight request is answered with
+// the methods and request headers allowed, and CORS reports true: the
+// caller must not handle it further.
+func CORS(w http.ResponseWriter, r *http.Request, methods, headers string) (preflight bool) {
+	origin := r.Header.Get("Origin")
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if origin == "" {
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", methods)
+	h.Set("Access-Control-Allow-Headers", headers)
+	h.Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -1,74 +1,496 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"llm-webtransport/auth"
+	"llm-webtransport/generation"
 	"llm-webtransport/llm"
+	"llm-webtransport/logging"
 	"llm-webtransport/message"
+	"llm-webtransport/metrics"
+	"llm-webtransport/origin"
+	"llm-webtransport/tracing"
 
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/webtransport-go"
 )
 
 type serverConfig struct {
-	llmBaseURL string
-	llmModel   string
+	provider llm.Provider
+	llmModel string
+	auth     auth.Authenticator // nil: authentication off
+	origins  *origin.Policy
+}
+
+// sessionState is shared by all streams of a WebTransport session.
+type sessionState struct {
+	session        *webtransport.Session
+	protocol       string        // negotiated application protocol, "" for legacy framing
+	identity       auth.Identity // the authenticated client
+	nextStreamID   atomic.Uint64 // numbers the session's streams in logs
+	nextDatagramID atomic.Uint64 // response IDs tagging datagram-mode tokens
 }
 
 func handleHttpToWebTransportUpgrade(s *webtransport.Server, cfg serverConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if drain.draining() {
+			http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		// The session span is a child of the client's dial, whose trace
+		// context comes in the CONNECT request's headers.
+		ctx, span := tracing.Start(tracing.Extract(context.Background(), r.Header), "webtransport.session", tracing.Server)
+		l := slog.With("session_id", logging.NewID(), "remote", r.RemoteAddr)
+		// Upgrade checks the origin too, but fails without saying why.
+		if !cfg.origins.Allowed(r) {
+			l.Warn("origin rejected", "origin", r.Header.Get("Origin"))
+			metrics.OriginRejections.With(metrics.WebTransport).Inc()
+			span.End(errors.New("origin not allowed"))
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		id, err := auth.Authenticate(cfg.auth, r)
+		if err != nil {
+			l.Warn("authentication failed", "err", err)
+			metrics.AuthFailures.With(metrics.WebTransport, auth.Reason(err)).Inc()
+			span.End(err)
+			auth.Unauthorized(w, err)
+			return
+		}
+		l = l.With("identity", id.Name)
 		session, err := s.Upgrade(w, r)
 		if err != nil {
-			log.Printf("upgrade failed: %v", err)
+			l.Warn("upgrade failed", "err", err)
+			span.End(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		log.Printf("new session from %s", session.RemoteAddr())
-		go handleSession(session, cfg)
+		protocol := session.SessionState().ApplicationProtocol
+		if protocol == "" {
+			l.Info("session opened", "protocol", "legacy")
+		} else {
+			l.Info("session opened", "protocol", protocol)
+		}
+		ctx = logging.NewContext(ctx, l)
+		span.Set("net.peer", session.RemoteAddr().String())
+		span.Set("protocol", protocol)
+		span.Set("identity", id.Name)
+		go func() {
+			handleSession(ctx, session, id, cfg)
+			span.End(nil)
+		}()
 	}
 }
 
-func handleSession(session *webtransport.Session, cfg serverConfig) {
+// handleSession accepts the streams of id's session. ctx carries the
+// session's span and logger.
+func handleSession(ctx context.Context, session *webtransport.Session, id auth.Identity, cfg serverConfig) {
+	if !drain.addSession(session) {
+		session.CloseWithError(message.SessionGoingAway, "server shutting down")
+		return
+	}
+	defer drain.removeSession(session)
+	metrics.ActiveSessions.With(metrics.WebTransport).Inc()
+	defer metrics.ActiveSessions.With(metrics.WebTransport).Dec()
+	sess := &sessionState{
+		session:  session,
+		protocol: session.SessionState().ApplicationProtocol,
+		identity: id,
+	}
 	for {
 		stream, err := session.AcceptStream(context.Background())
 		if err != nil {
-			log.Printf("session closed: %v", err)
+			logging.FromContext(ctx).Info("session closed", "reason", err)
 			return
 		}
-		go func() {
-			defer stream.Close()
-			reader := bufio.NewReader(stream)
-			for {
-				msg, err := message.Read(reader)
+		go handleStream(ctx, sess, stream, cfg)
+	}
+}
+
+// response is a generation's buffered tokens.
+type response = generation.Response[string]
+
+// responses buffers generations so that clients can resume them.
+var responses = generation.NewStore[string]()
+
+// handleStream serves one conversation. Every TOKEN frame read from the
+// stream is a user turn; it is answered in the context of all earlier turns
+// on the same stream, so a client that wants a fresh conversation opens a
+// new stream. The first prompt may instead be a REQUEST envelope carrying
+// the conversation so far and its options; errors on such a stream are
+// JSON. PINGs, METADATA and rejected REQUESTs may precede it. A METADATA
+// frame from the client selects the delivery mode and generation options
+// for subsequent responses, or resumes a response from a lost session.
+// Once the server drains, the stream finishes its current response and
+// then sends GOAWAY instead of reading another prompt. Each response's span
+// is a child of the trace context sent with its prompt, or of the session's
+// span in ctx.
+func handleStream(ctx context.Context, sess *sessionState, stream *webtransport.Stream, cfg serverConfig) {
+	l := logging.FromContext(ctx).With("stream_id", sess.nextStreamID.Add(1))
+	defer stream.Close()
+	watch := drain.addStream(stream)
+	defer drain.removeStream(watch)
+	metrics.ActiveStreams.With(metrics.WebTransport).Inc()
+	defer metrics.ActiveStreams.With(metrics.WebTransport).Dec()
+	framer, err := message.NewFramer(stream, sess.protocol)
+	if err != nil {
+		l.Warn("stream setup failed", "err", err)
+		return
+	}
+	var history []llm.Message
+	var opts llm.Options
+	var conversationID, traceparent string
+	delivery := message.DeliveryStream
+	prompted := false // a prompt was accepted or a response resumed
+	for {
+		if drain.draining() {
+			goAway(framer)
+			return
+		}
+		watch.setIdle(true)
+		readStart := time.Now()
+		frame, err := framer.ReadFrame()
+		watch.setIdle(false)
+		received := time.Now()
+		if err != nil {
+			if drain.draining() {
+				goAway(framer)
+				return
+			}
+			if err != io.EOF {
+				l.Warn("stream read failed", "err", err)
+			}
+			return
+		}
+		var prompt string
+		switch frame.Type {
+		case message.FrameToken:
+			prompt = string(frame.Payload)
+		case message.FramePing:
+			continue
+		case message.FrameRequest:
+			framer.SetJSONErrors()
+			if prompted {
+				framer.WriteErr(invalidRequest("", "request must be the first prompt on a stream"))
+				continue
+			}
+			var req message.Request
+			if err := frame.DecodeJSON(&req); err != nil {
+				framer.WriteErr(invalidRequest("", "invalid request: "+err.Error()))
+				continue
+			}
+			if e := req.Validate(); e != nil {
+				framer.WriteErr(e)
+				continue
+			}
+			if err := cfg.provider.CheckOptions(req.Options); err != nil {
+				framer.WriteErr(invalidRequest("options", err.Error()))
+				continue
+			}
+			last := len(req.Messages) - 1
+			history, prompt = req.Messages[:last], req.Messages[last].Content
+			opts, conversationID, traceparent = req.Options, req.ConversationID, req.Traceparent
+			if req.Delivery != "" {
+				delivery = req.Delivery
+			}
+		case message.FrameMetadata:
+			var md message.Metadata
+			if err := frame.DecodeJSON(&md); err != nil {
+				framer.WriteErr(invalidRequest("", "invalid metadata: "+err.Error()))
+				continue
+			}
+			if md.ResponseID != "" {
+				if len(history) > 0 {
+					framer.WriteErr(invalidRequest("response_id", "resume must be the first request on a stream"))
+					continue
+				}
+				resp, err := responses.Lookup(md.ResponseID, sess.identity.Name)
+				if err == nil && (md.Offset < 0 || md.Offset > resp.Len()) {
+					err = fmt.Errorf("offset %d is outside response %q", md.Offset, md.ResponseID)
+				}
 				if err != nil {
-					if err != io.EOF {
-						log.Printf("stream read error: %v", err)
-					}
-					return
+					framer.WriteErr(&message.Error{Code: message.ErrNotFound, Param: "response_id", Message: err.Error()})
+					continue
 				}
-				inputBytes := len(msg)
-				log.Printf("received: %s (%d bytes)", msg, inputBytes)
-
-				stats, err := llm.StreamChatCompletion(cfg.llmBaseURL, cfg.llmModel, msg, func(token string) error {
-					return message.Write(stream, token)
-				})
+				opts, conversationID = resp.Opts, resp.ConversationID
+				chatCtx, span := tracing.Start(tracing.WithTraceparent(ctx, md.Traceparent), "chat", tracing.Server)
+				span.Set("response.id", resp.ID)
+				span.Set("resume.offset", md.Offset)
+				rl := logging.WithTrace(chatCtx, l.With("request_id", resp.ID))
+				rl.Info("resuming response", "offset", md.Offset)
+				prompted = true
+				history, err = serveResponse(sess, stream, framer, resp, md.Offset, time.Time{}, nil)
+				span.End(err)
 				if err != nil {
-					log.Printf("llm error: %v", err)
-					message.Write(stream, "\n[error: "+err.Error()+"]")
+					rl.Warn("response delivery failed", "err", err)
+					return
 				}
+				continue
+			}
+			switch md.Delivery {
+			case "":
+			case message.DeliveryStream, message.DeliveryDatagram:
+				delivery = md.Delivery
+			default:
+				framer.WriteErr(invalidRequest("delivery", "unknown delivery mode "+md.Delivery))
+			}
+			if md.Options != nil {
+				if err := md.Options.Validate(); err != nil {
+					framer.WriteErr(invalidRequest("options", err.Error()))
+				} else if err := cfg.provider.CheckOptions(*md.Options); err != nil {
+					framer.WriteErr(invalidRequest("options", err.Error()))
+				} else {
+					opts = *md.Options
+				}
+			}
+			if len(md.History) > 0 {
+				if err := seedHistory(&history, md.History); err != nil {
+					framer.WriteErr(invalidRequest("history", err.Error()))
+				}
+			}
+			if md.Traceparent != "" {
+				traceparent = md.Traceparent
+			}
+			continue
+		default:
+			l.Warn("unexpected frame from client", "type", frame.Type.String())
+			framer.WriteErr(invalidRequest("", "unexpected "+frame.Type.String()+" frame"))
+			continue
+		}
 
-				log.Printf("stats: input=%d bytes, from_llm=%d bytes, to_client=%d bytes, prompt_tokens=%d, completion_tokens=%d",
-					inputBytes, stats.BytesReceived, stats.BytesSent, stats.PromptTokens, stats.CompletionTokens)
+		prompted = true
+		history = append(history, llm.Message{Role: llm.RoleUser, Content: prompt})
+		inputBytes := 0
+		for _, m := range history {
+			inputBytes += len(m.Content)
+		}
 
-				// Send an empty message to signal end of response
-				if err := message.Write(stream, ""); err != nil {
-					log.Printf("stream write error: %v", err)
-					return
-				}
+		o := opts
+		if o.Model == "" {
+			o.Model = cfg.llmModel
+		}
+		metrics.Requests.With(metrics.WebTransport, metrics.Model(o.Model), metrics.Identity(sess.identity.Name)).Inc()
+
+		parent := tracing.WithTraceparent(ctx, traceparent)
+		traceparent = ""
+		_, readSpan := tracing.StartAt(parent, "message.read", tracing.Internal, readStart)
+		readSpan.End(nil)
+		chatCtx, span := tracing.StartAt(parent, "chat", tracing.Server, received)
+
+		resp := responses.Start(history, o, conversationID, sess.identity.Name)
+		span.Set("response.id", resp.ID)
+		span.Set("llm.model", o.Model)
+		span.Set("delivery", delivery)
+		rl := logging.WithTrace(chatCtx, l.With("request_id", resp.ID))
+		if conversationID != "" {
+			span.Set("conversation.id", conversationID)
+			rl = rl.With("conversation_id", conversationID)
+		}
+		rl.Info("request received", logging.Prompt(prompt), "input_bytes", inputBytes, "turn", len(history)/2+1, "model", o.Model, "delivery", delivery)
+		go generate(logging.NewContext(chatCtx, rl), resp, cfg, inputBytes)
+
+		var dg *datagramSender
+		if delivery == message.DeliveryDatagram {
+			dg = &datagramSender{session: sess.session, id: sess.nextDatagramID.Add(1), log: rl}
+		}
+		history, err = serveResponse(sess, stream, framer, resp, 0, received, dg)
+		span.End(err)
+		if err != nil {
+			rl.Warn("response delivery failed", "err", err)
+			return
+		}
+	}
+}
+
+func invalidRequest(param, msg string) *message.Error {
+	return &message.Error{Code: message.ErrInvalidRequest, Param: param, Message: msg}
+}
+
+// generate runs the LLM request for resp, buffering its tokens. It is
+// cancelled only when no stream is delivering the response (see
+// serveResponse). Its span is a child of the one in reqCtx, and its
+// outcome is logged, in a single record, by reqCtx's logger.
+func generate(reqCtx context.Context, resp *response, cfg serverConfig, inputBytes int) {
+	stats, err := generation.Run(reqCtx, resp, cfg.provider, metrics.WebTransport, inputBytes, resp.Append)
+	switch {
+	case stats.Cancelled:
+		err = &message.Error{Code: message.ErrCancelled, Message: "response cancelled"}
+	case err != nil:
+		err = &message.Error{Code: message.ErrLLM, Message: err.Error()}
+	}
+	responses.Release(resp, message.NewUsageStats(stats), err)
+}
+
+// serveResponse delivers resp on the stream from token offset from on, as
+// datagrams if dg is set, followed by its outcome. received is when the
+// prompt arrived, for the TTFT metric, or zero for a resumed response. It
+// returns the stream's conversation afterwards: resp's messages and the
+// reply, or just the earlier turns if generation failed. An error means the
+// stream is unusable.
+func serveResponse(sess *sessionState, stream *webtransport.Stream, framer *message.Framer, resp *response, from int, received time.Time, dg *datagramSender) ([]llm.Message, error) {
+	md := message.Metadata{Model: resp.Opts.Model, Delivery: message.DeliveryStream, ResponseID: resp.ID, ConversationID: resp.ConversationID}
+	write := framer.WriteToken
+	if dg != nil {
+		md.Delivery, md.DatagramID = message.DeliveryDatagram, dg.id
+		write = dg.send
+	}
+	timer := metrics.NewTokenTimer(metrics.WebTransport, resp.Opts.Model, received)
+	send := func(token string) error {
+		if err := write(token); err != nil {
+			return err
+		}
+		timer.Written()
+		return nil
+	}
+	// Attached from the start, so that failing to deliver any of the
+	// response, even its METADATA, cancels the generation.
+	resp.Attach()
+	err := framer.WriteJSON(message.FrameMetadata, md)
+	if err == nil {
+		err = follow(stream.Context(), resp, from, send)
+	}
+	var window time.Duration
+	if err != nil && sessionLost(sess.session, err) {
+		window = *resumeWindow
+	}
+	resp.Detach(window)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, usage, err := resp.Result()
+	history := slices.Clone(resp.Messages)
+	if err != nil {
+		// Drop the unanswered turn so the history stays well-formed.
+		var e *message.Error
+		if !errors.As(err, &e) {
+			e = &message.Error{Code: message.ErrLLM, Message: err.Error()}
+		}
+		return history[:len(history)-1], framer.WriteErr(e)
+	}
+	history = append(history, llm.Message{Role: llm.RoleAssistant, Content: strings.Join(tokens, "")})
+
+	// With no tokens there is nothing to repair, and a zero TokenCount
+	// would not even be sent.
+	if dg != nil && len(dg.tokens) > 0 {
+		if err := dg.repair(framer); err != nil {
+			return nil, fmt.Errorf("datagram repair failed: %w", err)
+		}
+	}
+	if err := framer.WriteJSON(message.FrameUsageStats, usage); err != nil {
+		return nil, err
+	}
+	return history, framer.WriteEnd()
+}
+
+// sessionLost reports whether err ended a stream because its session went
+// away, rather than because the client reset the stream to give up on the
+// response.
+func sessionLost(session *webtransport.Session, err error) bool {
+	var strErr *quic.StreamError
+	if errors.As(err, &strErr) && strErr.ErrorCode == webtransport.WTSessionGoneErrorCode {
+		return true
+	}
+	return session.Context().Err() != nil
+}
+
+// follow sends resp's tokens from offset from on, waiting for more until
+// the generation ends or ctx is done.
+func follow(ctx context.Context, resp *response, from int, send func(string) error) error {
+	for {
+		tokens, changed, done := resp.Since(from)
+		for _, token := range tokens {
+			if err := send(token); err != nil {
+				return err
 			}
-		}()
+			from++
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// seedHistory starts a stream's conversation from turns sent by the client.
+// It must happen before the first prompt, and the turns must form a valid
+// conversation once the next user message is appended.
+func seedHistory(history *[]llm.Message, turns []llm.Message) error {
+	if len(*history) > 0 {
+		return errors.New("history must be sent before the first prompt")
+	}
+	if err := llm.ValidateMessages(append(slices.Clone(turns), llm.Message{Role: llm.RoleUser, Content: "?"})); err != nil {
+		return err
+	}
+	*history = turns
+	return nil
+}
+
+// datagramSender delivers one response's tokens as unreliable datagrams and
+// keeps them so that lost ones can be resent over the stream.
+type datagramSender struct {
+	session *webtransport.Session
+	id      uint64
+	log     *slog.Logger
+	tokens  []string
+	buf     []byte
+}
+
+func (d *datagramSender) send(token string) error {
+	seq := uint64(len(d.tokens))
+	d.tokens = append(d.tokens, token)
+	d.buf = message.AppendDatagram(d.buf[:0], d.id, seq, token)
+	err := d.session.SendDatagram(d.buf)
+	// A token too large for a datagram is left for the repair phase.
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return nil
+	}
+	return err
+}
+
+// repair announces how many tokens were sent, waits for the client's list of
+// missing sequence numbers and resends those tokens as REPAIR frames.
+func (d *datagramSender) repair(framer *message.Framer) error {
+	if err := framer.WriteJSON(message.FrameMetadata, message.Metadata{TokenCount: len(d.tokens)}); err != nil {
+		return err
+	}
+	frame, err := framer.ReadFrame()
+	for err == nil && frame.Type == message.FramePing {
+		frame, err = framer.ReadFrame()
+	}
+	if err != nil {
+		return err
+	}
+	var md message.Metadata
+	if frame.Type != message.FrameMetadata {
+		return errors.New("expected repair request, got " + frame.Type.String())
+	}
+	if err := frame.DecodeJSON(&md); err != nil {
+		return err
+	}
+	for _, seq := range md.Missing {
+		if seq >= uint64(len(d.tokens)) {
+			continue
+		}
+		if err := framer.WriteFrame(message.RepairFrame(seq, d.tokens[seq])); err != nil {
+			return err
+		}
 	}
+	d.log.Info("datagram response repaired", "datagram_id", d.id, "tokens", len(d.tokens), "repaired", len(md.Missing))
+	return nil
 }
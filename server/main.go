@@ -1,24 +1,79 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"llm-webtransport/auth"
+	"llm-webtransport/config"
+	"llm-webtransport/llm"
+	"llm-webtransport/logging"
+	"llm-webtransport/message"
+	"llm-webtransport/metrics"
+
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/quic-go/webtransport-go"
 )
 
+var (
+	addr         = config.Addr("addr", ":4433", "UDP address to listen on")
+	metricsAddr  = config.Addr("metrics-addr", ":9090", "TCP address serving Prometheus metrics at /metrics over plain HTTP")
+	resumeWindow = flag.Duration("resume-window", 30*time.Second, "How long a generation whose session was lost keeps running, waiting for the client to resume it (0 cancels it at once)")
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "On SIGINT or SIGTERM, how long in-flight responses may take to finish before sessions are closed")
+	llmConf      = config.LLMFlags()
+	tlsConf      = config.TLSFlags()
+	traceConf    = config.TracingFlags()
+	logConf      = config.LogFlags()
+	authConf     = config.AuthFlags()
+	originConf   = config.OriginFlags()
+)
+
 func main() {
-	tlsCert, err := tls.LoadX509KeyPair("certs/cert.pem", "certs/key.pem")
+	config.Parse()
+	if err := logging.Setup(os.Stderr, *logConf); err != nil {
+		log.Fatal(err)
+	}
+	provider, err := llmConf.Provider()
 	if err != nil {
-		log.Fatalf("failed to load TLS certificate: %v (run ./generate_cert.sh first)", err)
+		logging.Fatal("invalid LLM settings", "err", err)
+	}
+	authenticator, err := authConf.Load()
+	if err != nil {
+		logging.Fatal("auth setup failed", "err", err)
+	}
+	origins, err := originConf.Policy()
+	if err != nil {
+		logging.Fatal("invalid origins", "err", err)
+	}
+	flushTraces, err := traceConf.Start("server")
+	if err != nil {
+		logging.Fatal("tracing setup failed", "err", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := llm.CheckModel(ctx, provider, llmConf.Model); err != nil {
+		slog.Warn("model check failed", "err", err)
+	}
+	cancel()
+	metrics.SetModels(llmConf.Model)
+	metrics.SetIdentities(auth.Anonymous.Name)
+	metrics.SetIdentities(auth.Names(authenticator)...)
+
+	tlsCert, err := tlsConf.Load()
+	if err != nil {
+		logging.Fatal("TLS setup failed", "err", err)
 	}
 
 	h3srv := &http3.Server{
-		Addr: ":4433",
+		Addr: *addr,
 		TLSConfig: &tls.Config{
 			Certificates: []tls.Certificate{tlsCert},
 			NextProtos:   []string{"h3"},
@@ -32,18 +87,44 @@ func main() {
 
 	s := webtransport.Server{
 		H3:          h3srv,
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin: origins.Allowed,
+		// Clients that negotiate no protocol get the legacy text framing.
+		ApplicationProtocols: []string{message.ProtocolV1},
 	}
 
 	cfg := serverConfig{
-		llmBaseURL: "http://127.0.0.1:11434",
-		llmModel:   "gemma3:12b",
+		provider: provider,
+		llmModel: llmConf.Model,
+		auth:     authenticator,
+		origins:  origins,
 	}
 
 	http.HandleFunc("/wt", handleHttpToWebTransportUpgrade(&s, cfg))
 
-	log.Println("WebTransport server listening on :4433")
-	if err := s.ListenAndServe(); err != nil {
-		log.Fatalf("server error: %v", err)
-	}
+	go func() {
+		// Scrapers don't speak HTTP/3, so metrics get a TCP listener.
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		slog.Info("metrics listening", "addr", *metricsAddr)
+		if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+			logging.Fatal("metrics server failed", "err", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		slog.Info("WebTransport server listening", "addr", *addr)
+		if err := s.ListenAndServe(); err != nil && !drain.draining() {
+			logging.Fatal("server failed", "err", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop() // a second signal kills the server at once
+	slog.Info("shutting down", "drain_timeout", *drainTimeout)
+	drain.shutdown(*drainTimeout)
+	s.Close()
+	flushTraces()
+	slog.Info("server stopped")
 }
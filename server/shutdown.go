@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"llm-webtransport/message"
+
+	"github.com/quic-go/webtransport-go"
+)
+
+// drainState tracks sessions and streams so that the server can shut down
+// gracefully. Once draining starts no new sessions are accepted, and each
+// stream finishes its current response, sends GOAWAY and closes.
+type drainState struct {
+	ctx   context.Context // done once draining starts
+	start context.CancelFunc
+
+	mu       sync.Mutex
+	sessions map[*webtransport.Session]struct{}
+	streams  int
+	idle     chan struct{} // closed when draining and no streams are left
+}
+
+var drain = newDrainState()
+
+func newDrainState() *drainState {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &drainState{
+		ctx:      ctx,
+		start:    cancel,
+		sessions: make(map[*webtransport.Session]struct{}),
+		idle:     make(chan struct{}),
+	}
+}
+
+func (d *drainState) draining() bool { return d.ctx.Err() != nil }
+
+// addSession registers a session, or reports false if the server is
+// draining.
+func (d *drainState) addSession(s *webtransport.Session) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining() {
+		return false
+	}
+	d.sessions[s] = struct{}{}
+	return true
+}
+
+func (d *drainState) removeSession(s *webtransport.Session) {
+	d.mu.Lock()
+	delete(d.sessions, s)
+	d.mu.Unlock()
+}
+
+// addStream registers a stream; the returned watch must be ended by the
+// stream's handler.
+func (d *drainState) addStream(stream *webtransport.Stream) *streamWatch {
+	d.mu.Lock()
+	d.streams++
+	d.mu.Unlock()
+	w := &streamWatch{drain: d, stream: stream}
+	w.stop = context.AfterFunc(d.ctx, w.wake)
+	return w
+}
+
+func (d *drainState) removeStream(w *streamWatch) {
+	w.stop()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.streams--
+	d.checkIdle()
+}
+
+// checkIdle closes idle once draining has started and no streams are left.
+// d.mu must be held.
+func (d *drainState) checkIdle() {
+	if d.streams > 0 || !d.draining() {
+		return
+	}
+	select {
+	case <-d.idle:
+	default:
+		close(d.idle)
+	}
+}
+
+// shutdown starts draining and waits up to timeout for the streams to
+// finish. It then closes the remaining sessions with SessionGoingAway.
+func (d *drainState) shutdown(timeout time.Duration) {
+	d.mu.Lock()
+	d.start()
+	d.checkIdle()
+	d.mu.Unlock()
+
+	select {
+	case <-d.idle:
+		slog.Info("all streams drained")
+	case <-time.After(timeout):
+		d.mu.Lock()
+		slog.Warn("drain deadline passed", "open_streams", d.streams)
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	sessions := make([]*webtransport.Session, 0, len(d.sessions))
+	for s := range d.sessions {
+		sessions = append(sessions, s)
+	}
+	d.mu.Unlock()
+	for _, s := range sessions {
+		s.CloseWithError(message.SessionGoingAway, "server shutting down")
+	}
+}
+
+// streamWatch interrupts a stream that is waiting for its next prompt when
+// draining starts, without disturbing reads in the middle of a response.
+type streamWatch struct {
+	drain  *drainState
+	stream *webtransport.Stream
+	stop   func() bool
+
+	mu   sync.Mutex
+	idle bool
+}
+
+// setIdle marks whether the stream is between responses.
+func (w *streamWatch) setIdle(idle bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.idle = idle
+	if idle && w.drain.draining() {
+		w.stream.SetReadDeadline(time.Now())
+	}
+}
+
+func (w *streamWatch) wake() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.idle {
+		w.stream.SetReadDeadline(time.Now())
+	}
+}
+
+// goAway tells the client that the stream takes no more prompts.
+func goAway(framer *message.Framer) {
+	framer.WriteFrame(message.Frame{Type: message.FrameGoAway, Payload: []byte("server shutting down")})
+}
@@ -0,0 +1,162 @@
+// Package sse reads and writes server-sent events as specified by the HTML
+// Living Standard (https://html.spec.whatwg.org/multipage/server-sent-events.html).
+//
+// Data containing newlines is written as one data: line per line, and the
+// reader joins them back together. Carriage returns have no encoding in SSE
+// data and are read back as newlines, so token events carry their token as
+// a JSON string (see TokenData), which keeps every byte.
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// Event names used between httpserver and its clients.
+const (
+	EventToken  = "token"  // data: a response token as a JSON string
+	EventError  = "error"  // data: error message; the response is over
+	EventUsage  = "usage"  // data: JSON message.UsageStats
+	EventDone   = "done"   // end of response, empty data
+	EventGoAway = "goaway" // data: reason; the server is shutting down, the response continues
+)
+
+// Event is a single server-sent event. An empty Event name means the
+// default "message" type.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// TokenData returns the data of a token event: the token as a JSON string.
+func TokenData(token string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(token)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// ParseToken returns the token carried by a token event's data.
+func ParseToken(data string) (string, error) {
+	var token string
+	err := json.Unmarshal([]byte(data), &token)
+	return token, err
+}
+
+// Encode returns the wire form of ev. It always includes a data field, so
+// events with empty data are still dispatched by spec-compliant readers.
+func Encode(ev Event) []byte {
+	var b strings.Builder
+	if ev.ID != "" {
+		b.WriteString("id: " + ev.ID + "\n")
+	}
+	if ev.Event != "" {
+		b.WriteString("event: " + ev.Event + "\n")
+	}
+	data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r", "\n"), "\n") {
+		if line == "" {
+			b.WriteString("data:\n")
+		} else {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// WriteEvent writes ev to w in a single Write call.
+func WriteEvent(w io.Writer, ev Event) error {
+	_, err := w.Write(Encode(ev))
+	return err
+}
+
+// Reader parses events from a stream.
+type Reader struct {
+	r      *bufio.Reader
+	lastID string
+	skipLF bool // the last line ended in CR, so a following LF is part of it
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next dispatched event. Comments and events without data
+// are skipped, as a browser's EventSource would. At the end of the stream
+// it returns io.EOF; an event cut off by EOF is discarded.
+func (r *Reader) Next() (Event, error) {
+	var (
+		ev      Event
+		data    strings.Builder
+		hasData bool
+	)
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return Event{}, err
+		}
+		if line == "" {
+			if !hasData {
+				ev = Event{}
+				continue
+			}
+			ev.ID = r.lastID
+			ev.Data = strings.TrimSuffix(data.String(), "\n")
+			return ev, nil
+		}
+		if line[0] == ':' {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			ev.Event = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				r.lastID = value
+			}
+		}
+	}
+}
+
+// LastEventID returns the most recent id field seen, which a client sends
+// as Last-Event-ID when reconnecting.
+func (r *Reader) LastEventID() string { return r.lastID }
+
+// readLine reads a line terminated by CRLF, LF or CR, without the
+// terminator. A final unterminated line is dropped. It never reads past
+// the terminator, so a live stream doesn't block on a trailing CR.
+func (r *Reader) readLine() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := r.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		skipLF := r.skipLF
+		r.skipLF = false
+		switch c {
+		case '\n':
+			if skipLF && b.Len() == 0 {
+				continue
+			}
+			return b.String(), nil
+		case '\r':
+			r.skipLF = true
+			return b.String(), nil
+		}
+		b.WriteByte(c)
+	}
+}
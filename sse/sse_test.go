@@ -0,0 +1,105 @@
+package sse
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	events := []Event{
+		{Data: "plain"},
+		{ID: "r1:0", Event: EventToken, Data: "Hello"},
+		{Event: EventError, Data: "line one\nline two"},
+		{Data: "\ntrailing and leading\n"},
+		{Event: EventDone},
+		{Data: " leading space"},
+		{Data: "a: colon"},
+	}
+	var wire strings.Builder
+	for _, ev := range events {
+		wire.Write(Encode(ev))
+	}
+	r := NewReader(strings.NewReader(wire.String()))
+	lastID := ""
+	for i, want := range events {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		// The last ID carries over to events without one.
+		if want.ID != "" {
+			lastID = want.ID
+		}
+		want.ID = lastID
+		if got != want {
+			t.Errorf("event %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("after the last event: %v, want io.EOF", err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name string
+		wire string
+		want []Event
+	}{
+		{"multi-line data", "data: a\ndata: b\ndata\n\n", []Event{{Data: "a\nb\n"}}},
+		{"named events", "event: usage\ndata: {}\n\nevent: done\ndata:\n\n", []Event{{Event: "usage", Data: "{}"}, {Event: "done"}}},
+		{"ids", "id: 1\ndata: a\n\ndata: b\n\nid\ndata: c\n\n", []Event{{ID: "1", Data: "a"}, {ID: "1", Data: "b"}, {Data: "c"}}},
+		{"id with NUL ignored", "id: 1\ndata: a\n\nid: x\x00y\ndata: b\n\n", []Event{{ID: "1", Data: "a"}, {ID: "1", Data: "b"}}},
+		{"comments", ": keepalive\ndata: a\n: more\n\n", []Event{{Data: "a"}}},
+		{"no data is not dispatched", "event: token\n\ndata: a\n\n", []Event{{Data: "a"}}},
+		{"unknown fields", "retry: 100\nfoo: bar\ndata: a\n\n", []Event{{Data: "a"}}},
+		{"CRLF", "event: token\r\ndata: a\r\ndata: b\r\n\r\n", []Event{{Event: "token", Data: "a\nb"}}},
+		{"CR", "data: a\rdata: b\r\r", []Event{{Data: "a\nb"}}},
+		{"mixed", "data: a\r\ndata: b\rdata: c\n\r\n", []Event{{Data: "a\nb\nc"}}},
+		{"cut off", "data: a\n\ndata: b\n", []Event{{Data: "a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.wire))
+			for i, want := range tt.want {
+				got, err := r.Next()
+				if err != nil {
+					t.Fatalf("event %d: %v", i, err)
+				}
+				if got != want {
+					t.Errorf("event %d = %+v, want %+v", i, got, want)
+				}
+			}
+			if ev, err := r.Next(); err != io.EOF {
+				t.Errorf("extra event %+v, err %v", ev, err)
+			}
+		})
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	for _, token := range []string{"", "Hello", " world", "a\nb", "a\r\nb", "\r", "x\ry", `"quoted"`, "<b>&</b>", "\x00\t", "naïve 🙂"} {
+		ev := Event{Event: EventToken, Data: TokenData(token)}
+		got, err := NewReader(strings.NewReader(string(Encode(ev)))).Next()
+		if err != nil {
+			t.Fatalf("%q: %v", token, err)
+		}
+		parsed, err := ParseToken(got.Data)
+		if err != nil {
+			t.Fatalf("%q: %v", token, err)
+		}
+		if parsed != token {
+			t.Errorf("token %q came back as %q", token, parsed)
+		}
+	}
+}
+
+func TestTokenDataIsOneLine(t *testing.T) {
+	if got := TokenData("a\r\nb<"); got != `"a\r\nb<"` {
+		t.Errorf("TokenData = %s", got)
+	}
+	if _, err := ParseToken("not json"); err == nil {
+		t.Error("ParseToken accepted a bare string")
+	}
+}
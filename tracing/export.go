@@ -0,0 +1,286 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	batchSize     = 512
+	batchInterval = 2 * time.Second
+	queueSize     = 4096
+)
+
+// exp is the running exporter, nil until Setup.
+var exp atomic.Pointer[exporter]
+
+// exporter batches ended spans and writes them as OTLP/JSON
+// ExportTraceServiceRequests.
+type exporter struct {
+	service  string
+	endpoint string // OTLP/HTTP traces URL, or ""
+	file     io.WriteCloser
+	client   *http.Client
+
+	mu      sync.RWMutex // held for writing to close queue
+	closed  bool
+	queue   chan *otlpSpan
+	dropped atomic.Int64
+	done    chan struct{}
+}
+
+// Setup starts recording spans for the named service and exporting them
+// to an OTLP/HTTP collector (endpoint, such as http://localhost:4318; the
+// /v1/traces path is added unless present), to a file (one JSON request per
+// line, as read by the collector's otlpjsonfile receiver), or both. With
+// neither, tracing stays off. The returned function flushes the remaining
+// spans and stops exporting.
+func Setup(service, endpoint, file string) (shutdown func(), err error) {
+	if endpoint == "" && file == "" {
+		return func() {}, nil
+	}
+	e := &exporter{
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan *otlpSpan, queueSize),
+		done:    make(chan struct{}),
+	}
+	if endpoint != "" {
+		e.endpoint = strings.TrimSuffix(endpoint, "/")
+		if !strings.HasSuffix(e.endpoint, "/v1/traces") {
+			e.endpoint += "/v1/traces"
+		}
+	}
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("trace file: %w", err)
+		}
+		e.file = f
+	}
+	if !exp.CompareAndSwap(nil, e) {
+		if e.file != nil {
+			e.file.Close()
+		}
+		return nil, errors.New("tracing already set up")
+	}
+	go e.run()
+	return e.shutdown, nil
+}
+
+// export queues an ended span, dropping it if the queue is full.
+func (e *exporter) export(s *Span, end time.Time) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- s.otlp(end):
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+	var batch []*otlpSpan
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				e.write(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		e.write(batch)
+		batch = nil
+	}
+}
+
+// shutdown stops recording and waits for the queued spans to be written.
+func (e *exporter) shutdown() {
+	exp.CompareAndSwap(e, nil)
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	close(e.queue)
+	e.mu.Unlock()
+
+	<-e.done
+	if e.file != nil {
+		e.file.Close()
+	}
+	if n := e.dropped.Load(); n > 0 {
+		slog.Warn("tracing: spans dropped", "count", n)
+	}
+}
+
+func (e *exporter) write(batch []*otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{keyValue("service.name", e.service)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "llm-webtransport"},
+			Spans: batch,
+		}},
+	}}})
+	if err != nil {
+		slog.Warn("tracing: encode failed", "err", err)
+		return
+	}
+	if e.file != nil {
+		if _, err := e.file.Write(append(body, '\n')); err != nil {
+			slog.Warn("tracing: write failed", "err", err)
+		}
+	}
+	if e.endpoint != "" {
+		if err := e.post(body); err != nil {
+			slog.Warn("tracing: export failed", "spans", len(batch), "err", err)
+		}
+	}
+}
+
+func (e *exporter) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP/JSON encoding of ExportTraceServiceRequest. IDs are hex and 64-bit
+// integers are strings, as the protobuf JSON mapping requires.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope   `json:"scope"`
+		Spans []*otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              Kind           `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		String *string  `json:"stringValue,omitempty"`
+		Bool   *bool    `json:"boolValue,omitempty"`
+		Int    *string  `json:"intValue,omitempty"`
+		Double *float64 `json:"doubleValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 2: error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func (s *Span) otlp(end time.Time) *otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := &otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for _, a := range s.attrs {
+		o.Attributes = append(o.Attributes, keyValue(a.key, a.value))
+	}
+	if s.err != nil {
+		o.Status = &otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return o
+}
+
+func keyValue(key string, value any) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	var i int64
+	switch v := value.(type) {
+	case string:
+		kv.Value.String = &v
+		return kv
+	case bool:
+		kv.Value.Bool = &v
+		return kv
+	case float64:
+		kv.Value.Double = &v
+		return kv
+	case int:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint64:
+		i = int64(v)
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.String = &s
+		return kv
+	}
+	s := strconv.FormatInt(i, 10)
+	kv.Value.Int = &s
+	return kv
+}
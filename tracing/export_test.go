@@ -0,0 +1,119 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExportFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "spans.jsonl")
+	shutdown, err := Setup("test-service", "", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Setup("again", "", file); err == nil {
+		t.Error("second Setup succeeded")
+	}
+
+	parent, err := ParseTraceparent(testTraceparent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := ContextWithSpanContext(context.Background(), parent)
+	start := time.Unix(1700000000, 5)
+	ctx, span := StartAt(ctx, "op", Server, start)
+	span.Set("s", "text")
+	span.Set("b", true)
+	span.Set("i", 42)
+	span.Set("f", 0.5)
+	span.Set("d", time.Second)
+	span.End(errors.New("boom"))
+	span.End(nil) // ignored
+	_, child := Start(ctx, "child", Client)
+	child.End(nil)
+	shutdown()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req otlpRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("request shape: %s", data)
+	}
+	rs := req.ResourceSpans[0]
+	if a := rs.Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || *a[0].Value.String != "test-service" {
+		t.Errorf("resource attributes = %+v", a)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2: %s", len(spans), data)
+	}
+
+	s := spans[0]
+	if s.Name != "op" || s.Kind != Server || s.TraceID != testTraceID || s.ParentSpanID != testSpanID {
+		t.Errorf("span = %+v", s)
+	}
+	if len(s.SpanID) != 16 || s.SpanID == testSpanID {
+		t.Errorf("spanId = %q", s.SpanID)
+	}
+	if s.StartTimeUnixNano != strconv.FormatInt(start.UnixNano(), 10) {
+		t.Errorf("startTimeUnixNano = %q", s.StartTimeUnixNano)
+	}
+	if s.Status == nil || s.Status.Code != 2 || s.Status.Message != "boom" {
+		t.Errorf("status = %+v", s.Status)
+	}
+	attrs := map[string]otlpValue{}
+	for _, a := range s.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	if v := attrs["s"].String; v == nil || *v != "text" {
+		t.Errorf("string attribute = %+v", attrs["s"])
+	}
+	if v := attrs["b"].Bool; v == nil || !*v {
+		t.Errorf("bool attribute = %+v", attrs["b"])
+	}
+	if v := attrs["i"].Int; v == nil || *v != "42" {
+		t.Errorf("int attribute = %+v", attrs["i"])
+	}
+	if v := attrs["f"].Double; v == nil || *v != 0.5 {
+		t.Errorf("float attribute = %+v", attrs["f"])
+	}
+	if v := attrs["d"].String; v == nil || *v != "1s" {
+		t.Errorf("other attribute = %+v", attrs["d"])
+	}
+
+	c := spans[1]
+	if c.TraceID != testTraceID || c.ParentSpanID != s.SpanID || c.Kind != Client || c.Status != nil {
+		t.Errorf("child span = %+v", c)
+	}
+
+	if _, span := Start(context.Background(), "after", Internal); span != nil {
+		t.Error("span recorded after shutdown")
+	}
+}
+
+// TestEncoding checks the JSON field names and types that collectors read.
+func TestEncoding(t *testing.T) {
+	s := &Span{name: "op", kind: Internal, start: time.Unix(0, 1)}
+	s.sc.TraceID[15], s.sc.SpanID[7] = 1, 2
+	s.Set("n", 7)
+	data, err := json.Marshal(s.otlp(time.Unix(0, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"traceId":"00000000000000000000000000000001","spanId":"0000000000000002","name":"op","kind":1,` +
+		`"startTimeUnixNano":"1","endTimeUnixNano":"3","attributes":[{"key":"n","value":{"intValue":"7"}}]}`
+	if string(data) != want {
+		t.Errorf("got  %s\nwant %s", data, want)
+	}
+}
@@ -0,0 +1,229 @@
+// Package tracing records spans and propagates W3C trace context
+// (traceparent) across the binaries, so that the time to first token can
+// be split into handshake, stream setup, server queueing and LLM latency.
+// Spans are exported as OTLP/JSON to a collector or a file; see Setup.
+// Until Setup is called nothing is recorded, and every *Span is nil, whose
+// methods do nothing.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// SpanContext is the part of a span that crosses process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a traceparent header value, or "" if it is not
+// valid.
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value. Versions after 00
+// may append fields, which are ignored.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return sc, errors.New("malformed traceparent")
+	}
+	if !isHex(parts[1], 32) {
+		return sc, errors.New("malformed traceparent trace ID")
+	}
+	if !isHex(parts[2], 16) {
+		return sc, errors.New("malformed traceparent span ID")
+	}
+	if !isHex(parts[3], 2) {
+		return sc, errors.New("malformed traceparent flags")
+	}
+	hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	var flags [1]byte
+	hex.Decode(flags[:], []byte(parts[3]))
+	sc.Sampled = flags[0]&1 != 0
+	if !sc.IsValid() {
+		return sc, errors.New("traceparent has a zero ID")
+	}
+	return sc, nil
+}
+
+// isHex reports whether s is n lowercase hex digits, as traceparent fields
+// must be.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type contextKey struct{}
+
+// ContextWithSpanContext returns ctx with sc as the parent of spans
+// started from it.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx, which is
+// not valid if there is none.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(contextKey{}).(SpanContext)
+	return sc
+}
+
+// Traceparent returns the traceparent of the span carried by ctx, or "".
+func Traceparent(ctx context.Context) string {
+	return SpanContextFromContext(ctx).Traceparent()
+}
+
+// WithTraceparent returns ctx with the remote span in traceparent as the
+// parent of spans started from it. An empty or malformed traceparent leaves
+// ctx as it is.
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	sc, err := ParseTraceparent(traceparent)
+	if err != nil {
+		return ctx
+	}
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// Inject sets the traceparent header of an outgoing request to the span
+// carried by ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if tp := Traceparent(ctx); tp != "" {
+		h.Set("traceparent", tp)
+	}
+}
+
+// Extract returns ctx with the span in an incoming request's traceparent
+// header as the parent of spans started from it.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	return WithTraceparent(ctx, h.Get("traceparent"))
+}
+
+// Kind says which side of a request a span covers.
+type Kind int
+
+// Span kinds, numbered as in OTLP.
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+	Client   Kind = 3
+)
+
+// Span is one timed operation.
+type Span struct {
+	sc     SpanContext
+	parent SpanID
+	name   string
+	kind   Kind
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs []attribute
+	err   error
+	ended bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Start starts a span that is a child of the span carried by ctx, or the
+// root of a new trace, and returns a context carrying it.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	return StartAt(ctx, name, kind, time.Now())
+}
+
+// StartAt is like Start for a span that began at start, for operations
+// whose parent is only known once they are done.
+func StartAt(ctx context.Context, name string, kind Kind, start time.Time) (context.Context, *Span) {
+	if exp.Load() == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFromContext(ctx)
+	s := &Span{name: name, kind: kind, start: start}
+	if parent.IsValid() {
+		s.sc.TraceID, s.sc.Sampled = parent.TraceID, parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		binary.BigEndian.PutUint64(s.sc.TraceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.sc.TraceID[8:], rand.Uint64())
+		s.sc.Sampled = true
+	}
+	binary.BigEndian.PutUint64(s.sc.SpanID[:], rand.Uint64()|1) // never zero
+	return ContextWithSpanContext(ctx, s.sc), s
+}
+
+// Set records an attribute: a string, bool, integer or float64, or any
+// other value as its string form.
+func (s *Span) Set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attribute{key, value})
+	s.mu.Unlock()
+}
+
+// End ends the span, with an error status if err is not nil. Only the
+// first call counts.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.err = true, err
+	s.mu.Unlock()
+	if s.sc.Sampled {
+		if e := exp.Load(); e != nil {
+			e.export(s, end)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID      = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		in      string
+		sampled bool
+	}{
+		{testTraceparent, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03", true}, // unknown flags ignored
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true},
+	}
+	for _, tt := range tests {
+		sc, err := ParseTraceparent(tt.in)
+		if err != nil {
+			t.Errorf("ParseTraceparent(%q): %v", tt.in, err)
+			continue
+		}
+		if sc.TraceID.String() != testTraceID || hex.EncodeToString(sc.SpanID[:]) != testSpanID || sc.Sampled != tt.sampled {
+			t.Errorf("ParseTraceparent(%q) = %+v", tt.in, sc)
+		}
+	}
+}
+
+func TestParseTraceparentErrors(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "malformed traceparent"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "malformed traceparent"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "malformed traceparent"},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "malformed traceparent"},
+		{"0-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "malformed traceparent"},
+		{"zz-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "malformed traceparent"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", "trace ID"},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "trace ID"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01", "span ID"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1", "flags"},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "zero ID"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "zero ID"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseTraceparent(tt.in); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseTraceparent(%q) error = %v, want %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	sc, err := ParseTraceparent(testTraceparent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sc.Traceparent(); got != testTraceparent {
+		t.Errorf("Traceparent() = %q, want %q", got, testTraceparent)
+	}
+	if got := (SpanContext{}).Traceparent(); got != "" {
+		t.Errorf("zero SpanContext: Traceparent() = %q, want \"\"", got)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	h := http.Header{}
+	Inject(context.Background(), h)
+	if _, ok := h["Traceparent"]; ok {
+		t.Errorf("Inject without a span set %q", h.Get("traceparent"))
+	}
+
+	h.Set("traceparent", testTraceparent)
+	ctx := Extract(context.Background(), h)
+	out := http.Header{}
+	Inject(ctx, out)
+	if got := out.Get("traceparent"); got != testTraceparent {
+		t.Errorf("Inject(Extract()) = %q, want %q", got, testTraceparent)
+	}
+
+	ctx = WithTraceparent(context.Background(), "garbage")
+	if SpanContextFromContext(ctx).IsValid() {
+		t.Error("WithTraceparent accepted a malformed traceparent")
+	}
+}
+
+func TestStartWithoutSetup(t *testing.T) {
+	ctx, span := Start(context.Background(), "noop", Internal)
+	if span != nil || SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("Start before Setup = %v, %+v", span, SpanContextFromContext(ctx))
+	}
+	span.Set("key", "value")
+	span.End(nil)
+}